@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sync"
+)
+
+// buildGroup shares the result of builds with the same key between
+// concurrent callers, so resources deploying the same system to different
+// hosts only build it once.
+type buildGroup struct {
+	mu    sync.Mutex
+	calls map[string]*buildCall
+}
+
+type buildCall struct {
+	wg     sync.WaitGroup
+	result string
+	err    error
+}
+
+// runOnce runs work at most once per key and terraform operation, like the
+// pre_build_hook of a resource that is both planned and applied.
+type runOnce struct {
+	mu    sync.Mutex
+	calls map[string]*onceCall
+}
+
+// onceCall is the work of one key, its lock is held while it runs.
+type onceCall struct {
+	mu   sync.Mutex
+	done bool
+}
+
+func newRunOnce() *runOnce {
+	return &runOnce{calls: make(map[string]*onceCall)}
+}
+
+// Do runs f unless it already succeeded for key, waiting for f to finish if
+// it is already running for key. Work for other keys runs concurrently. A
+// nil runOnce always runs f.
+func (o *runOnce) Do(key string, f func() error) error {
+	if o == nil {
+		return f()
+	}
+
+	o.mu.Lock()
+	c, ok := o.calls[key]
+	if !ok {
+		c = &onceCall{}
+		o.calls[key] = c
+	}
+	o.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		return nil
+	}
+	err := f()
+	if err == nil {
+		c.done = true
+	}
+	return err
+}
+
+func newBuildGroup() *buildGroup {
+	return &buildGroup{calls: make(map[string]*buildCall)}
+}
+
+// Do runs build, unless a build with the same key is already running, in
+// which case it waits for that build and returns its result. A nil group
+// always runs build.
+func (g *buildGroup) Do(key string, build func() (string, error)) (string, error) {
+	if g == nil {
+		return build()
+	}
+
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.result, c.err
+	}
+	c := &buildCall{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.result, c.err = build()
+	c.wg.Done()
+
+	// Later plans build again, the inputs may have changed on disk.
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+
+	return c.result, c.err
+}
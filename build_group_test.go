@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunOnce(t *testing.T) {
+	o := newRunOnce()
+	runs := 0
+	fail := errors.New("hook failed")
+
+	// Failures are retried, success is remembered.
+	for _, expected := range []error{fail, nil, nil} {
+		err := o.Do("a", func() error {
+			runs++
+			if runs == 1 {
+				return fail
+			}
+			return nil
+		})
+		if err != expected {
+			t.Fatalf("expected %v, got %v", expected, err)
+		}
+	}
+	if runs != 2 {
+		t.Fatalf("expected 2 runs, got %d", runs)
+	}
+}
+
+func TestRunOnceConcurrentKeys(t *testing.T) {
+	o := newRunOnce()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error)
+
+	// Work for another key runs while the first is still running.
+	go func() {
+		done <- o.Do("a", func() error {
+			close(started)
+			select {
+			case <-release:
+				return nil
+			case <-time.After(5 * time.Second):
+				return errors.New("b did not run while a was running")
+			}
+		})
+	}()
+	<-started
+	err := o.Do("b", func() error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunOnceSameKey(t *testing.T) {
+	o := newRunOnce()
+	var mu sync.Mutex
+	runs := 0
+
+	// Concurrent callers of a key wait for the first run instead of
+	// running it again.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = o.Do("a", func() error {
+				mu.Lock()
+				runs++
+				mu.Unlock()
+				time.Sleep(10 * time.Millisecond)
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	if runs != 1 {
+		t.Fatalf("expected 1 run, got %d", runs)
+	}
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"errors"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/andrewchambers/terraform-provider-nix/nix"
 	"github.com/hashicorp/terraform/helper/schema"
@@ -15,40 +18,147 @@ func dataSourceNixBuild() *schema.Resource {
 				Type:     schema.TypeString,
 				Optional: true,
 			},
+			"expression": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"expression_path", "flake"},
+			},
 			"expression_path": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"flake"},
+			},
+			"attribute": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"flake": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"attr": &schema.Schema{
 				Type:     schema.TypeString,
-				Required: true,
+				Optional: true,
+			},
+			"argstr": &schema.Schema{
+				Type:         schema.TypeMap,
+				Optional:     true,
+				Elem:         &schema.Schema{Type: schema.TypeString},
+				ValidateFunc: validateNixIdentifierKeys,
+			},
+			"extra_nix_options": &schema.Schema{
+				Type:     schema.TypeMap,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			"experimental_features": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
 			},
 			"store_path": &schema.Schema{
 				Type:     schema.TypeString,
 				Computed: true,
 			},
+			"out_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"outputs": &schema.Schema{
+				Type:     schema.TypeMap,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
 		},
 	}
 }
 
 func dataNixBuildRead(d *schema.ResourceData, m interface{}) error {
-	nixPath := os.Getenv("NIX_PATH")
-	if p, ok := d.GetOk("nix_path"); ok {
-		nixPath = p.(string)
+	cfg, err := getDerivationConfig(d, m)
+	if err != nil {
+		return err
 	}
 
-	expressionPath := d.Get("expression_path").(string)
-
-	storePath, err := nix.BuildExpression(nixPath, expressionPath, nil)
+	outputs, err := nix.BuildDerivation(cfg)
 	if err != nil {
 		return err
 	}
 
+	outPath, ok := outputs["out"]
+	if !ok {
+		// Derivations without an out output use their first output.
+		for _, name := range sortedKeys(outputs) {
+			outPath = outputs[name]
+			break
+		}
+	}
+
 	id := d.Id()
 	if id == "" {
 		d.SetId(randomID())
 	}
 
-	err = d.Set("store_path", storePath)
+	err = d.Set("store_path", outPath)
+	if err != nil {
+		return err
+	}
+
+	err = d.Set("out_path", outPath)
+	if err != nil {
+		return err
+	}
+
+	err = d.Set("outputs", outputs)
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// getDerivationConfig reads the expression, expression_path or flake of the
+// nix_build and nix_eval data sources.
+func getDerivationConfig(d resourceLike, m interface{}) (*nix.DerivationConfig, error) {
+	nixPath := os.Getenv("NIX_PATH")
+	if p, ok := d.GetOk("nix_path"); ok {
+		nixPath = p.(string)
+	}
+
+	providerConfig := getProviderConfig(m)
+	cfg := &nix.DerivationConfig{
+		NixPath:              nixPath,
+		Expression:           d.Get("expression").(string),
+		Attribute:            d.Get("attribute").(string),
+		ArgsStr:              stringMap(d.Get("argstr")),
+		ExtraNixOptions:      stringMap(d.Get("extra_nix_options")),
+		ExperimentalFeatures: append(append([]string{}, providerConfig.ExperimentalFeatures...), stringList(d.Get("experimental_features"))...),
+		MaxJobs:              providerConfig.MaxJobs,
+		Cores:                providerConfig.Cores,
+	}
+
+	if p, ok := d.GetOk("expression_path"); ok {
+		var err error
+		cfg.File, err = filepath.Abs(p.(string))
+		if err != nil {
+			return nil, err
+		}
+	} else if flake, ok := d.GetOk("flake"); ok {
+		attr := d.Get("attr").(string)
+		if attr == "" {
+			return nil, errors.New("attr must be set when using flake")
+		}
+		ref := flake.(string)
+		if strings.HasPrefix(ref, ".") || strings.HasPrefix(ref, "/") {
+			var err error
+			ref, err = filepath.Abs(ref)
+			if err != nil {
+				return nil, err
+			}
+		}
+		cfg.Flake = ref + "#" + attr
+	} else if cfg.Expression == "" {
+		return nil, errors.New("one of expression, expression_path or flake must be set")
+	}
+
+	return cfg, nil
+}
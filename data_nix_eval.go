@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// Evaluate nix code into a value terraform can use.
+func dataSourceNixEval() *schema.Resource {
+	return &schema.Resource{
+		Read: dataNixEvalRead,
+		Schema: map[string]*schema.Schema{
+			"nix_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"expression": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"expression_path", "flake"},
+			},
+			"expression_path": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"flake"},
+			},
+			"attribute": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"flake": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"attr": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"argstr": &schema.Schema{
+				Type:         schema.TypeMap,
+				Optional:     true,
+				Elem:         &schema.Schema{Type: schema.TypeString},
+				ValidateFunc: validateNixIdentifierKeys,
+			},
+			"extra_nix_options": &schema.Schema{
+				Type:     schema.TypeMap,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			"experimental_features": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			"impure": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"value_json": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"value": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func dataNixEvalRead(d *schema.ResourceData, m interface{}) error {
+	cfg, err := getDerivationConfig(d, m)
+	if err != nil {
+		return err
+	}
+	cfg.Impure = d.Get("impure").(bool)
+
+	valueJSON, err := nix.EvalJSON(cfg)
+	if err != nil {
+		return err
+	}
+
+	// value is only set for strings, other values are read with jsondecode.
+	var value string
+	if json.Unmarshal([]byte(valueJSON), &value) != nil {
+		value = ""
+	}
+
+	id := d.Id()
+	if id == "" {
+		d.SetId(randomID())
+	}
+
+	err = d.Set("value_json", valueJSON)
+	if err != nil {
+		return err
+	}
+
+	err = d.Set("value", value)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// Build a nixos system locally without deploying it anywhere.
+func dataSourceNixOSSystem() *schema.Resource {
+	return &schema.Resource{
+		Read: dataNixOSSystemRead,
+		Schema: map[string]*schema.Schema{
+			"nixos_config": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"nixos_config_path", "flake"},
+			},
+			"nixos_config_expr": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"nixos_config", "nixos_config_path", "flake"},
+			},
+			"nixos_config_path": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"flake"},
+			},
+			"flake": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"flake_attr": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"nix_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"nix_path_entries": &schema.Schema{
+				Type:          schema.TypeMap,
+				Optional:      true,
+				Elem:          &schema.Schema{Type: schema.TypeString},
+				ConflictsWith: []string{"nix_path"},
+			},
+			"build_args": &schema.Schema{
+				Type:         schema.TypeMap,
+				Optional:     true,
+				Elem:         &schema.Schema{Type: schema.TypeString},
+				ValidateFunc: validateNixIdentifierKeys,
+			},
+			"build_args_str": &schema.Schema{
+				Type:         schema.TypeMap,
+				Optional:     true,
+				Elem:         &schema.Schema{Type: schema.TypeString},
+				ValidateFunc: validateNixIdentifierKeys,
+			},
+			"extra_nix_options": &schema.Schema{
+				Type:     schema.TypeMap,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			"system": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"store_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"drv_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func dataNixOSSystemRead(d *schema.ResourceData, m interface{}) error {
+	nixPath, nixPathEntries, err := getNixPath(d, "")
+	if err != nil {
+		return err
+	}
+
+	flake, err := getFlakeRef(d, "")
+	if err != nil {
+		return err
+	}
+
+	config, ok := d.GetOk("nixos_config_expr")
+	if !ok {
+		config, ok = d.GetOk("nixos_config")
+	}
+	nixosConfigPath := ""
+	if flake == "" {
+		if p, ok := d.GetOk("nixos_config_path"); ok {
+			nixosConfigPath, err = filepath.Abs(p.(string))
+		} else if ok {
+			nixosConfigPath, err = filepath.Abs(inlineConfigPath(config.(string)))
+			if err == nil {
+				err = os.MkdirAll(filepath.Dir(nixosConfigPath), 0755)
+			}
+			if err == nil {
+				err = ioutil.WriteFile(nixosConfigPath, []byte(config.(string)), 0644)
+			}
+		} else {
+			err = errors.New("one of nixos_config, nixos_config_expr, nixos_config_path or flake must be set")
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	providerConfig := getProviderConfig(m)
+	cfg := &nix.NixosRebuildConfig{
+		BuildHost:            "localhost",
+		NixosConfigPath:      nixosConfigPath,
+		NixPath:              nixPath,
+		NixPathEntries:       nixPathEntries,
+		Flake:                flake,
+		BuildArgs:            stringMap(d.Get("build_args")),
+		BuildArgsStr:         stringMap(d.Get("build_args_str")),
+		ExtraNixOptions:      stringMap(d.Get("extra_nix_options")),
+		System:               d.Get("system").(string),
+		ExperimentalFeatures: providerConfig.ExperimentalFeatures,
+		UseNewCLI:            providerConfig.UseNewCLI,
+		MaxJobs:              providerConfig.MaxJobs,
+		Cores:                providerConfig.Cores,
+	}
+
+	storePath, err := providerConfig.builds.Do("build:"+cfg.BuildKey(), func() (string, error) {
+		return nix.BuildSystem(cfg)
+	})
+	if err != nil {
+		return err
+	}
+
+	drvPath, err := nix.SystemDrvPath(cfg)
+	if err != nil {
+		return err
+	}
+
+	if d.Id() == "" {
+		d.SetId(randomID())
+	}
+
+	err = d.Set("store_path", storePath)
+	if err != nil {
+		return err
+	}
+
+	err = d.Set("drv_path", drvPath)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
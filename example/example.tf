@@ -9,6 +9,49 @@ provider "google" {
   region  = "us-central1"
 }
 
+provider "nix" {
+  # Optional values, with defaults.
+
+  # Build systems and check targets are reachable, but never modify any nix_nixos
+  # targets. The same as setting dry_run on every nix_nixos resource.
+  # dry_run = false
+
+  # Experimental nix features enabled for every nix command the provider runs
+  # locally, placed before any other flags. nix_nixos also accepts this, the
+  # lists are combined.
+  # experimental_features = ["nix-command", "flakes"]
+
+  # Build nix_nixos systems with nix build instead of nixos-rebuild build when
+  # the build host is localhost. The nix-command experimental feature (and flakes,
+  # for flake configurations) is enabled automatically for these builds.
+  # use_new_cli = false
+
+  # Defaults for --max-jobs and --cores on every build, used by resources that
+  # don't set their own. Zero uses the nix configuration.
+  # max_jobs = 0
+  # cores = 0
+
+  # The number of nix builds the provider runs at once, further builds wait
+  # for one to finish. Reads and garbage collection are not limited. Zero
+  # removes the limit.
+  # max_concurrent_builds = 2
+
+  # The nix commands to run, instead of those found in PATH. nix-instantiate,
+  # nix-store and nix-copy-closure are run from the directory of
+  # nix_build_binary when it is set. Configuring the provider fails if nix,
+  # nix-build or a set nixos_rebuild_binary is not found.
+  # nix_binary = "/nix/var/nix/profiles/default/bin/nix"
+  # nix_build_binary = "/nix/var/nix/profiles/default/bin/nix-build"
+  # nixos_rebuild_binary = "/run/current-system/sw/bin/nixos-rebuild"
+
+  # Fail configuring the provider unless nix --version satisfies this
+  # constraint.
+  # required_nix_version = ">= 2.4"
+
+  # How nix_nixos resources plan, see plan_mode on nix_nixos.
+  # plan_mode = "build"
+}
+
 resource "nix_build" "nixpkgs" {
   # Path to the nix expression to build.
   # If expression is set, this is an output path of
@@ -125,6 +168,17 @@ resource "nix_nixos" "nixos" {
   # Same as nix_build resource.
   nix_path = "nixpkgs=${nix_build.nixpkgs.store_path}:sshpubkey=${pathexpand("${var.ssh_pub_key}")}"
 
+  # The nix path as a map of names to paths, each passed to nix as -I name=path
+  # in place of NIX_PATH. Relative paths are made absolute. Conflicts with
+  # nix_path.
+  # nix_path_entries = {
+  #   nixpkgs = "./nixpkgs"
+  # }
+
+  # Relative paths in nixos_config_path, flake and nix_path_entries are resolved
+  # against this directory instead of the directory terraform runs in.
+  # config_dir = path.module
+
   # An optional configuration to write to nixos_config_path.
   # If this is not set, the configuration is assumed to already exist.
   # 
@@ -154,10 +208,53 @@ resource "nix_nixos" "nixos" {
   EOF
 
   # Path to your nixos config. If nixos_config is set, this is written, otherwise
-  # this file is assumed to exist.
+  # this file must already exist when planning. If nixos_config is set and this is not, the
+  # config is written to a stable path under the terraform data directory.
+  # This may also be a prebuilt system in the nix store, which is copied to the
+  # target and activated without evaluating anything.
   nixos_config_path = "./configuration-generated.nix"
 
-  # You can run code locally before or after a switch completes.
+  # A whole configuration given inline instead of nixos_config and
+  # nixos_config_path, for example one rendered from a template. It is
+  # written to a stable path under the terraform data directory, so plan and
+  # apply build the same system, and the file is removed once the config
+  # changes. Conflicts with nixos_config, nixos_config_path and flake.
+  # nixos_config_expr = templatefile("./configuration.nix.tpl", { motd = "hello" })
+
+  # Build the nixos configuration flake_attr from a flake instead of nixos_config_path,
+  # using nixos-rebuild --flake. Local flake paths are resolved to absolute paths,
+  # and nix_path is not used. Conflicts with nixos_config, nixos_config_expr and
+  # nixos_config_path.
+  # flake = "./infra"
+  # flake_attr = "nixosConfigurations.web1"
+
+  # Replace flake inputs when building, passed as --override-input name ref.
+  # Only valid together with flake.
+  # override_inputs = {
+  #   nixpkgs = "github:NixOS/nixpkgs/<rev>"
+  # }
+
+  # Pass --impure to flake evaluations so they can read the environment or
+  # the network. Evaluations without a flake are always impure.
+  # impure = false
+
+  # Arguments for configurations that are functions, passed as --arg name expression
+  # and --argstr name value to both plan time builds and switches.
+  # build_args = {
+  #   enableDebug = "true"
+  # }
+  # build_args_str = {
+  #   hostName = "web1"
+  # }
+
+  # How flake builds treat flake.lock. locked never changes it and fails the plan
+  # if it is missing inputs, update recreates it and no-write allows changes
+  # without writing them.
+  # lock_file_mode = "locked"
+
+  # You can run code locally before or after a switch completes, the hook
+  # attributes always run here, use the pre_switch and post_switch blocks
+  # below to run them on the target instead.
   # The default is to do nothing, but this shows how you may use it to ssh into the host.
   # The pre/post switch hooks are good places to load secrets or other things you may need to do.
   pre_switch_hook = <<-EOF
@@ -170,19 +267,826 @@ resource "nix_nixos" "nixos" {
 
   # post_switch_hook = ""
 
+  # Or several hooks, run in order until one fails. The failing hook is
+  # named in the error by its index, like the single hooks above their
+  # commands are sensitive. Hooks without a #! line run with sh.
+  # pre_switch_hooks = ["./snapshot-db.sh", "echo switching $NIX_TARGET_HOST"]
+  # post_switch_hooks = []
+
+  # Or hook blocks, run in the order they are written, each here by default,
+  # where = "local", or with where = "remote" on the target. Remote hooks
+  # connect like the switch, with its escalation and agent forwarding, and run
+  # with sh, without the NIX_ variables local hooks get. Their commands are
+  # sent to the target on stdin, not on the ssh command line. Both kinds fail
+  # the same way, are stopped after command_timeout, and are named by their
+  # index in errors, their commands are sensitive.
+  # pre_switch {
+  #   command = "./snapshot-db.sh"
+  # }
+  # pre_switch {
+  #   command = "systemctl stop lb-agent"
+  #   where   = "remote"  # Defaults to "local".
+  # }
+  # post_switch {
+  #   command = "systemctl start lb-agent"
+  #   where   = "remote"
+  # }
+
+  # Run locally before the system is evaluated or built, at plan time and at
+  # apply time, but at most once per resource in a terraform run. Use it to
+  # generate parts of the config, NIX_RESOLVED_CONFIG is set to the config path
+  # or flake reference that will be built. A failure stops the plan or apply
+  # with its output.
+  # pre_build_hook = ""
+
+  # Forward the local ssh agent to the target for the hooks, through
+  # NIX_SSHOPTS, and for the activation, for example to fetch from private git
+  # repositories. Closure copies and other connections don't forward it. The
+  # target can use the agent while connected, so only enable this for trusted
+  # hosts.
+  # forward_agent = false
+
   # Used by nixos-rebuild switch and nixos-rebuild build as --build-host.
   # build_host = "localhost"
 
+  # Build the system on the target itself, instead of copying the closure from
+  # build_host. The configuration is still evaluated locally, so only derivations
+  # are copied to the target. Plans evaluate the system path without building.
+  # build_on_target = false
+
+  # Remote builders passed as --builders to both plan time builds and switches,
+  # instead of using /etc/nix/machines. Use [""] to disable remote builders.
+  # builders = ["ssh://builder aarch64-linux /etc/keys/builder 8"]
+  # builders_use_substitutes = false
+
+  # Build paths that can't be substituted from a binary cache from source,
+  # passed as --fallback to plan time builds and switches.
+  # fallback = false
+
+  # The nix sandbox setting for builds, "true", "false" or "relaxed". Unset
+  # uses the nix configuration.
+  # sandbox = "relaxed"
+
+  # Seconds a plan time build or evaluation, or the build before a switch, may
+  # take before it is killed. Zero never kills them.
+  # build_timeout = 0
+
+  # Keep building independent derivations after one fails, passed as
+  # --keep-going, so one run reports every failed derivation.
+  # keep_going = false
+
+  # The nix system to build for, passed to <nixpkgs/nixos> as the system
+  # argument. Flakes set it in the configuration instead. Before switching the
+  # provider checks it matches uname -m on the target.
+  # system = "aarch64-linux"
+
+  # Build parallelism, passed as --max-jobs and --cores to plan time builds and
+  # switches. Zero uses the provider setting, or the nix configuration.
+  # max_jobs = 0
+  # cores = 0
+
   # Time to wait for ssh to become responsive. 
   # ssh_timeout = 180
 
+  # Wait up to ssh_timeout for the target to become reachable when refreshing.
+  # With false a refresh tries to connect only briefly, and an unreachable
+  # target keeps its recorded nixos_system, so refreshing a fleet with a few
+  # hosts down is fast and doesn't plan switches for them. Applies still wait.
+  # wait_for_ssh = true
+
+  # Manage the machine running terraform itself. Commands for the target run
+  # here instead of over ssh, with the escalation if target_user isn't root,
+  # nothing is copied, and ssh is never waited for, so reconfiguring sshd is
+  # safe. target_host only names the machine. A needed reboot is logged
+  # instead of done, as it would stop terraform.
+  # local = false
+
+  # A user to fall back to when creating the resource fails to connect as
+  # target_user, such as the ubuntu or ec2-user of a fresh cloud image,
+  # before the new system creates target_user. The wait for ssh, copy and
+  # switch then connect as it, with sudo unless escalation is set, and
+  # bootstrap_ssh_opts before the other ssh options. Later operations, and
+  # every update, connect as target_user only, so broken credentials on an
+  # existing host still fail. connected_user records who was used.
+  # bootstrap_user = ""
+  # bootstrap_ssh_opts = ""
+
+  # Seconds between attempts to reach the target while waiting for ssh. The
+  # wait doubles after each failed attempt up to ssh_poll_max_interval, with
+  # random jitter, until ssh_timeout runs out.
+  # ssh_poll_interval = 2
+  # ssh_poll_max_interval = 30
+
   # Options passed to ssh when checking or switching your installation.
   # ssh_opts     = "-o StrictHostKeyChecking=accept-new -o BatchMode=yes"
 
-  # Run nix-collect-garbage -d on target host before installing an update.
+  # The ssh options as separate arguments instead of ssh_opts, for values
+  # with spaces. They are shell quoted where needed, also in NIX_SSHOPTS, so
+  # arguments with spaces need a nix and nixos-rebuild that split NIX_SSHOPTS
+  # with shell quoting.
+  # ssh_args = ["-o", "StrictHostKeyChecking=accept-new", "-o", "BatchMode=yes"]
+
+  # A private key ssh uses for the target instead of the agent or
+  # ~/.ssh, passed with -i and -o IdentitiesOnly=yes. The key is written to a
+  # file only readable by you while the provider uses it. ssh_private_key_file
+  # names an existing key file instead.
+  # ssh_private_key = "${var.deploy_key}"
+  # ssh_private_key_file = "~/.ssh/deploy"
+
+  # Reach the target through a bastion with ssh -o ProxyJump, for every
+  # connection including those of nix-copy-closure and nixos-rebuild. The
+  # bastion authenticates with your ssh agent or ~/.ssh/config, not
+  # ssh_private_key. bastion_jumps is a chain of [user@]host[:port] jumps in
+  # the order they are made, instead of bastion_host.
+  # bastion_host = "bastion.example.com"
+  # bastion_user = ""
+  # bastion_port = 22
+  # bastion_jumps = ["admin@bastion.example.com", "10.0.0.1:2222"]
+
+  # Connect to the target through a command, for example an IAP tunnel, with
+  # %h and %p replaced by ssh. It is set with a generated ssh config passed
+  # as -F, which includes ~/.ssh/config and /etc/ssh/ssh_config, so it also
+  # reaches nix-copy-closure and nixos-rebuild. Can't be combined with a
+  # bastion.
+  # proxy_command = "cloudflared access ssh --hostname %h"
+
+  # Share one ssh connection between all the commands run on the target,
+  # with ControlMaster=auto and a ControlPersist of 60 seconds, saving a
+  # handshake per command on slow links. ssh falls back to separate
+  # connections if the shared one can't be set up. The shared connections
+  # are closed once terraform is done with the provider or interrupts it.
+  # ssh_multiplex = false
+
+  # Pin the host key of the target instead of trusting it on first use. Either
+  # the public key, as in /etc/ssh/ssh_host_ed25519_key.pub, which is written
+  # to a temporary known_hosts file, or its SHA256 fingerprint, which needs
+  # OpenSSH 8.5 or later. A mismatch fails every connection to the target.
+  # host_key = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIEExampleExampleExampleExampleExample"
+
+  # How host keys are trusted. "system" uses your known_hosts files as usual.
+  # "isolated" keeps the keys of targets in a known_hosts file per host under
+  # the terraform data dir. "replace-on-mismatch" forgets a changed host key
+  # and connects again once, for targets recreated at the same address.
+  # known_hosts_mode = "system"
+
+  # The ssh client used to connect to the target. "openssh" runs the ssh
+  # binary. "go-ssh" connects with golang.org/x/crypto/ssh, for machines
+  # without openssh: the provider puts itself first in PATH as ssh, so every
+  # connection uses it, including the reachability checks, hooks, activation,
+  # garbage collection, and the closure copies of nix-copy-closure, nix copy
+  # and nixos-rebuild. It authenticates with the ssh agent and the
+  # ssh_private_key, ssh_private_key_file or ~/.ssh/id_* keys, and checks host
+  # keys against the known_hosts files. It does not read ~/.ssh/config, and
+  # config files given with -F in ssh_opts may only set options, without Host,
+  # Match or Include lines. It ignores ssh_multiplex and other ssh options it
+  # does not know, needs host_key as a public key rather than a fingerprint,
+  # and does not support encrypted key files outside the agent.
+  # transport = "openssh"
+
+  # A password to log in with, for freshly provisioned machines that only
+  # allow password logins until the config installs keys. openssh is given it
+  # by an SSH_ASKPASS helper, which only answers password prompts, go-ssh uses
+  # it directly. It is passed to them in the environment, never on a command
+  # line or on disk, so the hooks see it too. Keys are still tried first.
+  # ssh_password = ""
+
+  # The nixos-rebuild action used to install the system, one of switch, boot,
+  # test or dry-activate. With boot the system is activated on the next reboot,
+  # with test it is activated but the system profile, and so what boots, is left
+  # alone, and with dry-activate nothing is activated and the new system is
+  # never recorded.
+  # switch_action = "switch"
+
+  # Activate the named specialisation of the system instead of the top level
+  # system. nixos_system still records the top level system.
+  # specialisation = ""
+
+  # Retry the switch up to this many times when it fails because of transient
+  # errors like nix store lock contention or "text file busy".
+  # switch_retries = 0
+
+  # Run the closure copy, the activation or the garbage collection again, up
+  # to this many times with a growing delay, when it fails because the ssh
+  # connection was lost, for example by a network blip or an sshd restart.
+  # Other failures are not retried. Before activating again the current
+  # system is checked, so an activation that finished isn't repeated.
+  # ssh_retries = 0
+
+  # Hold an advisory lock on /run/terraform-nix.lock on the target while
+  # switching, running hooks, the health checks and any rollback, so
+  # concurrent deployments to one host queue. The lock file names the current
+  # holder, and is released automatically if the holder is killed. Failing to
+  # get the lock fails the apply without touching the host.
+  # deploy_lock = true
+  # lock_timeout = 300
+
+  # If the switch fails once the activation started, or the reboot or health
+  # checks after it fail, switch back to the previously recorded nixos_system
+  # before reporting the error. New hosts, and failures before the activation
+  # such as build or lock failures, are never rolled back.
+  # rollback_on_failure = true
+
+  # Schedule a revert to the running system on the target before activating, and
+  # only cancel it once ssh works again with the new system. confirm_timeout is
+  # the number of seconds the target waits, counted from once the new system is
+  # built and copied.
+  # magic_rollback = false
+  # confirm_timeout = 300
+
+  # Poll a command after the switch, the apply only succeeds once it passes.
+  # The command runs locally with the same environment as the hooks, or on
+  # the target if on_target is set. A failing check triggers rollback_on_failure.
+  # health_check {
+  #   command   = "systemctl is-active nginx"
+  #   on_target = true
+  #   retries   = 10
+  #   interval  = 5
+  # }
+
+  # Poll an http endpoint from the machine running terraform after the switch
+  # until it returns the expected status, with backoff up to the timeout in seconds.
+  # insecure_skip_verify allows self signed certificates.
+  # health_http_url = "https://example.com/healthz"
+  # health_http_expected_status = 200
+  # health_http_timeout = 300
+  # insecure_skip_verify = false
+
+  # After the switch, reboot the target if the kernel, initrd or kernel modules
+  # changed, then wait up to reboot_timeout seconds for it to come back.
+  # reboot_if_needed = false
+  # reboot_timeout = 600
+
+  # Activate the new system without making it the system profile, with a revert
+  # scheduled on the target confirmation_timeout seconds after the new system is
+  # built and copied. The system is only made permanent once confirmation_command
+  # passes on the target, otherwise the target reverts and the apply fails. An
+  # unconfirmed system is never made the boot default. Conflicts with magic_rollback.
+  # require_confirmation = false
+  # confirmation_command = "true"
+  # confirmation_timeout = 300
+
+  # Build the system and check the target is reachable, but never run hooks,
+  # collect garbage or switch. The new system is not recorded, so a later real
+  # apply still switches. This can also be set on the provider block.
+  # dry_run = false
+
+  # Extra nix settings passed as --option name value to builds, switches and
+  # garbage collection, without editing nix.conf. Changing these only causes a
+  # switch if the built system changes.
+  # extra_nix_options = {
+  #   http-connections = "50"
+  # }
+
+  # Experimental nix features enabled for local nix commands, in addition to
+  # those set on the provider.
+  # experimental_features = ["nix-command", "flakes"]
+
+  # Keep a gc root for the system built at plan time under
+  # ~/.cache/terraform-nix/<resource id>, so plans after a local
+  # nix-collect-garbage don't rebuild it. The root follows the desired system
+  # and is removed with the resource.
+  # keep_result_gc_root = false
+
+  # "build" builds the system at plan time, so the plan shows whether the
+  # system really changed. "defer" never builds while planning, any changed
+  # input of the system, such as nixos_config, flake or build_args, marks the
+  # system as changed and apply builds and switches it.
+  # Deferred plans are faster, but can't show a config change is a no-op, and
+  # don't notice changes to config files that leave the attributes alone.
+  # Defaults to the provider setting.
+  # plan_mode = "build"
+
+  # A file receiving the complete output of the commands run while applying,
+  # overwritten by every apply, and included in the deployment_log attribute.
+  # Errors include its last lines. Defaults to a file named after the resource
+  # id under $TF_DATA_DIR/nix/logs.
+  # log_file = "deploy.log"
+
+  # Let the target download paths from its binary caches instead of copying
+  # them from the build host, passed as --use-substitutes.
+  # use_substitutes = true
+
+  # Binary caches the target substitutes the new closure from during the
+  # switch, instead of those it is configured with, useful to bootstrap hosts
+  # that don't know about a cache yet. Only used with use_substitutes.
+  # substituters = ["https://cache.example.com"]
+  # trusted_public_keys = ["cache.example.com-1:6NCHdD59X431o0gWypbMrAURkbJ16ZPMQFGspcDShjY="]
+
+  # How closures of prebuilt systems are copied to the target, "ssh" uses
+  # nix-copy-closure, "ssh-ng" uses nix copy --to ssh-ng://, which is faster
+  # for large closures. ssh_opts apply to both. Systems built by nixos-rebuild
+  # while switching are always copied by nixos-rebuild.
+  # copy_protocol = "ssh"
+
+  # Compress closure copies. "ssh" enables ssh compression. "zstd" and "xz"
+  # stream the paths missing on the target through the compressor with
+  # nix-store --export, the target needs the decompressor installed, and
+  # copy_protocol must be "ssh". copy_compression_level sets the zstd or xz
+  # level, zero is their default.
+  # copy_compression = "none"
+  # copy_compression_level = 0
+
+  # The number of streams closures are copied to the target with. Above 1 the
+  # paths missing on the target are split between the streams, and the system
+  # itself is copied last. Dependencies shared between streams may be sent
+  # more than once.
+  # copy_parallelism = 1
+
+  # A secret key file the system closure is signed with before it is copied,
+  # for targets with require-sigs. Prebuilt systems in nixos_config_path are
+  # signed too.
+  # signing_key_file = "/etc/nix/signing-key.sec"
+
+  # Set to false to have the target accept unsigned paths, the closure is then
+  # copied with nix copy --no-check-sigs. Can't be combined with
+  # signing_key_file.
+  # check_sigs = true
+
+  # Push every built system to a binary cache, at plan time and before
+  # switching, so targets and CI can substitute it. Credentials for the cache
+  # are read from the environment. on_push_failure is "fail" or "warn".
+  # post_build_push {
+  #   cache_url = "s3://example-cache?region=eu-west-1"
+  #   signing_key_file = "/etc/nix/cache-key.sec"
+  #   on_push_failure = "fail"
+  # }
+
+  # Run nix-collect-garbage -d on target host after a successful switch, so
+  # the generations it superseded are reclaimed.
   # collect_garbage = true
 
+  # Collect garbage before the switch instead, as older versions did. This
+  # frees little, the running system is still protected.
+  # gc_before_switch = false
+
+  # What a failed garbage collection does, "warn" logs it and leaves the
+  # deployment successful, "error" fails the apply.
+  # on_gc_failure = "warn"
+
+  # Keep this many of the newest system generations for manual rollbacks
+  # when collecting garbage, deleting the older ones with
+  # nix-env --delete-generations. Generations of other profiles are kept.
+  # gc_keep_generations = 5
+
+  # Or delete only the generations older than this many days, passed to
+  # nix-collect-garbage --delete-older-than. With neither set every old
+  # generation is deleted, with nix-collect-garbage -d.
+  # gc_delete_older_than = "14d"
+
+  # Stop collecting garbage once this much is freed, passed to
+  # nix-collect-garbage --max-freed, so a busy host isn't collected in full.
+  # Sizes are in bytes or with a K, M, G or T suffix, in powers of 1024.
+  # gc_max_freed_bytes = "5G"
+
+  # After collecting garbage, hard link identical files in the store with
+  # nix-store --optimise. This can take a long time on big stores, it is
+  # stopped after command_timeout, and a failure is only logged.
+  # store_optimise = false
+
+  # Before copying a system, the paths the target is missing are compared with
+  # the free space df reports for its store, failing early with the sizes when
+  # they won't fit. With this set garbage is collected once first, as the gc_
+  # options say, and the space checked again.
+  # gc_on_low_space = false
+
+  # Collect garbage on the build_host too, here when it is localhost, after
+  # a new system has been built and switched to. The new system is kept by
+  # a temporary gc root while it runs, and a failure is only logged. By
+  # default only paths nothing refers to are collected, the generations of
+  # the build host are left alone unless keep_generations, delete_older_than
+  # (as with gc_keep_generations and gc_delete_older_than, only one of them)
+  # or delete_generations, to delete every old generation, is set.
+  # collect_garbage_build_host {
+  #   delete_older_than  = "14d"
+  #   delete_generations = false
+  #   max_freed_bytes    = "50G"
+  # }
+
+  # Only collect garbage when the filesystem of /nix/store on the target is
+  # more than this many percent full, as df reports it, so hosts with plenty
+  # of space keep their old paths. Unset or 0 always collects.
+  # gc_when_used_percent_above = 0
+
   # SSH commands will run as this user, note they must be able to install the system
-  # so values other than root mean little.
+  # so values other than root mean little, unless escalation is set.
   # target_user = "root"
+
+  # How commands that need root on the target get it as target_user: none,
+  # sudo or doas. The activation, profile switches, garbage collection, gc
+  # roots, the lock and reboots run with sudo -n or doas -n, and
+  # nixos-rebuild gets --use-remote-sudo. Reads like readlink
+  # /run/current-system run as target_user. The escalation must not ask for
+  # a password, and closures are copied as target_user, so it must be a
+  # trusted nix user or the closure must be signed. sudo and doas reset the
+  # environment, so forward_agent does not reach the activation. Hooks get
+  # the prefix in NIX_TARGET_ESCALATION. use_sudo = true is the deprecated
+  # form of escalation = "sudo".
+  # escalation = "none"
+
+  # More flags for sudo or doas, after -n, such as "-u root". With flags or
+  # doas the system is built before it is copied and activated, since
+  # nixos-rebuild can only run plain sudo.
+  # escalation_flags = ""
+
+  # The TMPDIR of the commands run on the target, for hosts with a small or
+  # noexec /tmp. It is created if it is missing and left in place. With it
+  # the system is built before it is copied and activated, since
+  # nixos-rebuild can't set TMPDIR on the target. Hooks get it in
+  # NIX_REMOTE_TMPDIR. Must be an absolute path.
+  # remote_temp_dir = "/var/tmp/terraform-nix"
+
+  # Stop each command run on the target, such as reading the current system,
+  # the activation or garbage collection, that runs longer than this many
+  # seconds, so a wedged host fails a refresh instead of hanging it. Hooks
+  # are stopped after it too, whether they run locally or remotely. The
+  # error names the phase and command. Closure copies, builds, nixos-rebuild
+  # and health checks aren't limited by it, build_timeout and ssh_timeout
+  # are separate. 0 never stops them.
+  # command_timeout = 600
+
+  # Run the commands on the target with this command instead of ssh, for
+  # hosts only reachable another way, such as AWS SSM Session Manager. It is
+  # a Go template run with sh, with the placeholders:
+  #
+  # {{.Host}} - target_host.
+  # {{.User}} - target_user.
+  # {{.Command}} - The command to run, quoted as a single shell word.
+  # {{.RawCommand}} - The command unquoted, for templates quoting it their way.
+  #
+  # The command must pass stdin through and exit with the status of the
+  # remote command. Waiting for ssh runs true with it instead. With a
+  # template the system is built before it is copied and activated, and
+  # closures are copied as a nix-store --export stream into
+  # nix-store --import run with it. ssh options, bastions and host keys
+  # don't apply, and build_on_target still uses ssh.
+  # remote_command_template = "aws ssm start-session --target {{.Host}} --document-name AWS-StartNonInteractiveCommand --parameters command={{.Command}}"
+
+  # The command receiving closure copies on the target, with the same
+  # placeholders, in place of remote_command_template or ssh.
+  # copy_command_template = ""
+
+  # The ssh port of the target, passed to ssh as -p so nix-copy-closure and
+  # nixos-rebuild use it too. target_host can also be given as
+  # user@host:port, overriding target_user and target_port. IPv6 addresses
+  # can be given bare, with a zone like fe80::1%eth0, or bracketed as
+  # [2001:db8::10]:2222 to add a port.
+  # target_port = 22
+
+  # Run switch-to-configuration dry-activate on the target before switching and
+  # record the units the switch stops, restarts and reloads in units_to_stop,
+  # units_to_restart and units_to_reload. The system is built and copied
+  # before the switch for this. Lines that can't be classified are logged.
+  # report_unit_changes = false
+
+  # How long creating, updating and refreshing may take. Create and update
+  # cover the whole apply, waiting for ssh, garbage collection, the build,
+  # copy, switch, hooks, reboot and health checks. Commands still running
+  # when the timeout passes are interrupted, ssh_timeout only limits the wait
+  # for ssh within it. rollback_on_failure still runs after a timeout.
+  # timeouts {
+  #   create = "2h"
+  #   update = "2h"
+  #   read = "10m"
+  # }
+
+  # Computed attributes:
+  #
+  # nixos_system - The store path of the system installed on the target.
+  # needs_reboot - Whether the booted kernel, initrd or kernel modules differ
+  #                from nixos_system, false if the target is unreachable.
+  # booted_system - The store path of the system the target booted, if this
+  #                 lags behind nixos_system a reboot is pending.
+  # flake_lock_hash - A hash of flake.lock for local flakes, or the locked narHash
+  #                   of remote flakes, showing when flake inputs moved.
+  # resolved_config_path - The absolute config path, store path or flake
+  #                        reference that was deployed.
+  # deployment_log - The file the output of the last apply was written to.
+  # closure_size_bytes - The closure size of the system built at plan time, the
+  #                      change from the previous system is logged as a warning.
+  # change_summary - The package changes from the previous system, as printed by
+  #                  nix store diff-closures, when it is in the local store.
+  # units_to_restart, units_to_stop, units_to_reload - The units the last switch
+  #                   changed, with report_unit_changes.
+  # copy_skipped - Whether the last switch found the whole closure already on
+  #                the target, for systems built before the switch.
+  # required_copy_bytes - The nar size of the paths the last switch copied to
+  #                       the target.
+  # gc_freed_bytes - The bytes the last garbage collection freed, as
+  #                  nix-collect-garbage reported them.
+  # store_used_percent - How full the filesystem of /nix/store on the target
+  #                      was at the last refresh or garbage collection.
+  # connected_user - The user the last apply connected as, target_user or the
+  #                  bootstrap_user.
 }
+
+# Explicitly roll a nixos server back to an existing generation of its system
+# profile, or to a system_path already present in its store. Destroying this
+# resource does nothing.
+#
+# resource "nix_nixos_rollback" "rollback" {
+#   target_host = "${nix_nixos.nixos.target_host}"
+#
+#   # One of:
+#   generation = 42
+#   # system_path = "/nix/store/...-nixos-system-..."
+#
+#   # Optional values, with defaults.
+#   # target_user = "root"
+#   # target_port = 22
+#   # ssh_opts = "-o StrictHostKeyChecking=accept-new -o BatchMode=yes"
+#   # ssh_args = []  # Instead of ssh_opts.
+#   # ssh_private_key = ""
+#   # ssh_private_key_file = ""
+#   # bastion_host = ""
+#   # bastion_user = ""
+#   # bastion_port = 22
+#   # bastion_jumps = []
+#   # proxy_command = ""
+#   # ssh_multiplex = false
+#   # host_key = ""
+#   # known_hosts_mode = "system"
+#   # transport = "openssh"
+#   # ssh_password = ""
+#   # ssh_timeout = 180
+#   # ssh_poll_interval = 2
+#   # ssh_poll_max_interval = 30
+#   # ssh_retries = 0
+#   # escalation = "none"
+#   # escalation_flags = ""
+#   # remote_temp_dir = ""
+#   # command_timeout = 600
+#   # remote_command_template = ""
+#   # copy_command_template = ""
+#
+#   # Computed attributes:
+#   #
+#   # nixos_system - The store path of the system running after the rollback.
+# }
+
+# Activate a system that was built elsewhere, for example by CI or another
+# resource. The closure is copied to the target with nix-copy-closure and
+# switched to, nothing is evaluated or built, so plans are fast. The same
+# system_path can be promoted across many hosts.
+#
+# resource "nix_nixos_activation" "web" {
+#   system_path = "/nix/store/...-nixos-system-web-..."
+#   target_host = "${google_compute_instance.exampleserver.network_interface.0.access_config.0.nat_ip}"
+#
+#   # Optional values, with defaults.
+#   # target_user = "root"
+#   # target_port = 22
+#   # ssh_opts = "-o StrictHostKeyChecking=accept-new -o BatchMode=yes"
+#   # ssh_args = []  # Instead of ssh_opts.
+#   # ssh_private_key = ""
+#   # ssh_private_key_file = ""
+#   # bastion_host = ""
+#   # bastion_user = ""
+#   # bastion_port = 22
+#   # bastion_jumps = []
+#   # proxy_command = ""
+#   # ssh_multiplex = false
+#   # host_key = ""
+#   # known_hosts_mode = "system"
+#   # transport = "openssh"
+#   # ssh_password = ""
+#   # ssh_timeout = 180
+#   # ssh_poll_interval = 2
+#   # ssh_poll_max_interval = 30
+#   # ssh_retries = 0
+#   # escalation = "none"
+#   # escalation_flags = ""
+#   # remote_temp_dir = ""
+#   # command_timeout = 600
+#   # remote_command_template = ""
+#   # copy_command_template = ""
+#   # use_substitutes = true
+#   # substituters = []
+#   # trusted_public_keys = []
+#   # copy_protocol = "ssh"
+#   # check_sigs = true
+#
+#   # Computed attributes:
+#   #
+#   # nixos_system - The store path of the system installed on the target.
+# }
+
+# Build a nixos system locally without deploying it, for example to check in
+# CI that a config still evaluates, or to build once and activate the result
+# on several hosts with nix_nixos_activation. Nothing connects to a host.
+#
+# data "nix_nixos_system" "web" {
+#   # One of:
+#   nixos_config_path = "./web.nix"
+#   # nixos_config = "{ ... }: { ... }"
+#   # nixos_config_expr = "{ ... }: { ... }"
+#   # flake = "."
+#   # flake_attr = "web"
+#
+#   # Optional values, with defaults.
+#   # nix_path = "nixpkgs=..."
+#   # nix_path_entries = { nixpkgs = "./nixpkgs" }
+#   # build_args = {}
+#   # build_args_str = {}
+#   # extra_nix_options = {}
+#   # system = "x86_64-linux"
+#
+#   # Computed attributes:
+#   #
+#   # store_path - The store path of the built system toplevel.
+#   # drv_path - The derivation of the system toplevel.
+# }
+
+# Build any derivation locally and use its outputs elsewhere, for example a
+# tarball or an image built with dockerTools.
+#
+# data "nix_build" "image" {
+#   # One of:
+#   expression_path = "./image.nix"
+#   # expression = "(import <nixpkgs> {}).hello"
+#   # flake = "."
+#
+#   # Optional values, with defaults.
+#   # attribute = "image"  # An attribute of the expression_path file.
+#   # attr = "packages.x86_64-linux.image"  # Required with flake.
+#   # nix_path = "nixpkgs=..."
+#   # argstr = {}
+#   # extra_nix_options = {}
+#   # experimental_features = []  # Combined with those set on the provider.
+#
+#   # Computed attributes:
+#   #
+#   # out_path - The out output, or the first output of derivations without one.
+#   # store_path - The same as out_path.
+#   # outputs - Every output of the derivation by name.
+# }
+
+# Evaluate nix code with nix eval --json, so facts defined in nix, like the
+# port a service listens on, can be used by other resources.
+#
+# data "nix_eval" "web_port" {
+#   # One of:
+#   expression = "(import ./web.nix {}).services.nginx.port"
+#   # expression_path = "./facts.nix"
+#   # flake = "."
+#
+#   # Optional values, with defaults.
+#   # attribute = "webPort"  # An attribute of the expression_path file.
+#   # attr = "nixosConfigurations.web.config.networking.hostName"  # Required with flake.
+#   # nix_path = "nixpkgs=..."
+#   # argstr = {}
+#   # extra_nix_options = {}
+#   # experimental_features = []  # Combined with those set on the provider.
+#   # impure = false
+#
+#   # Computed attributes:
+#   #
+#   # value_json - The value as JSON, use jsondecode to read it.
+#   # value - The value if it is a string, otherwise "".
+# }
+
+# Copy any store path and its closure to a server, for example the output of
+# a nix_build data source. The path is protected from garbage collection on
+# the target while the resource exists, and copied again if it disappears.
+#
+# resource "nix_copy" "image" {
+#   store_path = "${data.nix_build.image.out_path}"
+#   target_host = "${google_compute_instance.exampleserver.network_interface.0.access_config.0.nat_ip}"
+#
+#   # Optional values, with defaults.
+#   # target_user = "root"
+#   # target_port = 22
+#   # ssh_opts = "-o StrictHostKeyChecking=accept-new -o BatchMode=yes"
+#   # ssh_args = []  # Instead of ssh_opts.
+#   # ssh_private_key = ""
+#   # ssh_private_key_file = ""
+#   # bastion_host = ""
+#   # bastion_user = ""
+#   # bastion_port = 22
+#   # bastion_jumps = []
+#   # proxy_command = ""
+#   # ssh_multiplex = false
+#   # host_key = ""
+#   # known_hosts_mode = "system"
+#   # transport = "openssh"
+#   # ssh_password = ""
+#   # ssh_timeout = 180
+#   # ssh_poll_interval = 2
+#   # ssh_poll_max_interval = 30
+#   # ssh_retries = 0
+#   # escalation = "none"
+#   # escalation_flags = ""
+#   # remote_temp_dir = ""
+#   # command_timeout = 600
+#   # remote_command_template = ""
+#   # copy_command_template = ""
+#   # check_sigs = true
+#   # gc_root = true  # Add a root under /nix/var/nix/gcroots/terraform, removed on destroy.
+# }
+
+# Protect a store path on a server from its garbage collection with a root at
+# /nix/var/nix/gcroots/terraform/<name>. If the root or the path disappears
+# the root is created again, which fails until the path is copied back.
+#
+# resource "nix_gc_root" "image" {
+#   store_path = "${nix_copy.image.store_path}"
+#   name = "image"
+#   target_host = "${google_compute_instance.exampleserver.network_interface.0.access_config.0.nat_ip}"
+#
+#   # Optional values, with defaults.
+#   # target_user = "root"
+#   # target_port = 22
+#   # ssh_opts = "-o StrictHostKeyChecking=accept-new -o BatchMode=yes"
+#   # ssh_args = []  # Instead of ssh_opts.
+#   # ssh_private_key = ""
+#   # ssh_private_key_file = ""
+#   # bastion_host = ""
+#   # bastion_user = ""
+#   # bastion_port = 22
+#   # bastion_jumps = []
+#   # proxy_command = ""
+#   # ssh_multiplex = false
+#   # host_key = ""
+#   # known_hosts_mode = "system"
+#   # transport = "openssh"
+#   # ssh_password = ""
+#   # ssh_timeout = 180
+#   # ssh_poll_interval = 2
+#   # ssh_poll_max_interval = 30
+#   # ssh_retries = 0
+#   # escalation = "none"
+#   # escalation_flags = ""
+#   # remote_temp_dir = ""
+#   # command_timeout = 600
+#   # remote_command_template = ""
+#   # copy_command_template = ""
+#
+#   # Computed attributes:
+#   #
+#   # root - The location of the root on the target.
+# }
+
+# Collect garbage on a server independently of its deployments, for example
+# with a scheduled terraform apply -target. The collection runs on create and
+# again whenever an option or one of the triggers changes, destroying it
+# does nothing.
+#
+# resource "nix_gc" "builder" {
+#   target_host = "builder.example.com"
+#
+#   triggers = {
+#     week = "2020-W14"
+#   }
+#
+#   # Optional values, with defaults.
+#   # target_user = "root"
+#   # target_port = 22
+#   # ssh_opts = "-o StrictHostKeyChecking=accept-new -o BatchMode=yes"
+#   # ssh_args = []  # Instead of ssh_opts.
+#   # ssh_private_key = ""
+#   # ssh_private_key_file = ""
+#   # bastion_host = ""
+#   # bastion_user = ""
+#   # bastion_port = 22
+#   # bastion_jumps = []
+#   # proxy_command = ""
+#   # ssh_multiplex = false
+#   # host_key = ""
+#   # known_hosts_mode = "system"
+#   # transport = "openssh"
+#   # ssh_password = ""
+#   # ssh_timeout = 180
+#   # ssh_poll_interval = 2
+#   # ssh_poll_max_interval = 30
+#   # ssh_retries = 0
+#   # escalation = "none"
+#   # escalation_flags = ""
+#   # remote_temp_dir = ""
+#   # command_timeout = 600
+#   # remote_command_template = ""
+#   # copy_command_template = ""
+#   # keep_generations = 0  # Or delete_older_than, like gc_keep_generations of nix_nixos.
+#   # delete_older_than = ""  # Neither deletes every old generation.
+#   # max_freed_bytes = ""
+#
+#   # Computed attributes:
+#   #
+#   # freed_bytes - The bytes the last collection freed.
+#   # collected_at - When the last collection ran, in RFC 3339 format.
+# }
+
+# Upload a store path to a binary cache and wait until the cache serves it,
+# so hosts can substitute it before they are deployed, for example with
+# nix_nixos_activation. The path is pushed again if the cache drops it.
+#
+# resource "nix_cache_push" "web" {
+#   store_path = "${data.nix_nixos_system.web.store_path}"
+#   # The cache hosts substitute from, also the store pushed to by nix copy.
+#   cache_url = "https://cache.example.com"
+#
+#   # Optional values, with defaults.
+#   # tool = "nix"  # Or "attic" or "cachix", which push to cache_name.
+#   # cache_name = ""
+#   # signing_key_file = ""  # Signs the closure before nix copy pushes it.
+#   # auth_token_env = ""  # The variable holding a token to read the cache, also passed to cachix.
+#   # availability_timeout = 300
+# }
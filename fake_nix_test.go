@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+)
+
+// fakeNix replaces the nix commands with scripts that record how they were
+// run. Builds and evaluations produce system, a directory that passes
+// nix.CheckSystemPath, with the single specialisation gpu.
+type fakeNix struct {
+	dir    string
+	system string
+}
+
+func newFakeNix(t *testing.T) *fakeNix {
+	dir, err := ioutil.TempDir("", "fake-nix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	f := &fakeNix{dir: dir, system: filepath.Join(dir, "system")}
+	f.write(t, "system/bin/switch-to-configuration", "#!/bin/sh\n")
+	f.write(t, "system/specialisation/gpu/bin/switch-to-configuration", "#!/bin/sh\n")
+	f.write(t, "nixos-rebuild", fmt.Sprintf("#!/bin/sh\necho \"nixos-rebuild $*\" >> %s/calls\nln -s %s result\n", dir, f.system))
+	f.write(t, "nix-build", fmt.Sprintf("#!/bin/sh\necho \"nix-build $*\" >> %s/calls\n", dir))
+	f.write(t, "nix-instantiate", fmt.Sprintf(`#!/bin/sh
+echo "nix-instantiate $*" >> %s/calls
+case "$*" in
+*--expr*) echo '["gpu"]' ;;
+*) echo '"%s"' ;;
+esac
+`, dir, f.system))
+
+	nix.SetBinaries(nix.Binaries{
+		NixBuild:     filepath.Join(dir, "nix-build"),
+		NixosRebuild: filepath.Join(dir, "nixos-rebuild"),
+	})
+	t.Cleanup(func() { nix.SetBinaries(nix.Binaries{}) })
+
+	dataDir := os.Getenv("TF_DATA_DIR")
+	os.Setenv("TF_DATA_DIR", filepath.Join(dir, "data"))
+	t.Cleanup(func() { os.Setenv("TF_DATA_DIR", dataDir) })
+
+	return f
+}
+
+func (f *fakeNix) write(t *testing.T, name, content string) {
+	path := filepath.Join(f.dir, name)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, []byte(content), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// calls returns the commands run so far whose name is prefix.
+func (f *fakeNix) calls(t *testing.T, prefix string) []string {
+	out, err := ioutil.ReadFile(filepath.Join(f.dir, "calls"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	var calls []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if strings.HasPrefix(line, prefix+" ") {
+			calls = append(calls, line)
+		}
+	}
+	return calls
+}
+
+// order returns the names of the commands run so far that are in names, in
+// the order they were run.
+func (f *fakeNix) order(t *testing.T, names ...string) string {
+	out, err := ioutil.ReadFile(filepath.Join(f.dir, "calls"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	var order []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		name := strings.SplitN(line, " ", 2)[0]
+		for _, n := range names {
+			if name == n {
+				order = append(order, name)
+			}
+		}
+	}
+	return strings.Join(order, " ")
+}
+
+// fakeTarget makes ssh run commands here instead of connecting, with ssh -G
+// reporting port on localhost as the address of the target. The target's
+// current system is currentSystem, and systemctl and systemd-run only record
+// how they were run.
+func (f *fakeNix) fakeTarget(t *testing.T, port int, currentSystem string) {
+	f.write(t, "target/ssh", fmt.Sprintf(`#!/bin/sh
+for arg; do
+	if [ "$arg" = -G ]; then
+		printf 'hostname 127.0.0.1\nport %d\n'
+		exit 0
+	fi
+done
+while [ $# -gt 0 ] && [ "$1" != -- ]; do shift; done
+shift
+exec sh -c "$*"
+`, port))
+	f.write(t, "target/readlink", fmt.Sprintf("#!/bin/sh\necho %s\n", currentSystem))
+	for _, name := range []string{"systemctl", "systemd-run"} {
+		f.write(t, "target/"+name, fmt.Sprintf("#!/bin/sh\necho \"%s $*\" >> %s/calls\n", name, f.dir))
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", filepath.Join(f.dir, "target")+string(os.PathListSeparator)+path)
+	t.Cleanup(func() { os.Setenv("PATH", path) })
+}
+
+// fakeActivation makes the fake target of fakeTarget receive system, which is
+// missing there, with nix-copy-closure, and records its activation by
+// nix-env and switch-to-configuration.
+func (f *fakeNix) fakeActivation(t *testing.T) {
+	f.write(t, "nix-store", `#!/bin/sh
+case "$*" in
+"--query --requisites "*) echo "$3" ;;
+"--query --size "*) echo 0 ;;
+"--check-validity --print-invalid "*) shift 2; printf '%s\n' "$@" ;;
+esac
+`)
+	f.write(t, "target/nix-store", "#!/bin/sh\nexec "+f.dir+"/nix-store \"$@\"\n")
+	for _, name := range []string{"nix-copy-closure", "target/nix-env", "system/bin/switch-to-configuration"} {
+		f.write(t, name, fmt.Sprintf("#!/bin/sh\necho \"%s $*\" >> %s/calls\n", filepath.Base(name), f.dir))
+	}
+}
@@ -2,4 +2,8 @@ module github.com/andrewchambers/terraform-provider-nix
 
 go 1.14
 
-require github.com/hashicorp/terraform v0.12.7
+require (
+	github.com/hashicorp/go-version v1.1.0
+	github.com/hashicorp/terraform v0.12.7
+	golang.org/x/crypto v0.0.0-20190701094942-4def268fd1a4
+)
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+)
+
+type httpProbeConfig struct {
+	URL                string
+	ExpectedStatus     int
+	Timeout            time.Duration
+	InsecureSkipVerify bool
+}
+
+// waitForHTTP polls the probe url with backoff until it answers with the
+// expected status, or the probe timeout passes or ctx is done.
+func waitForHTTP(ctx context.Context, probe *httpProbeConfig) error {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: probe.InsecureSkipVerify},
+		},
+	}
+
+	deadline := time.Now().Add(probe.Timeout)
+	delay := 1 * time.Second
+	lastErr := fmt.Errorf("no response")
+
+	for {
+		req, err := http.NewRequest("GET", probe.URL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err == nil {
+			_ = resp.Body.Close()
+			if resp.StatusCode == probe.ExpectedStatus {
+				return nil
+			}
+			err = fmt.Errorf("got status %d, expected %d", resp.StatusCode, probe.ExpectedStatus)
+		}
+		lastErr = err
+		log.Printf("[INFO] http probe of %s failed: %s", probe.URL, err)
+
+		if time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("http probe of %s did not pass within %s: %s", probe.URL, probe.Timeout, lastErr)
+		}
+		err = nix.SleepContext(ctx, delay)
+		if err != nil {
+			return err
+		}
+
+		delay *= 2
+		if delay > 30*time.Second {
+			delay = 30 * time.Second
+		}
+	}
+}
@@ -1,14 +1,24 @@
 package main
 
 import (
+	"os"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
 	"github.com/hashicorp/terraform/plugin"
 	"github.com/hashicorp/terraform/terraform"
 )
 
 func main() {
+	// The ssh helpers run the provider as ssh and ssh-askpass.
+	if status, ok := nix.RunSSHHelper(os.Args); ok {
+		os.Exit(status)
+	}
+
 	plugin.Serve(&plugin.ServeOpts{
 		ProviderFunc: func() terraform.ResourceProvider {
 			return Provider()
 		},
 	})
+	// Terraform is done with the provider.
+	closeSSHMasters()
 }
@@ -0,0 +1,109 @@
+package nix
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// unameSystems maps uname -m machine names to nix system architectures.
+var unameSystems = map[string]string{
+	"x86_64":  "x86_64",
+	"amd64":   "x86_64",
+	"aarch64": "aarch64",
+	"arm64":   "aarch64",
+	"armv7l":  "armv7l",
+	"armv6l":  "armv6l",
+	"i686":    "i686",
+	"i386":    "i686",
+	"riscv64": "riscv64",
+}
+
+// goarchSystems maps GOARCH to nix system architectures.
+var goarchSystems = map[string]string{
+	"amd64":   "x86_64",
+	"arm64":   "aarch64",
+	"arm":     "armv7l",
+	"386":     "i686",
+	"riscv64": "riscv64",
+}
+
+// LocalSystem returns the nix system of the machine running the provider.
+func LocalSystem() string {
+	arch, ok := goarchSystems[runtime.GOARCH]
+	if !ok {
+		arch = runtime.GOARCH
+	}
+	return arch + "-" + runtime.GOOS
+}
+
+// TargetSystem returns the nix system of the TargetHost, from uname.
+func TargetSystem(cfg *NixosRebuildConfig) (string, error) {
+	cmd := cfg.sshCommand("uname -m")
+	output := bytes.NewBuffer(nil)
+	err := cfg.runRemote("checking the system", cmd, output)
+	if err != nil {
+		return "", formatChildErr(err)
+	}
+	return unameToSystem(output.String()), nil
+}
+
+// unameToSystem converts the output of uname -m on a NixOS host into a nix
+// system.
+func unameToSystem(uname string) string {
+	machine := strings.TrimSpace(uname)
+	arch, ok := unameSystems[machine]
+	if !ok {
+		arch = machine
+	}
+	return arch + "-linux"
+}
+
+// SystemOfPath returns the nix system a local system toplevel was built for.
+func SystemOfPath(systemPath string) (string, error) {
+	system, err := ioutil.ReadFile(filepath.Join(systemPath, "system"))
+	if err != nil {
+		return "", fmt.Errorf("unable to read the system of %s: %s", systemPath, err)
+	}
+	return strings.TrimSpace(string(system)), nil
+}
+
+// CheckTargetSystem fails if the system being deployed is built for a
+// different architecture than the TargetHost. The system is that of
+// SystemPath when it is set, otherwise the configured System, otherwise
+// nothing is checked.
+func CheckTargetSystem(cfg *NixosRebuildConfig) error {
+	system := cfg.System
+	if cfg.SystemPath != "" {
+		var err error
+		system, err = SystemOfPath(cfg.SystemPath)
+		if err != nil {
+			return err
+		}
+	}
+	if system == "" {
+		return nil
+	}
+
+	target, err := TargetSystem(cfg)
+	if err != nil {
+		return err
+	}
+	if target != system {
+		return fmt.Errorf("the system is built for %s but %s is %s, set system = %q to build for it", system, cfg.TargetHost, target, target)
+	}
+	return nil
+}
+
+// crossBuildHint explains how to avoid an error building for another
+// architecture locally, or returns "".
+func (cfg *NixosRebuildConfig) crossBuildHint() string {
+	local := cfg.BuildHost == "" || cfg.BuildHost == "localhost"
+	if !local || cfg.System == "" || cfg.System == LocalSystem() {
+		return ""
+	}
+	return fmt.Sprintf("\n%s systems may not be buildable on this %s machine, set build_host to a %s builder or configure remote builders", cfg.System, LocalSystem(), cfg.System)
+}
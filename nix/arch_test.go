@@ -0,0 +1,102 @@
+package nix
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnameToSystem(t *testing.T) {
+	for uname, expected := range map[string]string{
+		"x86_64\n":  "x86_64-linux",
+		"aarch64\n": "aarch64-linux",
+		"arm64":     "aarch64-linux",
+		"armv7l\n":  "armv7l-linux",
+		"i686\n":    "i686-linux",
+		"mips64\n":  "mips64-linux",
+	} {
+		if got := unameToSystem(uname); got != expected {
+			t.Errorf("unameToSystem(%q) = %q, expected %q", uname, got, expected)
+		}
+	}
+}
+
+func TestCheckTargetSystem(t *testing.T) {
+	// uname -m on the target prints the machine in dir/machine.
+	dir := fakeCommands(t, map[string]string{"uname": `cat "$(dirname "$0")/machine"`})
+	systemPath := filepath.Join(dir, "system")
+	err := os.MkdirAll(systemPath, 0755)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(systemPath, "system"), []byte("aarch64-linux\n"), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		cfg      NixosRebuildConfig
+		machine  string
+		mismatch string
+	}{
+		{"matching system", NixosRebuildConfig{System: "aarch64-linux"}, "aarch64", ""},
+		{"arm64 target", NixosRebuildConfig{System: "aarch64-linux"}, "arm64", ""},
+		{"mismatched system", NixosRebuildConfig{System: "aarch64-linux"}, "x86_64", `the system is built for aarch64-linux but example.com is x86_64-linux, set system = "x86_64-linux"`},
+		{"matching prebuilt", NixosRebuildConfig{SystemPath: systemPath}, "aarch64", ""},
+		// The system of a prebuilt system wins over the configured one.
+		{"mismatched prebuilt", NixosRebuildConfig{SystemPath: systemPath, System: "x86_64-linux"}, "x86_64", "the system is built for aarch64-linux but example.com is x86_64-linux"},
+		// Nothing to compare against, uname isn't run.
+		{"unknown system", NixosRebuildConfig{}, "", ""},
+	} {
+		// Without a machine uname fails.
+		machine := filepath.Join(dir, "machine")
+		os.Remove(machine)
+		if tc.machine != "" {
+			err := ioutil.WriteFile(machine, []byte(tc.machine+"\n"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		cfg := tc.cfg
+		cfg.Local = true
+		cfg.TargetHost = "example.com"
+		err = CheckTargetSystem(&cfg)
+		if tc.mismatch == "" {
+			if err != nil {
+				t.Errorf("%s: %s", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.mismatch) {
+			t.Errorf("%s: got %v, expected %q", tc.name, err, tc.mismatch)
+		}
+	}
+}
+
+func TestCrossBuildHint(t *testing.T) {
+	other := "riscv64-linux"
+	if LocalSystem() == other {
+		other = "aarch64-linux"
+	}
+	for _, tc := range []struct {
+		cfg  NixosRebuildConfig
+		hint bool
+	}{
+		{NixosRebuildConfig{System: other}, true},
+		{NixosRebuildConfig{System: other, BuildHost: "localhost"}, true},
+		{NixosRebuildConfig{System: other, BuildHost: "builder"}, false},
+		{NixosRebuildConfig{System: LocalSystem()}, false},
+		{NixosRebuildConfig{}, false},
+	} {
+		hint := tc.cfg.crossBuildHint()
+		if tc.hint != (hint != "") {
+			t.Errorf("%+v: got hint %q", tc.cfg, hint)
+		}
+		if tc.hint && !strings.Contains(hint, "set build_host to a "+other+" builder") {
+			t.Errorf("%+v: the hint doesn't suggest a builder: %q", tc.cfg, hint)
+		}
+	}
+}
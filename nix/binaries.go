@@ -0,0 +1,114 @@
+package nix
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	version "github.com/hashicorp/go-version"
+)
+
+// Binaries are the nix commands the provider runs locally.
+type Binaries struct {
+	// Nix is the nix command.
+	Nix string
+	// NixBuild is nix-build. nix-instantiate, nix-store and nix-copy-closure
+	// are expected next to it.
+	NixBuild string
+	// NixosRebuild is nixos-rebuild.
+	NixosRebuild string
+}
+
+var binaries = Binaries{
+	Nix:          "nix",
+	NixBuild:     "nix-build",
+	NixosRebuild: "nixos-rebuild",
+}
+
+// SetBinaries sets the nix commands to run, empty fields are looked up in
+// PATH. It must be called before any command is run.
+func SetBinaries(b Binaries) {
+	if b.Nix == "" {
+		b.Nix = "nix"
+	}
+	if b.NixBuild == "" {
+		b.NixBuild = "nix-build"
+	}
+	if b.NixosRebuild == "" {
+		b.NixosRebuild = "nixos-rebuild"
+	}
+	binaries = b
+}
+
+// command returns a command running the local nix command name.
+func command(name string, args ...string) *exec.Cmd {
+	return exec.Command(binaryPath(name), args...)
+}
+
+// binaryPath returns the configured binary to run for the nix command name.
+func binaryPath(name string) string {
+	switch name {
+	case "nix":
+		name = binaries.Nix
+	case "nix-build":
+		name = binaries.NixBuild
+	case "nixos-rebuild":
+		name = binaries.NixosRebuild
+	default:
+		if dir := filepath.Dir(binaries.NixBuild); dir != "." {
+			name = filepath.Join(dir, name)
+		}
+	}
+	return name
+}
+
+// CheckBinaries checks the nix commands exist. nixos-rebuild is only run by
+// some deploys, so it is only checked when nixosRebuild says it was set.
+func CheckBinaries(nixosRebuild bool) error {
+	names := []string{"nix", "nix-build"}
+	if nixosRebuild {
+		names = append(names, "nixos-rebuild")
+	}
+	for _, name := range names {
+		path := binaryPath(name)
+		if _, err := exec.LookPath(path); err != nil {
+			return fmt.Errorf("%s was not found at %q, install nix or set %s_binary: %s", name, path, strings.Replace(name, "-", "_", -1), err)
+		}
+	}
+	return nil
+}
+
+var nixVersionRegexp = regexp.MustCompile(`\d+\.\d+(\.\d+)?`)
+
+// CheckNixVersion checks the version of the nix command satisfies the
+// constraint, such as ">= 2.4".
+func CheckNixVersion(constraint string) error {
+	constraints, err := version.NewConstraint(constraint)
+	if err != nil {
+		return fmt.Errorf("invalid nix version constraint %q: %s", constraint, err)
+	}
+
+	cmd := exec.Command(binaries.Nix, "--version")
+	output := bytes.NewBuffer(nil)
+	err = runCommandWithLogging(cmd, output)
+	if err != nil {
+		return fmt.Errorf("unable to get the version of %s: %s", binaries.Nix, formatChildErr(err))
+	}
+
+	match := nixVersionRegexp.FindString(output.String())
+	if match == "" {
+		return fmt.Errorf("unable to parse the version of %s from %q", binaries.Nix, output.String())
+	}
+	v, err := version.NewVersion(match)
+	if err != nil {
+		return err
+	}
+
+	if !constraints.Check(v) {
+		return fmt.Errorf("%s is version %s, but %s is required, upgrade nix or set nix_binary to a newer nix", binaries.Nix, v, constraint)
+	}
+	return nil
+}
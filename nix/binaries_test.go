@@ -0,0 +1,37 @@
+package nix
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckBinaries(t *testing.T) {
+	dir := fakeCommands(t, map[string]string{"nix": "", "nix-build": ""})
+	defer SetBinaries(Binaries{})
+
+	for _, tc := range []struct {
+		binaries     Binaries
+		nixosRebuild bool
+		missing      string
+	}{
+		{Binaries{}, false, ""},
+		{Binaries{Nix: filepath.Join(dir, "nix"), NixBuild: filepath.Join(dir, "nix-build")}, false, ""},
+		{Binaries{Nix: filepath.Join(dir, "nix-2.4")}, false, "nix_binary"},
+		{Binaries{NixBuild: filepath.Join(dir, "bin", "nix-build")}, false, "nix_build_binary"},
+		// nixos-rebuild, missing from PATH, is only checked when it is set.
+		{Binaries{NixosRebuild: filepath.Join(dir, "nixos-rebuild")}, true, "nixos_rebuild_binary"},
+	} {
+		SetBinaries(tc.binaries)
+		err := CheckBinaries(tc.nixosRebuild)
+		if tc.missing == "" {
+			if err != nil {
+				t.Errorf("%+v: %s", tc.binaries, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.missing) {
+			t.Errorf("%+v: got %v, expected an error naming %s", tc.binaries, err, tc.missing)
+		}
+	}
+}
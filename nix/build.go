@@ -0,0 +1,134 @@
+package nix
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// usesNixBuild reports whether buildCommand uses nix build.
+func (cfg *NixosRebuildConfig) usesNixBuild() bool {
+	return cfg.UseNewCLI && (cfg.BuildHost == "" || cfg.BuildHost == "localhost")
+}
+
+// buildCommand returns the command BuildSystem uses to build the system
+// toplevel into outLink, run in the directory containing outLink.
+//
+// The legacy command is nixos-rebuild build, which always names its output
+// link result. With UseNewCLI, local builds use nix build, builds on another
+// build host still go through nixos-rebuild. If jsonLog is set nix build logs
+// with --log-format internal-json.
+func (cfg *NixosRebuildConfig) buildCommand(outLink string, jsonLog bool) *exec.Cmd {
+	if !cfg.usesNixBuild() {
+		return command("nixos-rebuild", append([]string{"build"}, cfg.rebuildFlags()...)...)
+	}
+
+	features := append([]string{"nix-command"}, cfg.ExperimentalFeatures...)
+	if cfg.Flake != "" {
+		features = append(features, "flakes")
+	}
+
+	args := append([]string{"build"}, experimentalFeatureFlags(features)...)
+	if jsonLog {
+		args = append(args, "--log-format", "internal-json")
+	}
+	args = append(args, "--out-link", outLink)
+	if cfg.Flake != "" {
+		flake, attr := SplitFlakeRef(cfg.Flake)
+		args = append(args, fmt.Sprintf("%s#nixosConfigurations.%s.config.system.build.toplevel", flake, attr))
+	} else {
+		// NIXOS_CONFIG and NIX_PATH come from the environment, as with nixos-rebuild.
+		args = append(args, "--file", "<nixpkgs/nixos>", "config.system.build.toplevel")
+	}
+	args = append(args, cfg.evalFlags()...)
+
+	return command("nix", args...)
+}
+
+// EvalSystem evaluates the system toplevel and returns its store path without
+// building it. It is used to plan without a local build.
+func EvalSystem(cfg *NixosRebuildConfig) (string, error) {
+	if cfg.SystemPath != "" {
+		return cfg.SystemPath, nil
+	}
+	return evalToplevel(cfg, "outPath")
+}
+
+// SystemDrvPath returns the path of the derivation of the system toplevel.
+func SystemDrvPath(cfg *NixosRebuildConfig) (string, error) {
+	return evalToplevel(cfg, "drvPath")
+}
+
+// evalToplevel evaluates the string attribute attr of the system toplevel.
+func evalToplevel(cfg *NixosRebuildConfig, attr string) (string, error) {
+	var cmd *exec.Cmd
+	if cfg.Flake != "" {
+		features := append([]string{"nix-command", "flakes"}, cfg.ExperimentalFeatures...)
+		flake, name := SplitFlakeRef(cfg.Flake)
+		args := append([]string{"eval"}, experimentalFeatureFlags(features)...)
+		args = append(args, "--raw", fmt.Sprintf("%s#nixosConfigurations.%s.config.system.build.toplevel.%s", flake, name, attr))
+		cmd = command("nix", append(args, cfg.evalFlags()...)...)
+	} else {
+		args := experimentalFeatureFlags(cfg.ExperimentalFeatures)
+		args = append(args, "--eval", "--json", "<nixpkgs/nixos>", "-A", "system."+attr)
+		cmd = command("nix-instantiate", append(args, cfg.evalFlags()...)...)
+	}
+	cmd.Env = cfg.GetEnv()
+
+	output := bytes.NewBuffer(nil)
+	err := cfg.runWithTimeout(cfg.BuildTimeout, func(cfg *NixosRebuildConfig) error {
+		return cfg.runCommand(cmd, output)
+	})
+	if err != nil {
+		return "", formatChildErr(err)
+	}
+	return strings.Trim(strings.TrimSpace(output.String()), "\""), nil
+}
+
+// Specialisations returns the names of the specialisations of the system,
+// evaluating the configuration without building it.
+func Specialisations(cfg *NixosRebuildConfig) ([]string, error) {
+	var cmd *exec.Cmd
+	if cfg.Flake != "" {
+		features := append([]string{"nix-command", "flakes"}, cfg.ExperimentalFeatures...)
+		flake, name := SplitFlakeRef(cfg.Flake)
+		args := append([]string{"eval"}, experimentalFeatureFlags(features)...)
+		args = append(args, "--json", fmt.Sprintf("%s#nixosConfigurations.%s.config.specialisation", flake, name), "--apply", "builtins.attrNames")
+		cmd = command("nix", append(args, cfg.evalFlags()...)...)
+	} else {
+		// The ellipsis passes the --arg flags on to <nixpkgs/nixos>.
+		args := experimentalFeatureFlags(cfg.ExperimentalFeatures)
+		args = append(args, "--eval", "--strict", "--json", "--expr", "{ ... }@args: builtins.attrNames (import <nixpkgs/nixos> args).config.specialisation")
+		cmd = command("nix-instantiate", append(args, cfg.evalFlags()...)...)
+	}
+	cmd.Env = cfg.GetEnv()
+
+	output := bytes.NewBuffer(nil)
+	err := cfg.runWithTimeout(cfg.BuildTimeout, func(cfg *NixosRebuildConfig) error {
+		return cfg.runCommand(cmd, output)
+	})
+	if err != nil {
+		return nil, formatChildErr(err)
+	}
+	var names []string
+	err = json.Unmarshal(output.Bytes(), &names)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the specialisations of the system: %s", err)
+	}
+	return names, nil
+}
+
+// BuildKey identifies the system BuildSystem and EvalSystem produce, configs
+// with the same key produce the same system.
+func (cfg *NixosRebuildConfig) BuildKey() string {
+	h := sha256.New()
+	for _, input := range append([]string{cfg.NixosConfigPath, cfg.NixPath, cfg.SystemPath, strconv.FormatBool(cfg.UseNewCLI)}, cfg.rebuildFlags()...) {
+		fmt.Fprintf(h, "%d:%s\n", len(input), input)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
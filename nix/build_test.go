@@ -0,0 +1,116 @@
+package nix
+
+import (
+	"reflect"
+	"testing"
+)
+
+// countArg returns how many times arg is in args.
+func countArg(args []string, arg string) int {
+	n := 0
+	for _, a := range args {
+		if a == arg {
+			n++
+		}
+	}
+	return n
+}
+
+func TestImpureFlag(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		cfg      NixosRebuildConfig
+		expected int
+	}{
+		{"flake nix build", NixosRebuildConfig{Flake: "/src#host", UseNewCLI: true, Impure: true}, 1},
+		{"flake nixos-rebuild", NixosRebuildConfig{Flake: "/src#host", Impure: true}, 1},
+		{"flake on a build host", NixosRebuildConfig{Flake: "/src#host", UseNewCLI: true, BuildHost: "builder", Impure: true}, 1},
+		{"pure flake", NixosRebuildConfig{Flake: "/src#host", UseNewCLI: true}, 0},
+		// Evaluations without a flake are always impure.
+		{"no flake", NixosRebuildConfig{UseNewCLI: true, Impure: true}, 0},
+	} {
+		args := tc.cfg.buildCommand("/tmp/result", false).Args
+		if n := countArg(args, "--impure"); n != tc.expected {
+			t.Errorf("%s: --impure is %d times in the build %q, expected %d", tc.name, n, args, tc.expected)
+		}
+		// The switch runs nixos-rebuild with the same flags.
+		if n := countArg(tc.cfg.rebuildFlags(), "--impure"); n != tc.expected {
+			t.Errorf("%s: --impure is %d times in the switch flags %q, expected %d", tc.name, n, tc.cfg.rebuildFlags(), tc.expected)
+		}
+	}
+}
+
+func TestExperimentalFeatureFlags(t *testing.T) {
+	features := []string{"ca-derivations", "recursive-nix"}
+	for _, tc := range []struct {
+		name     string
+		cfg      NixosRebuildConfig
+		expected []string
+	}{
+		{
+			"nix build",
+			NixosRebuildConfig{UseNewCLI: true, ExperimentalFeatures: features, MaxJobs: 4},
+			[]string{"nix", "build", "--extra-experimental-features", "nix-command ca-derivations recursive-nix", "--out-link", "/tmp/result", "--file", "<nixpkgs/nixos>", "config.system.build.toplevel", "--max-jobs", "4"},
+		},
+		{
+			"nix build flake",
+			NixosRebuildConfig{UseNewCLI: true, Flake: "/src#host", ExperimentalFeatures: features},
+			[]string{"nix", "build", "--extra-experimental-features", "nix-command ca-derivations recursive-nix flakes", "--out-link", "/tmp/result", "/src#nixosConfigurations.host.config.system.build.toplevel", "--no-update-lock-file"},
+		},
+		{
+			"nixos-rebuild",
+			NixosRebuildConfig{ExperimentalFeatures: features, MaxJobs: 4},
+			[]string{"nixos-rebuild", "build", "--extra-experimental-features", "ca-derivations recursive-nix", "--build-host", "", "--max-jobs", "4"},
+		},
+		{
+			"no features",
+			NixosRebuildConfig{},
+			[]string{"nixos-rebuild", "build", "--build-host", ""},
+		},
+	} {
+		args := tc.cfg.buildCommand("/tmp/result", false).Args
+		if !reflect.DeepEqual(args, tc.expected) {
+			t.Errorf("%s:\n got %q\nwant %q", tc.name, args, tc.expected)
+		}
+	}
+}
+
+func TestBuildCommand(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		cfg      NixosRebuildConfig
+		jsonLog  bool
+		expected []string
+	}{
+		{
+			"legacy",
+			NixosRebuildConfig{},
+			true,
+			[]string{"nixos-rebuild", "build", "--build-host", ""},
+		},
+		{
+			"new cli",
+			NixosRebuildConfig{UseNewCLI: true},
+			false,
+			[]string{"nix", "build", "--extra-experimental-features", "nix-command", "--out-link", "/tmp/result", "--file", "<nixpkgs/nixos>", "config.system.build.toplevel"},
+		},
+		{
+			"new cli json log",
+			NixosRebuildConfig{UseNewCLI: true, BuildHost: "localhost"},
+			true,
+			[]string{"nix", "build", "--extra-experimental-features", "nix-command", "--log-format", "internal-json", "--out-link", "/tmp/result", "--file", "<nixpkgs/nixos>", "config.system.build.toplevel"},
+		},
+		// nix build can't build on another host.
+		{
+			"new cli build host",
+			NixosRebuildConfig{UseNewCLI: true, BuildHost: "builder"},
+			true,
+			[]string{"nixos-rebuild", "build", "--build-host", "builder"},
+		},
+	} {
+		args := tc.cfg.buildCommand("/tmp/result", tc.jsonLog).Args
+		if !reflect.DeepEqual(args, tc.expected) {
+			t.Errorf("%s:\n got %q\nwant %q", tc.name, args, tc.expected)
+		}
+	}
+}
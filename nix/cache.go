@@ -0,0 +1,105 @@
+package nix
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CachePush describes a binary cache built systems are pushed to.
+type CachePush struct {
+	// URL is the nix store URL of the cache, credentials come from the
+	// environment.
+	URL string
+	// SigningKeyFile, if set, signs the closure before it is pushed.
+	SigningKeyFile string
+	// WarnOnFailure logs failed pushes instead of failing.
+	WarnOnFailure bool
+	// Tool pushes with nix copy when it is "" or "nix", or with the attic or
+	// cachix command line tools, which push to the cache called Name.
+	Tool string
+	Name string
+	// Env is added to the environment of the push command.
+	Env []string
+}
+
+// PushToCache copies the closure of storePath to the PostBuildPush cache.
+func PushToCache(cfg *NixosRebuildConfig, storePath string) error {
+	push := cfg.PostBuildPush
+	if push == nil {
+		return nil
+	}
+
+	err := pushToCache(cfg, push, storePath)
+	if err != nil && push.WarnOnFailure {
+		log.Printf("[WARN] %s", err)
+		return nil
+	}
+	return err
+}
+
+func pushToCache(cfg *NixosRebuildConfig, push *CachePush, storePath string) error {
+	if push.SigningKeyFile != "" {
+		err := SignClosure(cfg, push.SigningKeyFile, storePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	var cmd *exec.Cmd
+	switch push.Tool {
+	case "attic":
+		cmd = exec.Command("attic", "push", push.Name, storePath)
+	case "cachix":
+		cmd = exec.Command("cachix", "push", push.Name, storePath)
+	default:
+		args := append([]string{"copy"}, experimentalFeatureFlags(append([]string{"nix-command"}, cfg.ExperimentalFeatures...))...)
+		args = append(args, "--to", push.URL, storePath)
+		cmd = command("nix", args...)
+	}
+	cmd.Env = append(cfg.GetEnv(), push.Env...)
+	err := cfg.runCommand(cmd, ioutil.Discard)
+	if err != nil {
+		return fmt.Errorf("pushing %s to %s failed: %s", storePath, push.URL, formatChildErr(err))
+	}
+	log.Printf("[INFO] pushed %s to %s", storePath, push.URL)
+	return nil
+}
+
+// CacheHasPath reports whether the binary cache at url can serve storePath.
+// Http caches are asked for the narinfo of the path directly, with token as a
+// bearer token if it is set, other stores are queried with nix path-info.
+func CacheHasPath(url string, storePath string, token string) (bool, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		cmd := command("nix", append(experimentalFeatureFlags([]string{"nix-command"}), "path-info", "--store", url, storePath)...)
+		err := runCommandWithLogging(cmd, ioutil.Discard)
+		return err == nil, nil
+	}
+
+	hash := strings.SplitN(filepath.Base(storePath), "-", 2)[0]
+	req, err := http.NewRequest("HEAD", strings.TrimRight(url, "/")+"/"+hash+".narinfo", nil)
+	if err != nil {
+		return false, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	_ = resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected status %d fetching the narinfo of %s from %s", resp.StatusCode, storePath, url)
+}
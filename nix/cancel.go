@@ -0,0 +1,114 @@
+package nix
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// ErrCancelled is returned by commands and waits stopped because terraform
+// was interrupted.
+var ErrCancelled = errors.New("cancelled")
+
+// ErrTimeout is returned by commands and waits stopped because the context
+// of their config is done, which the resources use for their timeouts.
+var ErrTimeout = errors.New("the resource timeout passed")
+
+// stopCtx is done once terraform asks the provider to stop.
+var stopCtx = context.Background()
+
+// SetStopContext makes the commands and waits of this package stop once ctx
+// is done, the provider passes its stop context.
+func SetStopContext(ctx context.Context) {
+	stopCtx = ctx
+}
+
+// context returns the Context of cfg, or the background context if it has
+// none.
+func (cfg *NixosRebuildConfig) context() context.Context {
+	if cfg.Context != nil {
+		return cfg.Context
+	}
+	return context.Background()
+}
+
+// stopErr returns why commands under ctx must stop, or nil.
+func stopErr(ctx context.Context) error {
+	if stopCtx.Err() != nil {
+		return ErrCancelled
+	}
+	if ctx.Err() != nil {
+		return ErrTimeout
+	}
+	return nil
+}
+
+// killGrace is how long interrupted commands get to exit before they are
+// killed.
+const killGrace = 10 * time.Second
+
+// runCancellable runs c in a process group of its own, so the builders and
+// ssh connections it starts can be stopped with it. Once the stop context or
+// ctx is done the group is sent SIGINT, then SIGKILL if it is still running
+// after killGrace.
+func runCancellable(ctx context.Context, c *exec.Cmd) error {
+	if err := stopErr(ctx); err != nil {
+		return err
+	}
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	c.SysProcAttr.Setpgid = true
+
+	err := c.Start()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+			return
+		case <-stopCtx.Done():
+		case <-ctx.Done():
+		}
+		_ = syscall.Kill(-c.Process.Pid, syscall.SIGINT)
+		select {
+		case <-done:
+		case <-time.After(killGrace):
+			_ = syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+		}
+	}()
+
+	err = c.Wait()
+	close(done)
+	if err != nil {
+		if stop := stopErr(ctx); stop != nil {
+			return stop
+		}
+	}
+	return err
+}
+
+// Sleep waits for d, returning ErrCancelled if terraform is interrupted
+// first.
+func Sleep(d time.Duration) error {
+	return SleepContext(context.Background(), d)
+}
+
+// SleepContext is Sleep, also returning ErrTimeout if ctx is done first.
+func SleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-stopCtx.Done():
+		return ErrCancelled
+	case <-ctx.Done():
+		return ErrTimeout
+	}
+}
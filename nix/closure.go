@@ -0,0 +1,64 @@
+package nix
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ClosureSize returns the total nar size in bytes of the closure of the local
+// store path storePath.
+func ClosureSize(storePath string) (int64, error) {
+	output := bytes.NewBuffer(nil)
+	err := runCommandWithLogging(command("nix-store", "--query", "--requisites", storePath), output)
+	if err != nil {
+		return 0, formatChildErr(err)
+	}
+	return pathsSize(strings.Fields(output.String()))
+}
+
+// pathsSize returns the total nar size in bytes of the local store paths.
+func pathsSize(paths []string) (int64, error) {
+	if len(paths) == 0 {
+		return 0, nil
+	}
+	output := bytes.NewBuffer(nil)
+	err := runCommandWithLogging(command("nix-store", append([]string{"--query", "--size"}, paths...)...), output)
+	if err != nil {
+		return 0, formatChildErr(err)
+	}
+	var total int64
+	for _, field := range strings.Fields(output.String()) {
+		size, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("unexpected nix-store --query --size output %q", field)
+		}
+		total += size
+	}
+	return total, nil
+}
+
+var ansiEscapeRegexp = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// DiffClosures returns the package version and size changes between the
+// closures of the local store paths oldPath and newPath, one per line, as
+// printed by nix store diff-closures.
+func DiffClosures(cfg *NixosRebuildConfig, oldPath, newPath string) ([]string, error) {
+	args := append([]string{"store", "diff-closures"}, experimentalFeatureFlags(append([]string{"nix-command"}, cfg.ExperimentalFeatures...))...)
+	output := bytes.NewBuffer(nil)
+	err := runCommandWithLogging(command("nix", append(args, oldPath, newPath)...), output)
+	if err != nil {
+		return nil, formatChildErr(err)
+	}
+
+	var changes []string
+	for _, line := range strings.Split(ansiEscapeRegexp.ReplaceAllString(output.String(), ""), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			changes = append(changes, line)
+		}
+	}
+	return changes, nil
+}
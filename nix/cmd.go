@@ -3,29 +3,101 @@ package nix
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os/exec"
 	"strconv"
+	"strings"
+	"sync"
 )
 
 func runCommandWithLogging(c *exec.Cmd, stdout io.Writer) error {
-	log.Printf("running %v in env %v", c.Args, c.Env)
+	return runCommandWithLog(context.Background(), c, stdout, nil, "", nil)
+}
+
+// runCommand runs c with runCommandWithLogging, also writing its output to
+// cfg.Log when it is set. Logged lines are prefixed with the TargetHost, so
+// parallel deployments can be told apart.
+func (cfg *NixosRebuildConfig) runCommand(c *exec.Cmd, stdout io.Writer) error {
+	return cfg.escalationErr(runCommandWithLog(cfg.context(), c, stdout, cfg.Log, cfg.TargetHost, nil))
+}
+
+// runRemote is runCommand for a command of the given phase on the
+// TargetHost, stopping it if it runs longer than the CommandTimeout.
+func (cfg *NixosRebuildConfig) runRemote(phase string, c *exec.Cmd, stdout io.Writer) error {
+	if cfg.CommandTimeout <= 0 {
+		return cfg.runCommand(c, stdout)
+	}
+	ctx, cancel := context.WithTimeout(cfg.context(), cfg.CommandTimeout)
+	defer cancel()
+	err := cfg.escalationErr(runCommandWithLog(ctx, c, stdout, cfg.Log, cfg.TargetHost, nil))
+	if err == ErrTimeout && cfg.context().Err() == nil {
+		return fmt.Errorf("%s on %s exceeded the command timeout of %s and was stopped, running %s", phase, cfg.TargetHost, cfg.CommandTimeout, strings.Join(c.Args, " "))
+	}
+	return err
+}
+
+// runCommandWithProgress is runCommand for commands run with
+// --log-format internal-json, their progress is summarised instead of being
+// logged line by line.
+func (cfg *NixosRebuildConfig) runCommandWithProgress(c *exec.Cmd, stdout io.Writer) error {
+	return cfg.escalationErr(runCommandWithLog(cfg.context(), c, stdout, cfg.Log, cfg.TargetHost, newBuildProgress()))
+}
+
+// runCommandWithLog runs c, logging each line of its output as it arrives
+// with the given prefix, and writing it to logw unless it is nil. The
+// environment is never written to logw, it may contain secrets. If progress
+// is set, internal-json log lines on stderr are passed to it. c reads its
+// Stdin if one is set, and is stopped once ctx is done.
+func runCommandWithLog(ctx context.Context, c *exec.Cmd, stdout io.Writer, logw io.Writer, prefix string, progress *buildProgress) error {
+	log.Printf("running %v in env %v", c.Args, redactEnv(c.Env))
+
+	var logMu sync.Mutex
+	writeLog := func(s string) {
+		if logw == nil {
+			return
+		}
+		logMu.Lock()
+		defer logMu.Unlock()
+		_, _ = io.WriteString(logw, s)
+	}
+	writeLog(fmt.Sprintf("$ %s\n", strings.Join(c.Args, " ")))
+
+	if prefix != "" {
+		prefix += " "
+	}
 
 	er, ew := io.Pipe()
 	or, ow := io.Pipe()
 	c.Stdout = ow
 	c.Stderr = ew
-	c.Stdin = nil
 
-	capture := func(r io.Reader, label string) {
+	stderrSaver := &prefixSuffixSaver{N: 32 << 10}
+
+	capture := func(r io.Reader, label string, saver io.Writer) {
 		brdr := bufio.NewReader(r)
 
 		for {
 			s, err := brdr.ReadString('\n')
-			if len(s) != 0 {
-				log.Printf("[INFO] %s: %s", label, s)
+			if progress != nil && strings.HasPrefix(s, internalJSONPrefix) {
+				var summary string
+				s, summary = progress.handle(strings.TrimPrefix(s, internalJSONPrefix))
+				if summary != "" {
+					log.Printf("[INFO] %sprogress: %s", prefix, summary)
+					writeLog("progress: " + summary + "\n")
+				}
+			}
+			_, _ = io.WriteString(saver, s)
+			// Progress output redraws a line with carriage returns, each
+			// redraw is logged as a line of its own.
+			for _, line := range strings.Split(strings.TrimSuffix(s, "\n"), "\r") {
+				if len(line) != 0 {
+					log.Printf("[INFO] %s%s: %s", prefix, label, line)
+					writeLog(label + ": " + line + "\n")
+				}
 			}
 			if err != nil {
 				break
@@ -34,16 +106,14 @@ func runCommandWithLogging(c *exec.Cmd, stdout io.Writer) error {
 
 	}
 
-	stderrSaver := &prefixSuffixSaver{N: 32 << 10}
-	terr := io.TeeReader(er, stderrSaver)
 	tout := io.TeeReader(or, stdout)
 
 	ioDone := make(chan struct{})
 
-	go func() { capture(terr, "stderr"); ioDone <- struct{}{} }()
-	go func() { capture(tout, "stdout"); ioDone <- struct{}{} }()
+	go func() { capture(er, "stderr", stderrSaver); ioDone <- struct{}{} }()
+	go func() { capture(tout, "stdout", ioutil.Discard); ioDone <- struct{}{} }()
 
-	err := c.Run()
+	err := runCancellable(ctx, c)
 
 	_ = or.Close()
 	_ = er.Close()
@@ -131,3 +201,15 @@ func minInt(a, b int) int {
 	}
 	return b
 }
+
+// redactEnv returns env with the ssh password hidden, for logging.
+func redactEnv(env []string) []string {
+	redacted := make([]string, len(env))
+	for i, kv := range env {
+		if strings.HasPrefix(kv, sshPasswordEnv+"=") {
+			kv = sshPasswordEnv + "=<redacted>"
+		}
+		redacted[i] = kv
+	}
+	return redacted
+}
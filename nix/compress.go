@@ -0,0 +1,73 @@
+package nix
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+)
+
+// compressors are the commands compressing and decompressing a closure
+// stream for each CopyCompression algorithm.
+var compressors = map[string][2]string{
+	"zstd": {"zstd -c", "zstd -d -c"},
+	"xz":   {"xz -c", "xz -d -c"},
+}
+
+// streamCompressed reports whether closures are copied as a compressed
+// nix-store --export stream rather than by nix-copy-closure or nix copy.
+func (cfg *NixosRebuildConfig) streamCompressed() bool {
+	_, ok := compressors[cfg.CopyCompression]
+	return ok
+}
+
+// copySSHEnv returns the environment for commands copying closures over ssh,
+// with ssh compression enabled if requested.
+func (cfg *NixosRebuildConfig) copySSHEnv() []string {
+	env := cfg.GetEnv()
+	if cfg.CopyCompression == "ssh" {
+		env = append(env, fmt.Sprintf("NIX_SSHOPTS=%s -C", cfg.SSHOpts))
+	}
+	return env
+}
+
+// copyStream copies the paths of the closure of storePath missing on the
+// TargetHost as a nix-store --export stream, compressed if CopyCompression
+// is zstd or xz. The target needs the decompressor installed. Closures too
+// large for the arguments of one export are streamed in batches, in
+// dependency order so each batch imports once the previous one is valid.
+func copyStream(cfg *NixosRebuildConfig, storePath string) error {
+	paths, err := missingPaths(cfg, storePath)
+	if err != nil {
+		return err
+	}
+
+	for _, batch := range argBatches(paths) {
+		err = copyStreamBatch(cfg, batch)
+		if err != nil {
+			if cfg.streamCompressed() {
+				return fmt.Errorf("copying %d paths compressed with %s failed: %s", len(paths), cfg.CopyCompression, formatChildErr(err))
+			}
+			return fmt.Errorf("copying %d paths failed: %s", len(paths), formatChildErr(err))
+		}
+	}
+	return nil
+}
+
+// copyStreamBatch copies paths to the TargetHost in one export stream.
+func copyStreamBatch(cfg *NixosRebuildConfig, paths []string) error {
+	// The paths are arguments of the script rather than part of it, the
+	// script must fit in a single argument.
+	export := fmt.Sprintf("%s --export \"$@\"", shellQuote(binaryPath("nix-store")))
+	receive := cfg.rootCommand("nix-store --import") + " > /dev/null"
+	if cfg.streamCompressed() {
+		compress, decompress := compressors[cfg.CopyCompression][0], compressors[cfg.CopyCompression][1]
+		if cfg.CopyCompressionLevel > 0 {
+			compress = fmt.Sprintf("%s -%d", compress, cfg.CopyCompressionLevel)
+		}
+		export += " | " + compress
+		receive = decompress + " | " + receive
+	}
+	cmd := exec.Command("sh", append([]string{"-c", export + " | " + cfg.copyShell(cfg.tempDirCommand(receive)), "sh"}, paths...)...)
+	cmd.Env = cfg.GetEnv()
+	return cfg.runCommand(cmd, ioutil.Discard)
+}
@@ -0,0 +1,39 @@
+package nix
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCopyStreamLargeClosure(t *testing.T) {
+	closure := fakeClosure(50000)
+	// The export stream is just the exported paths, imported in the order
+	// of the runs of nix-store --import.
+	store := fakeNixStore(1) + `case "$1" in
+--export) shift; printf '%s\n' "$@" ;;
+--import) cat >> "$(dirname "$0")/imported" ;;
+esac
+`
+	dir := fakeCommands(t, map[string]string{"nix-store": store})
+	err := ioutil.WriteFile(filepath.Join(dir, "closure"), []byte(strings.Join(closure, "\n")+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &NixosRebuildConfig{Local: true, TargetHost: "example.com", CopyCommandTemplate: "sh -c {{.Command}}"}
+	err = copyStream(cfg, closure[len(closure)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported, err := ioutil.ReadFile(filepath.Join(dir, "imported"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(strings.Fields(string(imported)), closure) {
+		t.Fatalf("expected the %d paths of the closure to be imported in dependency order", len(closure))
+	}
+}
@@ -0,0 +1,207 @@
+package nix
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+)
+
+// RemotePathValid reports whether storePath is valid in the store of the
+// TargetHost.
+func RemotePathValid(cfg *NixosRebuildConfig, storePath string) (bool, error) {
+	output := bytes.NewBuffer(nil)
+	err := cfg.runRemote("checking store paths", cfg.sshCommand("nix-store --check-validity --print-invalid "+shellQuote(storePath)), output)
+	if err != nil {
+		return false, formatChildErr(err)
+	}
+	return strings.TrimSpace(output.String()) == "", nil
+}
+
+// maxArgsSize bounds the size of the paths passed as the arguments of one
+// command, well below the argument limit of the systems nix runs on.
+const maxArgsSize = 128 << 10
+
+// argBatches splits paths into batches that each fit in the arguments of one
+// command, keeping their order.
+func argBatches(paths []string) [][]string {
+	var batches [][]string
+	size := 0
+	for i, p := range paths {
+		if i == 0 || size+len(p)+1 > maxArgsSize {
+			batches = append(batches, nil)
+			size = 0
+		}
+		batches[len(batches)-1] = append(batches[len(batches)-1], p)
+		size += len(p) + 1
+	}
+	return batches
+}
+
+// missingPaths returns the paths of the closure of storePath that are not
+// valid on the TargetHost, in dependency order.
+func missingPaths(cfg *NixosRebuildConfig, storePath string) ([]string, error) {
+	cmd := command("nix-store", "--query", "--requisites", storePath)
+	cmd.Env = cfg.GetEnv()
+	output := bytes.NewBuffer(nil)
+	err := cfg.runCommand(cmd, output)
+	if err != nil {
+		return nil, formatChildErr(err)
+	}
+	closure := strings.Fields(output.String())
+
+	// Large closures don't fit in a single command line.
+	output = bytes.NewBuffer(nil)
+	cmd = cfg.sshCommand("xargs nix-store --check-validity --print-invalid")
+	cmd.Stdin = strings.NewReader(strings.Join(closure, "\n"))
+	err = cfg.runRemote("checking store paths", cmd, output)
+	if err != nil {
+		return nil, formatChildErr(err)
+	}
+	invalid := make(map[string]bool)
+	for _, p := range strings.Fields(output.String()) {
+		invalid[p] = true
+	}
+
+	// --requisites lists the closure in dependency order.
+	var missing []string
+	for _, p := range closure {
+		if invalid[p] {
+			missing = append(missing, p)
+		}
+	}
+	return missing, nil
+}
+
+// checkFreeSpace fails if the paths of the closure of storePath missing on
+// the TargetHost won't fit in the free space of its store, after collecting
+// garbage once with GCOnLowSpace. The space needed is recorded in the
+// Report. Targets whose free space df doesn't report aren't checked.
+func checkFreeSpace(cfg *NixosRebuildConfig, storePath string) error {
+	paths, err := missingPaths(cfg, storePath)
+	if err != nil {
+		return err
+	}
+	required, err := pathsSize(paths)
+	if err != nil {
+		return err
+	}
+	if cfg.Report != nil {
+		cfg.Report.RequiredCopyBytes = required
+	}
+	if required == 0 {
+		return nil
+	}
+
+	for collect := cfg.GCOnLowSpace; ; collect = false {
+		free, mount, err := storeFree(cfg)
+		if err == ErrCancelled || err == ErrTimeout {
+			return err
+		}
+		if err != nil {
+			log.Printf("[WARN] unable to check %s has space for %s: %s", cfg.TargetHost, formatBytes(required), err)
+			return nil
+		}
+		if required <= free {
+			return nil
+		}
+		if !collect {
+			return fmt.Errorf("copying to %s needs ~%s, only %s free on %s", cfg.TargetHost, formatBytes(required), formatBytes(free), mount)
+		}
+		log.Printf("[INFO] copying to %s needs ~%s, only %s free on %s, collecting garbage", cfg.TargetHost, formatBytes(required), formatBytes(free), mount)
+		_, err = CollectGarbage(cfg)
+		if err == ErrCancelled || err == ErrTimeout {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("collecting garbage to make space on %s failed: %s", cfg.TargetHost, err)
+		}
+	}
+}
+
+// copyParallel copies the closure of storePath to the TargetHost with
+// CopyParallelism streams. Each stream copies the closures of its paths, so
+// dependencies shared between streams may be sent more than once. storePath
+// itself is copied last, once everything else is valid on the target.
+func copyParallel(cfg *NixosRebuildConfig, storePath string) error {
+	missing, err := missingPaths(cfg, storePath)
+	if err != nil {
+		return err
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	batches := make([][]string, cfg.CopyParallelism)
+	n := 0
+	for _, p := range missing {
+		if p == storePath {
+			continue
+		}
+		batches[n%len(batches)] = append(batches[n%len(batches)], p)
+		n++
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(batches))
+	for i, batch := range batches {
+		if len(batch) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, batch []string) {
+			defer wg.Done()
+			errs[i] = copyPaths(cfg, batch)
+		}(i, batch)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("stream %d: %s", i+1, err))
+		}
+	}
+	if len(failed) != 0 {
+		return fmt.Errorf("copying to %s failed:\n%s", cfg.TargetHost, strings.Join(failed, "\n"))
+	}
+
+	err = copyPaths(cfg, []string{storePath})
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] copied %d paths of the closure of %s to %s with %d streams", len(missing), storePath, cfg.TargetHost, cfg.CopyParallelism)
+	return nil
+}
+
+// substituteOnTarget reports whether the TargetHost substitutes from caches
+// other than its own before closures are copied to it.
+func (cfg *NixosRebuildConfig) substituteOnTarget() bool {
+	return cfg.UseSubstitutes && len(cfg.Substituters) != 0
+}
+
+// substitute lets the TargetHost download the missing paths of the closure
+// of storePath from the Substituters. Paths the caches don't have are left
+// for the copy.
+func substitute(cfg *NixosRebuildConfig, storePath string) error {
+	missing, err := missingPaths(cfg, storePath)
+	if err != nil || len(missing) == 0 {
+		return err
+	}
+
+	// The missing paths are read from stdin, they don't fit in a single
+	// command line.
+	args := []string{"xargs", "nix-store", "--realise", "--keep-going", "--option", "substituters", strings.Join(cfg.Substituters, " ")}
+	if len(cfg.TrustedPublicKeys) != 0 {
+		args = append(args, "--option", "trusted-public-keys", strings.Join(cfg.TrustedPublicKeys, " "))
+	}
+	cmd := cfg.rootSSHCommand(remoteArgs(args))
+	cmd.Stdin = strings.NewReader(strings.Join(missing, "\n"))
+	err = cfg.runRemote("substitution", cmd, ioutil.Discard)
+	if err != nil {
+		log.Printf("[INFO] %s could not substitute all of %d missing paths, copying the rest: %s", cfg.TargetHost, len(missing), formatChildErr(err))
+	}
+	return nil
+}
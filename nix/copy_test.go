@@ -0,0 +1,202 @@
+package nix
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeNixStore answers --query with the closure in the file closure next to
+// it, and reports every nth path of the closure as invalid.
+func fakeNixStore(n int) string {
+	return fmt.Sprintf(`case "$1" in
+--query) cat "$(dirname "$0")/closure" ;;
+--check-validity) shift 2; printf '%%s\n' "$@" | awk -F '[/-]' '($4 + 0) %% %d == 0' ;;
+esac
+`, n)
+}
+
+// fakeStore installs fakeNixStore(n) for closure, with commands for scripts.
+func fakeStore(t *testing.T, closure []string, n int, scripts map[string]string) string {
+	scripts["nix-store"] = fakeNixStore(n)
+	dir := fakeCommands(t, scripts)
+	err := ioutil.WriteFile(filepath.Join(dir, "closure"), []byte(strings.Join(closure, "\n")+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// calledWith returns the arguments of every run of the fake commands that
+// record them in files named prefix.<pid> in dir.
+func calledWith(t *testing.T, dir, prefix string) [][]string {
+	files, err := filepath.Glob(filepath.Join(dir, prefix+".*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var runs [][]string
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		runs = append(runs, strings.Fields(string(data)))
+	}
+	return runs
+}
+
+func TestArgBatches(t *testing.T) {
+	for _, tc := range []struct {
+		paths   []string
+		batches int
+	}{
+		{nil, 0},
+		{[]string{"/nix/store/a"}, 1},
+		{fakeClosure(100), 1},
+		{fakeClosure(10000), 7},
+	} {
+		batches := argBatches(tc.paths)
+		if len(batches) != tc.batches {
+			t.Errorf("%d paths: expected %d batches, got %d", len(tc.paths), tc.batches, len(batches))
+		}
+		var joined []string
+		for _, batch := range batches {
+			size := 0
+			for _, p := range batch {
+				size += len(p) + 1
+			}
+			if size > maxArgsSize {
+				t.Errorf("%d paths: batch of %d bytes is over %d", len(tc.paths), size, maxArgsSize)
+			}
+			joined = append(joined, batch...)
+		}
+		if len(tc.paths) != 0 && !reflect.DeepEqual(joined, tc.paths) {
+			t.Errorf("%d paths: batches don't keep the paths in order", len(tc.paths))
+		}
+	}
+}
+
+func TestMissingPathsLargeClosure(t *testing.T) {
+	closure := fakeClosure(5000)
+	fakeStore(t, closure, 3, map[string]string{})
+
+	missing, err := missingPaths(&NixosRebuildConfig{Local: true}, closure[len(closure)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []string
+	for i, p := range closure {
+		if i%3 == 0 {
+			expected = append(expected, p)
+		}
+	}
+	if !reflect.DeepEqual(missing, expected) {
+		t.Fatalf("expected %d missing paths, got %d", len(expected), len(missing))
+	}
+}
+
+func TestCopyParallelLargeClosure(t *testing.T) {
+	closure := fakeClosure(50000)
+	dir := fakeStore(t, closure, 1, map[string]string{
+		"nix-copy-closure": `shift 2; printf '%s\n' "$@" > "$(dirname "$0")/copied.$$"` + "\n",
+	})
+
+	cfg := &NixosRebuildConfig{Local: true, TargetHost: "example.com", CopyParallelism: 2}
+	err := copyParallel(cfg, closure[len(closure)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copied := map[string]bool{}
+	runs := calledWith(t, dir, "copied")
+	for _, args := range runs {
+		for _, p := range args {
+			copied[p] = true
+		}
+	}
+	if len(copied) != len(closure) {
+		t.Fatalf("copied %d paths with %d commands, expected the %d paths of the closure", len(copied), len(runs), len(closure))
+	}
+}
+
+func TestSubstituteLargeClosure(t *testing.T) {
+	closure := fakeClosure(5000)
+	store := fakeNixStore(3) + `if [ "$1" = --realise ]; then printf '%s\n' "$@" > "$(dirname "$0")/realised.$$"; fi` + "\n"
+	dir := fakeCommands(t, map[string]string{"nix-store": store})
+	err := ioutil.WriteFile(filepath.Join(dir, "closure"), []byte(strings.Join(closure, "\n")+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &NixosRebuildConfig{Local: true, TargetHost: "example.com", Substituters: []string{"https://cache.example.com"}}
+	err = substitute(cfg, closure[len(closure)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	realised := map[string]bool{}
+	for _, args := range calledWith(t, dir, "realised") {
+		if strings.Join(args[:5], " ") != "--realise --keep-going --option substituters https://cache.example.com" {
+			t.Fatalf("unexpected nix-store arguments %q", args[:5])
+		}
+		for _, p := range args[5:] {
+			realised[p] = true
+		}
+	}
+	for i, p := range closure {
+		if realised[p] != (i%3 == 0) {
+			t.Fatalf("%s realised = %v, expected only the missing paths", p, realised[p])
+		}
+	}
+}
+
+func TestCopyProtocol(t *testing.T) {
+	const path = "/nix/store/00000000000000000000000000000000-nixos-system"
+	record := `echo "$(basename "$0") $* NIX_SSHOPTS=$NIX_SSHOPTS" > "$(dirname "$0")/copied"` + "\n"
+	dir := fakeCommands(t, map[string]string{"nix": record, "nix-copy-closure": record})
+
+	for _, tc := range []struct {
+		name     string
+		cfg      NixosRebuildConfig
+		expected string
+	}{
+		{
+			"ssh",
+			NixosRebuildConfig{TargetHost: "example.com"},
+			"nix-copy-closure --to root@example.com " + path + " NIX_SSHOPTS=-p 2222",
+		},
+		{
+			"ssh-ng",
+			NixosRebuildConfig{TargetHost: "example.com", CopyProtocol: "ssh-ng"},
+			"nix copy --extra-experimental-features nix-command --to ssh-ng://root@example.com " + path + " NIX_SSHOPTS=-p 2222",
+		},
+		{
+			"ssh-ng compressed",
+			NixosRebuildConfig{TargetHost: "example.com", CopyProtocol: "ssh-ng", CopyCompression: "ssh"},
+			"nix copy --extra-experimental-features nix-command --to ssh-ng://root@example.com?compress=true " + path + " NIX_SSHOPTS=-p 2222 -C",
+		},
+		{
+			"ssh-ng ipv6",
+			NixosRebuildConfig{TargetHost: "2001:db8::10", CopyProtocol: "ssh-ng"},
+			"nix copy --extra-experimental-features nix-command --to ssh-ng://root@[2001:db8::10] " + path + " NIX_SSHOPTS=-p 2222",
+		},
+	} {
+		cfg := tc.cfg
+		cfg.TargetUser = "root"
+		cfg.SSHOpts = "-p 2222"
+		err := copyBatch(&cfg, []string{path})
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		copied, err := ioutil.ReadFile(filepath.Join(dir, "copied"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(string(copied)); got != tc.expected {
+			t.Errorf("%s:\n got %q\nwant %q", tc.name, got, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package nix
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// DerivationConfig describes nix code to build with BuildDerivation, or to
+// evaluate with EvalJSON. Exactly one of Expression, File or Flake is set.
+type DerivationConfig struct {
+	NixPath string
+	// Expression is nix code evaluating to a derivation.
+	Expression string
+	// File is a nix file, Attribute optionally selects an attribute of it.
+	File      string
+	Attribute string
+	// Flake is a flake#attr reference.
+	Flake                string
+	ArgsStr              map[string]string
+	ExtraNixOptions      map[string]string
+	ExperimentalFeatures []string
+	MaxJobs              int
+	Cores                int
+	// Impure allows evaluations to read the environment, only EvalJSON uses it.
+	Impure bool
+}
+
+// flags returns the flags shared by evaluating and building the derivation.
+func (cfg *DerivationConfig) flags() []string {
+	var flags []string
+	for _, name := range sortedKeys(cfg.ExtraNixOptions) {
+		flags = append(flags, "--option", name, cfg.ExtraNixOptions[name])
+	}
+	return append(flags, parallelismFlags(cfg.MaxJobs, cfg.Cores)...)
+}
+
+// instantiateCommand returns the command printing the derivation path.
+func (cfg *DerivationConfig) instantiateCommand() *exec.Cmd {
+	if cfg.Flake != "" {
+		features := append([]string{"nix-command", "flakes"}, cfg.ExperimentalFeatures...)
+		args := append([]string{"eval"}, experimentalFeatureFlags(features)...)
+		args = append(args, "--raw", cfg.Flake+".drvPath")
+		return command("nix", append(args, cfg.flags()...)...)
+	}
+
+	args := experimentalFeatureFlags(cfg.ExperimentalFeatures)
+	if cfg.Expression != "" {
+		args = append(args, "-E", cfg.Expression)
+	} else {
+		args = append(args, cfg.File)
+		if cfg.Attribute != "" {
+			args = append(args, "-A", cfg.Attribute)
+		}
+	}
+	for _, name := range sortedKeys(cfg.ArgsStr) {
+		args = append(args, "--argstr", name, cfg.ArgsStr[name])
+	}
+	return command("nix-instantiate", append(args, cfg.flags()...)...)
+}
+
+func (cfg *DerivationConfig) env() []string {
+	return append(os.Environ(), fmt.Sprintf("NIX_PATH=%s", cfg.NixPath))
+}
+
+// BuildDerivation builds a derivation and returns its outputs by name.
+func BuildDerivation(cfg *DerivationConfig) (map[string]string, error) {
+	cmd := cfg.instantiateCommand()
+	cmd.Env = cfg.env()
+	output := bytes.NewBuffer(nil)
+	err := runCommandWithLogging(cmd, output)
+	if err != nil {
+		return nil, fmt.Errorf("evaluating derivation failed: %s", formatChildErr(err))
+	}
+
+	drvs := strings.Fields(output.String())
+	if len(drvs) != 1 {
+		return nil, fmt.Errorf("expected a single derivation, got %d", len(drvs))
+	}
+	drv := drvs[0]
+
+	names, err := derivationOutputs(drv)
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := acquireBuildSlot(context.Background(), drv)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	args := experimentalFeatureFlags(cfg.ExperimentalFeatures)
+	args = append(args, "--realise", drv)
+	cmd = command("nix-store", append(args, cfg.flags()...)...)
+	cmd.Env = cfg.env()
+	output = bytes.NewBuffer(nil)
+	err = runCommandWithLogging(cmd, output)
+	if err != nil {
+		return nil, fmt.Errorf("building %s failed: %s", drv, formatChildErr(err))
+	}
+
+	built := make(map[string]bool)
+	for _, p := range strings.Fields(output.String()) {
+		built[p] = true
+	}
+
+	outputs := make(map[string]string)
+	for name, p := range names {
+		if !built[p] {
+			return nil, fmt.Errorf("output %s of %s was not built", name, drv)
+		}
+		outputs[name] = p
+	}
+	return outputs, nil
+}
+
+// drvOutputRegexp matches the output list at the start of a .drv file,
+// Derive([("out","/nix/store/...","",""),...
+var drvOutputRegexp = regexp.MustCompile(`\("([^"]+)","(/nix/store/[^"]+)"`)
+
+// derivationOutputs returns the output paths of a derivation by name.
+func derivationOutputs(drv string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(drv)
+	if err != nil {
+		return nil, err
+	}
+
+	// The outputs end at the first closing bracket of the file.
+	end := bytes.IndexByte(data, ']')
+	if !bytes.HasPrefix(data, []byte("Derive([")) || end == -1 {
+		return nil, fmt.Errorf("unable to parse derivation %s", drv)
+	}
+
+	outputs := make(map[string]string)
+	for _, match := range drvOutputRegexp.FindAllSubmatch(data[:end], -1) {
+		outputs[string(match[1])] = string(match[2])
+	}
+	if len(outputs) == 0 {
+		return nil, fmt.Errorf("%s has no input addressed outputs", drv)
+	}
+	return outputs, nil
+}
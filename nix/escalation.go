@@ -0,0 +1,86 @@
+package nix
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// escalationPrefix returns the command prefix running a command as root on
+// the TargetHost, or "" if the Escalation is none. The escalation never
+// prompts, a password prompt fails the command instead.
+func (cfg *NixosRebuildConfig) escalationPrefix() string {
+	var prefix string
+	switch cfg.Escalation {
+	case "sudo":
+		prefix = "sudo -n"
+	case "doas":
+		prefix = "doas -n"
+	default:
+		return ""
+	}
+	if cfg.EscalationFlags != "" {
+		prefix += " " + cfg.EscalationFlags
+	}
+	return prefix
+}
+
+// escalates reports whether commands that need root are escalated.
+func (cfg *NixosRebuildConfig) escalates() bool {
+	return cfg.escalationPrefix() != ""
+}
+
+// remoteSudo reports whether nixos-rebuild can escalate on the TargetHost
+// itself with --use-remote-sudo, which runs plain sudo.
+func (cfg *NixosRebuildConfig) remoteSudo() bool {
+	return cfg.Escalation == "sudo" && cfg.EscalationFlags == ""
+}
+
+// rootCommand returns command running as root on the TargetHost with the
+// Escalation. Only commands that need root use it, reads such as
+// readlink /run/current-system run as the TargetUser.
+func (cfg *NixosRebuildConfig) rootCommand(command string) string {
+	prefix := cfg.escalationPrefix()
+	if prefix == "" {
+		return command
+	}
+	// The escalation resets the environment.
+	if cfg.RemoteTempDir != "" {
+		prefix += " env TMPDIR=" + shellQuote(cfg.RemoteTempDir)
+	}
+	return prefix + " sh -c " + shellQuote(command)
+}
+
+// rootSSHCommand is sshCommand running command as root.
+func (cfg *NixosRebuildConfig) rootSSHCommand(command string) *exec.Cmd {
+	return cfg.sshCommand(cfg.rootCommand(command))
+}
+
+// agentRootSSHCommand is agentSSHCommand running command as root.
+func (cfg *NixosRebuildConfig) agentRootSSHCommand(command string) *exec.Cmd {
+	return cfg.agentSSHCommand(cfg.rootCommand(command))
+}
+
+// escalationPasswordErrors are the lower cased messages of sudo and doas
+// refusing to run a command because it needs a password.
+var escalationPasswordErrors = []string{
+	"sudo: a password is required",
+	"sudo: a terminal is required",
+	"doas: authentication required",
+	"doas: authorization required",
+}
+
+// escalationErr explains the failure of a command that the Escalation asked
+// for a password.
+func (cfg *NixosRebuildConfig) escalationErr(err error) error {
+	if err == nil || !cfg.escalates() {
+		return err
+	}
+	msg := strings.ToLower(err.Error())
+	for _, fragment := range escalationPasswordErrors {
+		if strings.Contains(msg, fragment) {
+			return fmt.Errorf("%s on %s asked %s for a password, the escalation must not need one: %s", cfg.Escalation, cfg.TargetHost, cfg.TargetUser, err)
+		}
+	}
+	return err
+}
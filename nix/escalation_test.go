@@ -0,0 +1,51 @@
+package nix
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRootCommand(t *testing.T) {
+	const command = "nix-collect-garbage -d"
+	for _, tc := range []struct {
+		cfg        NixosRebuildConfig
+		expected   string
+		remoteSudo bool
+	}{
+		{NixosRebuildConfig{}, "nix-collect-garbage -d", false},
+		{NixosRebuildConfig{Escalation: "none"}, "nix-collect-garbage -d", false},
+		{NixosRebuildConfig{Escalation: "sudo"}, "sudo -n sh -c 'nix-collect-garbage -d'", true},
+		{NixosRebuildConfig{Escalation: "doas"}, "doas -n sh -c 'nix-collect-garbage -d'", false},
+		// nixos-rebuild only runs plain sudo.
+		{NixosRebuildConfig{Escalation: "sudo", EscalationFlags: "-u root"}, "sudo -n -u root sh -c 'nix-collect-garbage -d'", false},
+		{NixosRebuildConfig{Escalation: "doas", EscalationFlags: "-u root"}, "doas -n -u root sh -c 'nix-collect-garbage -d'", false},
+		// The escalation resets the environment.
+		{NixosRebuildConfig{Escalation: "sudo", RemoteTempDir: "/var/tmp/deploy"}, "sudo -n env TMPDIR='/var/tmp/deploy' sh -c 'nix-collect-garbage -d'", true},
+	} {
+		if got := tc.cfg.rootCommand(command); got != tc.expected {
+			t.Errorf("%+v:\n got %s\nwant %s", tc.cfg, got, tc.expected)
+		}
+		if got := tc.cfg.remoteSudo(); got != tc.remoteSudo {
+			t.Errorf("%+v: remoteSudo() = %v, expected %v", tc.cfg, got, tc.remoteSudo)
+		}
+	}
+}
+
+func TestEscalationErr(t *testing.T) {
+	passwordErr := errors.New("exit status 1: sudo: a password is required")
+	cfg := &NixosRebuildConfig{TargetHost: "example.com", TargetUser: "deploy", Escalation: "sudo"}
+	err := cfg.escalationErr(passwordErr)
+	if err == nil || !strings.HasPrefix(err.Error(), "sudo on example.com asked deploy for a password") {
+		t.Errorf("got %v, expected the password prompt explained", err)
+	}
+
+	other := errors.New("exit status 1: error: getting status of '/nix/store/x': No such file or directory")
+	if err := cfg.escalationErr(other); err != other {
+		t.Errorf("an unrelated failure became %v", err)
+	}
+	// Without an escalation the message is the command's own.
+	if err := (&NixosRebuildConfig{}).escalationErr(passwordErr); err != passwordErr {
+		t.Errorf("got %v without an escalation", err)
+	}
+}
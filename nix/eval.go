@@ -0,0 +1,54 @@
+package nix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// EvalJSON evaluates cfg with nix eval and returns the value as JSON.
+func EvalJSON(cfg *DerivationConfig) (string, error) {
+	features := append([]string{"nix-command"}, cfg.ExperimentalFeatures...)
+	if cfg.Flake != "" {
+		features = append(features, "flakes")
+	}
+
+	args := append([]string{"eval"}, experimentalFeatureFlags(features)...)
+	args = append(args, "--json")
+	switch {
+	case cfg.Flake != "":
+		args = append(args, cfg.Flake)
+	case cfg.Expression != "":
+		args = append(args, "--expr", cfg.Expression)
+	default:
+		args = append(args, "--file", cfg.File)
+		if cfg.Attribute != "" {
+			args = append(args, cfg.Attribute)
+		}
+	}
+	for _, name := range sortedKeys(cfg.ArgsStr) {
+		args = append(args, "--argstr", name, cfg.ArgsStr[name])
+	}
+	if cfg.Impure {
+		args = append(args, "--impure")
+	}
+
+	cmd := command("nix", append(args, cfg.flags()...)...)
+	cmd.Env = cfg.env()
+	output := bytes.NewBuffer(nil)
+	err := runCommandWithLogging(cmd, output)
+	if err != nil {
+		err = formatChildErr(err)
+		if strings.Contains(err.Error(), "cannot convert") {
+			return "", fmt.Errorf("the value can't be represented as JSON, functions and derivations that don't build can't be returned: %s", err)
+		}
+		return "", fmt.Errorf("evaluation failed: %s", err)
+	}
+
+	value := strings.TrimSpace(output.String())
+	if !json.Valid([]byte(value)) {
+		return "", fmt.Errorf("nix eval returned invalid JSON: %s", value)
+	}
+	return value, nil
+}
@@ -0,0 +1,43 @@
+package nix
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeCommands puts scripts named after the keys of scripts first in the
+// PATH, for the nix commands and the commands run on a Local target.
+func fakeCommands(t *testing.T, scripts map[string]string) string {
+	dir, err := ioutil.TempDir("", "fake-nix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for name, script := range scripts {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	t.Cleanup(func() { os.Setenv("PATH", path) })
+	SetBinaries(Binaries{})
+	return dir
+}
+
+// fakeClosure returns n store paths, with n large enough their total length
+// is over the limit for a single argument.
+func fakeClosure(n int) []string {
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("/nix/store/%032d-%s", i, strings.Repeat("p", 40))
+	}
+	return paths
+}
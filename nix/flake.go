@@ -0,0 +1,68 @@
+package nix
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// SplitFlakeRef splits a flake#attr reference into the flake and attribute.
+func SplitFlakeRef(ref string) (string, string) {
+	idx := strings.LastIndex(ref, "#")
+	if idx == -1 {
+		return ref, ""
+	}
+	return ref[:idx], ref[idx+1:]
+}
+
+// localFlakeDir returns the directory of a local flake reference, or "" if
+// the flake is remote.
+func localFlakeDir(flake string) string {
+	flake = strings.TrimPrefix(flake, "path:")
+	if strings.HasPrefix(flake, "/") {
+		return flake
+	}
+	return ""
+}
+
+// FlakeLockHash returns a hash identifying the locked inputs of cfg.Flake.
+// Local flakes hash their flake.lock, remote flakes use the locked narHash
+// reported by nix flake metadata.
+func FlakeLockHash(cfg *NixosRebuildConfig) (string, error) {
+	flake, _ := SplitFlakeRef(cfg.Flake)
+
+	if dir := localFlakeDir(flake); dir != "" {
+		lock, err := ioutil.ReadFile(filepath.Join(dir, "flake.lock"))
+		if err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256(lock)
+		return "sha256:" + hex.EncodeToString(sum[:]), nil
+	}
+
+	features := append([]string{"nix-command", "flakes"}, cfg.ExperimentalFeatures...)
+	args := append([]string{"flake", "metadata"}, experimentalFeatureFlags(features)...)
+	args = append(args, "--json", flake)
+	cmd := command("nix", args...)
+	output := bytes.NewBuffer(nil)
+	err := runCommandWithLogging(cmd, output)
+	if err != nil {
+		return "", formatChildErr(err)
+	}
+
+	var metadata struct {
+		Locked struct {
+			NarHash string `json:"narHash"`
+		} `json:"locked"`
+	}
+	err = json.Unmarshal(output.Bytes(), &metadata)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse flake metadata: %s", err)
+	}
+	return metadata.Locked.NarHash, nil
+}
@@ -0,0 +1,33 @@
+package nix
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestFlakeLockHashRemote(t *testing.T) {
+	dir := fakeCommands(t, map[string]string{
+		"nix": `echo "$@" > "$(dirname "$0")/args"
+echo '{"locked": {"narHash": "sha256-abc"}}'
+`,
+	})
+	cfg := &NixosRebuildConfig{Flake: "github:example/deploy#host", ExperimentalFeatures: []string{"ca-derivations"}}
+	hash, err := FlakeLockHash(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != "sha256-abc" {
+		t.Errorf("got hash %q, expected sha256-abc", hash)
+	}
+
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flakes may not be enabled in the nix configuration.
+	expected := "flake metadata --extra-experimental-features nix-command flakes ca-derivations --json github:example/deploy\n"
+	if string(args) != expected {
+		t.Errorf("nix ran with %q, expected %q", args, expected)
+	}
+}
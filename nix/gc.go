@@ -0,0 +1,193 @@
+package nix
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// GCOptions are how CollectGarbage collects garbage. The zero value deletes
+// every old generation of every profile, like nix-collect-garbage -d.
+type GCOptions struct {
+	// KeepGenerations, if positive, keeps this many of the newest system
+	// generations and deletes the rest, other profiles are left alone.
+	KeepGenerations int
+	// DeleteOlderThan, if set, deletes the generations older than it, in
+	// the form nix-collect-garbage --delete-older-than takes, such as 14d.
+	DeleteOlderThan string
+	// MaxFreed, if positive, stops the collection once this many bytes
+	// are freed.
+	MaxFreed int64
+	// KeepProfiles, unless KeepGenerations or DeleteOlderThan are set,
+	// deletes no generations and only collects paths nothing refers to.
+	KeepProfiles bool
+}
+
+// gcScript returns the remote script collecting garbage as the GC says.
+func (cfg *NixosRebuildConfig) gcScript() string {
+	return cfg.gcCommand(cfg.GC)
+}
+
+// gcCommand returns the script collecting garbage as opts say.
+func (cfg *NixosRebuildConfig) gcCommand(opts GCOptions) string {
+	gc := "nix-collect-garbage"
+	switch {
+	case opts.KeepGenerations > 0:
+		gc = fmt.Sprintf("nix-env -p %s --delete-generations +%d && %s", systemProfile, opts.KeepGenerations, gc)
+	case opts.DeleteOlderThan != "":
+		gc += " --delete-older-than " + shellQuote(opts.DeleteOlderThan)
+	case opts.KeepProfiles:
+	default:
+		gc += " -d"
+	}
+	if opts.MaxFreed > 0 {
+		gc += fmt.Sprintf(" --max-freed %d", opts.MaxFreed)
+	}
+	if flags := cfg.optionFlags(); len(flags) != 0 {
+		gc += " " + remoteArgs(flags)
+	}
+	return gc
+}
+
+// freedRegexp matches the summary nix-collect-garbage prints, such as
+// "12 store paths deleted, 345.67 MiB freed".
+var freedRegexp = regexp.MustCompile(`([0-9]+(?:\.[0-9]+)?) (bytes|KiB|MiB|GiB|TiB) freed`)
+
+// freedUnits are the sizes of the units in freedRegexp.
+var freedUnits = map[string]float64{
+	"bytes": 1,
+	"KiB":   1 << 10,
+	"MiB":   1 << 20,
+	"GiB":   1 << 30,
+	"TiB":   1 << 40,
+}
+
+// parseFreed returns the bytes the output of nix-collect-garbage says were
+// freed, summing the summaries of several collections, or 0 if it has none.
+func parseFreed(output string) int64 {
+	var freed float64
+	for _, match := range freedRegexp.FindAllStringSubmatch(output, -1) {
+		n, err := strconv.ParseFloat(match[1], 64)
+		if err == nil {
+			freed += n * freedUnits[match[2]]
+		}
+	}
+	return int64(freed)
+}
+
+// CollectGarbage collects garbage on the TargetHost, as the GC says, and
+// returns how many bytes were freed.
+func CollectGarbage(cfg *NixosRebuildConfig) (int64, error) {
+	var freed int64
+	err := cfg.retrySSH("garbage collection", func() error {
+		// The summary is printed on stderr.
+		cmd := cfg.rootSSHCommand(cfg.gcScript() + " 2>&1")
+		output := bytes.NewBuffer(nil)
+		err := cfg.runRemote("garbage collection", cmd, output)
+		if err != nil {
+			if out := strings.TrimSpace(output.String()); out != "" && err != ErrCancelled && err != ErrTimeout {
+				return fmt.Errorf("%s\n%s", formatChildErr(err), out)
+			}
+			return formatChildErr(err)
+		}
+		freed = parseFreed(output.String())
+		return nil
+	})
+	return freed, err
+}
+
+// CollectBuildHostGarbage collects garbage on the BuildHost as opts say,
+// here when it is localhost, and returns how many bytes were freed. The
+// store path keep, if it exists there, is held by a temporary gc root while
+// the collection runs.
+func CollectBuildHostGarbage(cfg *NixosRebuildConfig, opts GCOptions, keep string) (int64, error) {
+	script := "d=$(mktemp -d) || exit 1; trap 'rm -rf \"$d\"' EXIT; "
+	if keep != "" {
+		script += fmt.Sprintf("if [ -e %s ]; then nix-store --add-root \"$d/keep\" --indirect -r %s > /dev/null || exit 1; fi; ", shellQuote(keep), shellQuote(keep))
+	}
+	// The summary is printed on stderr.
+	script += cfg.gcCommand(opts) + " 2>&1"
+
+	var cmd *exec.Cmd
+	if cfg.BuildHost == "" || cfg.BuildHost == "localhost" {
+		cmd = exec.Command("sh", "-c", script)
+	} else {
+		cmd = exec.Command("sh", "-c", fmt.Sprintf("exec ssh %s %s -- %s", cfg.SSHOpts, shellQuote(cfg.BuildHost), shellQuote(script)))
+	}
+	cmd.Env = os.Environ()
+
+	output := bytes.NewBuffer(nil)
+	err := cfg.runRemote("garbage collection on the build host", cmd, output)
+	if err != nil {
+		if out := strings.TrimSpace(output.String()); out != "" && err != ErrCancelled && err != ErrTimeout {
+			return 0, fmt.Errorf("%s\n%s", formatChildErr(err), out)
+		}
+		return 0, formatChildErr(err)
+	}
+	return parseFreed(output.String()), nil
+}
+
+// OptimiseStore hard links the identical files of the store on the
+// TargetHost with nix-store --optimise, and returns how many bytes it says
+// were saved.
+func OptimiseStore(cfg *NixosRebuildConfig) (int64, error) {
+	output := bytes.NewBuffer(nil)
+	// The savings, like "12.34 MiB freed by hard-linking 56 files", are
+	// printed on stderr.
+	err := cfg.runRemote("optimising the store", cfg.rootSSHCommand("nix-store --optimise 2>&1"), output)
+	if err != nil {
+		return 0, formatChildErr(err)
+	}
+	return parseFreed(output.String()), nil
+}
+
+// storeDF returns the fields of the df -P -k line of the filesystem of the
+// nix store on the TargetHost: the filesystem, its size, used and available
+// kilobytes, capacity and mount point.
+func storeDF(cfg *NixosRebuildConfig) ([]string, error) {
+	output := bytes.NewBuffer(nil)
+	err := cfg.runRemote("measuring the store", cfg.sshCommand("df -P -k /nix/store"), output)
+	if err != nil {
+		return nil, formatChildErr(err)
+	}
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) == 2 {
+		fields := strings.Fields(lines[1])
+		if len(fields) == 6 {
+			return fields, nil
+		}
+	}
+	return nil, fmt.Errorf("unable to parse the df output of %s: %q", cfg.TargetHost, output.String())
+}
+
+// StoreUsedPercent returns how full the filesystem of the nix store on the
+// TargetHost is, in percent, from df.
+func StoreUsedPercent(cfg *NixosRebuildConfig) (int, error) {
+	fields, err := storeDF(cfg)
+	if err != nil {
+		return 0, err
+	}
+	used, err := strconv.Atoi(strings.TrimSuffix(fields[4], "%"))
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse the df capacity of %s: %q", cfg.TargetHost, fields[4])
+	}
+	return used, nil
+}
+
+// storeFree returns the bytes available on the filesystem of the nix store
+// on the TargetHost, and where it is mounted, from df.
+func storeFree(cfg *NixosRebuildConfig) (int64, string, error) {
+	fields, err := storeDF(cfg)
+	if err != nil {
+		return 0, "", err
+	}
+	available, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("unable to parse the df available space of %s: %q", cfg.TargetHost, fields[3])
+	}
+	return available << 10, fields[5], nil
+}
@@ -0,0 +1,75 @@
+package nix
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// AddGCRoot registers root as an indirect gc root for storePath in the local
+// store, replacing any previous root at the same location.
+func AddGCRoot(root string, storePath string) error {
+	err := os.MkdirAll(filepath.Dir(root), 0755)
+	if err != nil {
+		return err
+	}
+
+	cmd := command("nix-store", "--add-root", root, "--indirect", "--realise", storePath)
+	err = runCommandWithLogging(cmd, ioutil.Discard)
+	if err != nil {
+		return fmt.Errorf("unable to add gc root %s: %s", root, formatChildErr(err))
+	}
+	return nil
+}
+
+// RemoveGCRoot removes a root added by AddGCRoot, nix-collect-garbage cleans
+// up the dangling registration.
+func RemoveGCRoot(root string) error {
+	err := os.Remove(root)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// remoteGCRootDir holds the gc roots added on targets by AddRemoteGCRoot.
+const remoteGCRootDir = "/nix/var/nix/gcroots/terraform"
+
+// RemoteGCRoot returns the location of the named gc root on a target.
+func RemoteGCRoot(name string) string {
+	return remoteGCRootDir + "/" + name
+}
+
+// AddRemoteGCRoot points root on the TargetHost at storePath, protecting it
+// from garbage collection on the target.
+func AddRemoteGCRoot(cfg *NixosRebuildConfig, root string, storePath string) error {
+	script := fmt.Sprintf("mkdir -p %s && ln -sfn %s %s", shellQuote(filepath.Dir(root)), shellQuote(storePath), shellQuote(root))
+	err := cfg.runRemote("adding the gc root", cfg.rootSSHCommand(script), ioutil.Discard)
+	if err != nil {
+		return fmt.Errorf("unable to add gc root %s on %s: %s", root, cfg.TargetHost, formatChildErr(err))
+	}
+	return nil
+}
+
+// RemoveRemoteGCRoot removes a root added by AddRemoteGCRoot.
+func RemoveRemoteGCRoot(cfg *NixosRebuildConfig, root string) error {
+	err := cfg.runRemote("removing the gc root", cfg.rootSSHCommand("rm -f "+shellQuote(root)), ioutil.Discard)
+	if err != nil {
+		return fmt.Errorf("unable to remove gc root %s on %s: %s", root, cfg.TargetHost, formatChildErr(err))
+	}
+	return nil
+}
+
+// RemoteGCRootTarget returns the store path root points at on the TargetHost,
+// or "" if the root does not exist.
+func RemoteGCRootTarget(cfg *NixosRebuildConfig, root string) (string, error) {
+	output := bytes.NewBuffer(nil)
+	err := cfg.runRemote("reading the gc root", cfg.sshCommand(fmt.Sprintf("if test -L %s; then readlink %s; fi", shellQuote(root), shellQuote(root))), output)
+	if err != nil {
+		return "", formatChildErr(err)
+	}
+	return strings.TrimSpace(output.String()), nil
+}
@@ -0,0 +1,587 @@
+package nix
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// goSSHMain is the ssh of the go-ssh transport, it connects as ssh would
+// with the ssh arguments args and returns the exit status. It understands
+// the options this provider and nix pass to ssh, others are ignored.
+func goSSHMain(args []string) int {
+	opts, err := parseGoSSHArgs(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ssh: %s\n", err)
+		return 255
+	}
+
+	if opts.printConfig {
+		opts.print(os.Stdout)
+		return 0
+	}
+	// There are no control masters to talk to.
+	if opts.control != "" {
+		return 0
+	}
+
+	status, err := opts.run()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ssh: %s\n", err)
+		return 255
+	}
+	return status
+}
+
+// goSSHFlagsWithArgs are the ssh flags that take an argument.
+const goSSHFlagsWithArgs = "BbcDEeFIiJLlmOopQRSWw"
+
+type goSSHOptions struct {
+	user                  string
+	host                  string
+	port                  int
+	identities            []string
+	identitiesOnly        bool
+	userKnownHosts        []string
+	globalKnownHosts      []string
+	strictHostKeyChecking string
+	hostKeyAlias          string
+	proxyJump             string
+	proxyCommand          string
+	connectTimeout        time.Duration
+	forwardAgent          bool
+	localCommand          string
+	noCommand             bool
+	printConfig           bool
+	control               string
+	command               []string
+
+	// seen holds the options already set, ssh uses the first value given.
+	seen  map[string]bool
+	agent agent.ExtendedAgent
+}
+
+// parseGoSSHArgs parses the arguments of ssh, options may also follow the
+// destination, as nix passes them.
+func parseGoSSHArgs(args []string) (*goSSHOptions, error) {
+	o := &goSSHOptions{
+		port:                  22,
+		userKnownHosts:        []string{"~/.ssh/known_hosts"},
+		globalKnownHosts:      []string{"/etc/ssh/ssh_known_hosts"},
+		strictHostKeyChecking: "ask",
+		seen:                  make(map[string]bool),
+	}
+
+	destination := ""
+	configFile := ""
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			rest := args[i+1:]
+			if destination == "" && len(rest) != 0 {
+				destination = rest[0]
+				rest = rest[1:]
+			}
+			o.command = rest
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			if destination == "" {
+				destination = arg
+				continue
+			}
+			o.command = args[i:]
+			break
+		}
+
+		for j := 1; j < len(arg); j++ {
+			flag := arg[j]
+			if !strings.ContainsRune(goSSHFlagsWithArgs, rune(flag)) {
+				switch flag {
+				case 'A':
+					o.forwardAgent = true
+				case 'G':
+					o.printConfig = true
+				case 'N':
+					o.noCommand = true
+				}
+				continue
+			}
+
+			value := arg[j+1:]
+			if value == "" {
+				i++
+				if i == len(args) {
+					return nil, fmt.Errorf("option -%c needs an argument", flag)
+				}
+				value = args[i]
+			}
+
+			var err error
+			switch flag {
+			case 'o':
+				err = o.setOption(splitSSHOption(value))
+			case 'p':
+				err = o.setOption("port", value)
+			case 'l':
+				err = o.setOption("user", value)
+			case 'i':
+				err = o.setOption("identityfile", value)
+			case 'J':
+				err = o.setOption("proxyjump", value)
+			case 'F':
+				configFile = value
+			case 'O':
+				o.control = value
+			}
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	if destination == "" {
+		return nil, errors.New("no destination given")
+	}
+	if i := strings.LastIndex(destination, "@"); i >= 0 {
+		_ = o.setOption("user", destination[:i])
+		destination = destination[i+1:]
+	}
+	o.host = destination
+
+	// The config file only gives the options not on the command line.
+	if configFile != "" {
+		err := o.readConfig(configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if o.user == "" {
+		o.user = localUser()
+	}
+	return o, nil
+}
+
+// splitSSHOption splits an -o option into its name and value, they are
+// separated by = or whitespace.
+func splitSSHOption(option string) (string, string) {
+	i := strings.IndexAny(option, "= \t")
+	if i < 0 {
+		return option, ""
+	}
+	return option[:i], strings.TrimLeft(option[i:], "= \t")
+}
+
+// readConfig reads the options of an ssh config file. Host and Match blocks
+// are not supported, and neither are includes, which are skipped with a
+// warning.
+func (o *goSSHOptions) readConfig(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value := splitSSHOption(line)
+		switch strings.ToLower(name) {
+		case "include":
+			fmt.Fprintf(os.Stderr, "ssh: %s: skipping Include %s, the go-ssh transport only reads the options of the given config file\n", path, value)
+			continue
+		case "host", "match":
+			return fmt.Errorf("%s: %s blocks are not supported by the go-ssh transport", path, name)
+		}
+		err = o.setOption(name, value)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	return nil
+}
+
+// setOption sets an ssh option unless it was already set.
+func (o *goSSHOptions) setOption(name, value string) error {
+	name = strings.ToLower(name)
+	if name == "identityfile" {
+		o.identities = append(o.identities, value)
+		return nil
+	}
+
+	key := name
+	// Whichever of ProxyJump and ProxyCommand comes first is used.
+	if name == "proxyjump" || name == "proxycommand" {
+		key = "proxy"
+	}
+	if o.seen[key] {
+		return nil
+	}
+	o.seen[key] = true
+
+	switch name {
+	case "port":
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("bad port %q", value)
+		}
+		o.port = port
+	case "user":
+		o.user = value
+	case "identitiesonly":
+		o.identitiesOnly = value == "yes"
+	case "userknownhostsfile":
+		o.userKnownHosts = strings.Fields(value)
+	case "globalknownhostsfile":
+		o.globalKnownHosts = strings.Fields(value)
+	case "stricthostkeychecking":
+		o.strictHostKeyChecking = strings.ToLower(value)
+	case "hostkeyalias":
+		o.hostKeyAlias = value
+	case "proxyjump":
+		if value != "none" {
+			o.proxyJump = value
+		}
+	case "proxycommand":
+		if value != "none" {
+			o.proxyCommand = value
+		}
+	case "connecttimeout":
+		seconds, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("bad ConnectTimeout %q", value)
+		}
+		o.connectTimeout = time.Duration(seconds) * time.Second
+	case "forwardagent":
+		o.forwardAgent = value == "yes"
+	case "localcommand":
+		o.localCommand = value
+	case "knownhostscommand":
+		return errors.New("KnownHostsCommand is not supported by the go-ssh transport")
+	}
+	return nil
+}
+
+// print writes the options ssh -G prints that the provider reads.
+func (o *goSSHOptions) print(w io.Writer) {
+	fmt.Fprintf(w, "user %s\nhostname %s\nport %d\n", o.user, o.host, o.port)
+	fmt.Fprintf(w, "userknownhostsfile %s\n", strings.Join(o.userKnownHosts, " "))
+	if o.hostKeyAlias != "" {
+		fmt.Fprintf(w, "hostkeyalias %s\n", o.hostKeyAlias)
+	}
+	if o.proxyJump != "" {
+		fmt.Fprintf(w, "proxyjump %s\n", o.proxyJump)
+	}
+	if o.proxyCommand != "" {
+		fmt.Fprintf(w, "proxycommand %s\n", o.proxyCommand)
+	}
+}
+
+// run connects to the host and runs the command, returning its exit status.
+func (o *goSSHOptions) run() (int, error) {
+	client, err := o.dial()
+	if err != nil {
+		return 255, err
+	}
+	defer client.Close()
+
+	if o.noCommand {
+		if o.localCommand != "" {
+			cmd := exec.Command("sh", "-c", o.localCommand)
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			_ = cmd.Run()
+		}
+		_ = client.Wait()
+		return 0, nil
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return 255, err
+	}
+	defer session.Close()
+
+	if o.forwardAgent && o.agent != nil {
+		err = agent.ForwardToAgent(client, o.agent)
+		if err == nil {
+			err = agent.RequestAgentForwarding(session)
+		}
+		if err != nil {
+			return 255, fmt.Errorf("unable to forward the ssh agent: %s", err)
+		}
+	}
+
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+	if len(o.command) == 0 {
+		err = session.Shell()
+		if err == nil {
+			err = session.Wait()
+		}
+	} else {
+		err = session.Run(strings.Join(o.command, " "))
+	}
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		return exitErr.ExitStatus(), nil
+	}
+	if err != nil {
+		return 255, err
+	}
+	return 0, nil
+}
+
+// dial connects to the host, through the ProxyJump hosts if there are any.
+func (o *goSSHOptions) dial() (*ssh.Client, error) {
+	auth := o.authMethods()
+
+	var client *ssh.Client
+	if o.proxyJump != "" {
+		for _, jump := range strings.Split(o.proxyJump, ",") {
+			jumpUser := localUser()
+			if i := strings.LastIndex(jump, "@"); i >= 0 {
+				jumpUser = jump[:i]
+				jump = jump[i+1:]
+			}
+			jumpHost, jumpPort := jump, 22
+			if host, port, err := net.SplitHostPort(jump); err == nil {
+				jumpHost = host
+				jumpPort, err = strconv.Atoi(port)
+				if err != nil {
+					return nil, fmt.Errorf("bad ProxyJump port in %q", jump)
+				}
+			} else {
+				jumpHost = strings.TrimSuffix(strings.TrimPrefix(jump, "["), "]")
+			}
+
+			var err error
+			client, err = o.connect(client, jumpUser, jumpHost, jumpPort, "", auth)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return o.connect(client, o.user, o.host, o.port, o.hostKeyAlias, auth)
+}
+
+// connect opens an ssh connection to host, through via if it is not nil.
+func (o *goSSHOptions) connect(via *ssh.Client, user, host string, port int, hostKeyAlias string, auth []ssh.AuthMethod) (*ssh.Client, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+
+	var conn net.Conn
+	var err error
+	switch {
+	case via != nil:
+		conn, err = via.Dial("tcp", addr)
+	case o.proxyCommand != "":
+		conn, err = proxyCommandConn(o.proxyCommand, user, host, port)
+	default:
+		conn, err = net.DialTimeout("tcp", addr, o.connectTimeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %s: %s", addr, err)
+	}
+
+	config := &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: o.hostKeyCallback(host, port, hostKeyAlias),
+		Timeout:         o.connectTimeout,
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("unable to connect to %s: %s", addr, err)
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// authMethods returns the keys of the ssh agent and of the identity files,
+// then the ssh password if there is one. With IdentitiesOnly and identity
+// files given, the agent is not used.
+func (o *goSSHOptions) authMethods() []ssh.AuthMethod {
+	var signers []ssh.Signer
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err == nil {
+			o.agent = agent.NewClient(conn)
+			if !o.identitiesOnly || len(o.identities) == 0 {
+				agentSigners, err := o.agent.Signers()
+				if err == nil {
+					signers = append(signers, agentSigners...)
+				}
+			}
+		}
+	}
+
+	identities := o.identities
+	explicit := len(identities) != 0
+	if !explicit {
+		identities = []string{"~/.ssh/id_ed25519", "~/.ssh/id_ecdsa", "~/.ssh/id_rsa"}
+	}
+	for _, identity := range identities {
+		data, err := ioutil.ReadFile(expandHome(identity))
+		if err != nil {
+			if explicit {
+				fmt.Fprintf(os.Stderr, "ssh: unable to read identity file %s: %s\n", identity, err)
+			}
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ssh: unable to use identity file %s: %s\n", identity, err)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+
+	methods := []ssh.AuthMethod{ssh.PublicKeys(signers...)}
+	if password := os.Getenv(sshPasswordEnv); password != "" {
+		methods = append(methods, ssh.Password(password), ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			answers := make([]string, len(questions))
+			for i := range answers {
+				answers[i] = password
+			}
+			return answers, nil
+		}))
+	}
+	return methods
+}
+
+// hostKeyCallback checks host keys against the known_hosts files like ssh,
+// following StrictHostKeyChecking for unknown hosts. The key of host is
+// looked up under hostKeyAlias if it is set.
+func (o *goSSHOptions) hostKeyCallback(host string, port int, hostKeyAlias string) ssh.HostKeyCallback {
+	return func(_ string, remote net.Addr, key ssh.PublicKey) error {
+		if o.strictHostKeyChecking == "no" || o.strictHostKeyChecking == "off" {
+			return nil
+		}
+
+		name := host
+		if hostKeyAlias != "" {
+			name, port = hostKeyAlias, 22
+		}
+		address := net.JoinHostPort(name, strconv.Itoa(port))
+
+		var files []string
+		for _, file := range append(append([]string{}, o.userKnownHosts...), o.globalKnownHosts...) {
+			file = expandHome(file)
+			if _, err := os.Stat(file); err == nil {
+				files = append(files, file)
+			}
+		}
+
+		var err error = &knownhosts.KeyError{}
+		if len(files) != 0 {
+			check, cerr := knownhosts.New(files...)
+			if cerr != nil {
+				return cerr
+			}
+			err = check(address, remote, key)
+		}
+
+		keyErr, ok := err.(*knownhosts.KeyError)
+		if !ok {
+			return err
+		}
+		if len(keyErr.Want) != 0 {
+			return fmt.Errorf("WARNING: REMOTE HOST IDENTIFICATION HAS CHANGED! the %s host key of %s is %s, which is not the key in known_hosts", key.Type(), name, ssh.FingerprintSHA256(key))
+		}
+		if o.strictHostKeyChecking != "accept-new" || len(o.userKnownHosts) == 0 {
+			return fmt.Errorf("host key verification failed, the host key of %s is not known", name)
+		}
+
+		file := expandHome(o.userKnownHosts[0])
+		err = os.MkdirAll(filepath.Dir(file), 0700)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(address)}, key))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Warning: Permanently added '%s' (%s) to the list of known hosts.\n", knownhosts.Normalize(address), key.Type())
+		return nil
+	}
+}
+
+// commandConn is a connection over the stdin and stdout of a ProxyCommand.
+type commandConn struct {
+	cmd *exec.Cmd
+	io.Reader
+	io.WriteCloser
+}
+
+// proxyCommandConn starts the ProxyCommand command, with the %h, %p and %r
+// tokens replaced like ssh does.
+func proxyCommandConn(command, user, host string, port int) (net.Conn, error) {
+	command = strings.NewReplacer("%%", "%", "%h", host, "%p", strconv.Itoa(port), "%r", user).Replace(command)
+	cmd := exec.Command("sh", "-c", "exec "+command)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return &commandConn{cmd: cmd, Reader: stdout, WriteCloser: stdin}, nil
+}
+
+func (c *commandConn) Close() error {
+	_ = c.WriteCloser.Close()
+	_ = c.cmd.Process.Kill()
+	_ = c.cmd.Wait()
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *commandConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *commandConn) SetDeadline(t time.Time) error      { return nil }
+func (c *commandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *commandConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// localUser is the user ssh logs in as by default.
+func localUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// expandHome expands a leading ~/ in path to the home directory.
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[2:])
+		}
+	}
+	return path
+}
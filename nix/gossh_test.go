@@ -0,0 +1,166 @@
+package nix
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseGoSSHArgs(t *testing.T) {
+	for _, tc := range []struct {
+		args    []string
+		user    string
+		host    string
+		port    int
+		command []string
+	}{
+		{[]string{"root@example.com", "true"}, "root", "example.com", 22, []string{"true"}},
+		{[]string{"-p", "2222", "-l", "admin", "example.com"}, "admin", "example.com", 2222, nil},
+		{[]string{"-p2222", "-oUser=admin", "example.com", "nix-store", "--serve"}, "admin", "example.com", 2222, []string{"nix-store", "--serve"}},
+		// nix passes its options after the destination.
+		{[]string{"root@example.com", "-o", "Port 2222", "-x"}, "root", "example.com", 2222, nil},
+		// ssh uses the first value given.
+		{[]string{"-p", "2222", "-o", "Port=3333", "-l", "admin", "root@example.com"}, "admin", "example.com", 2222, nil},
+		{[]string{"-A", "--", "root@example.com", "-p", "2222"}, "root", "example.com", 22, []string{"-p", "2222"}},
+	} {
+		o, err := parseGoSSHArgs(tc.args)
+		if err != nil {
+			t.Errorf("parseGoSSHArgs(%q): %s", tc.args, err)
+			continue
+		}
+		if o.user != tc.user || o.host != tc.host || o.port != tc.port || !reflect.DeepEqual(o.command, tc.command) {
+			t.Errorf("parseGoSSHArgs(%q) = %s@%s:%d %q, expected %s@%s:%d %q", tc.args, o.user, o.host, o.port, o.command, tc.user, tc.host, tc.port, tc.command)
+		}
+	}
+
+	for _, args := range [][]string{
+		{},
+		{"-p"},
+		{"-p", "none", "example.com"},
+		{"-o", "KnownHostsCommand /bin/true", "example.com"},
+	} {
+		if _, err := parseGoSSHArgs(args); err == nil {
+			t.Errorf("parseGoSSHArgs(%q) succeeded", args)
+		}
+	}
+}
+
+func TestGoSSHReadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		config string
+		port   int
+		ok     bool
+	}{
+		{"Port 2222\nProxyCommand nc %h %p\n", 2222, true},
+		// The provider's configs include the usual ones, which go-ssh
+		// doesn't read.
+		{"# pinned\nPort=2222\nInclude ~/.ssh/config\n", 2222, true},
+		{"Host example.com\n  Port 2222\n", 0, false},
+		{"Match all\n  Port 2222\n", 0, false},
+	} {
+		config := filepath.Join(dir, "config")
+		err := ioutil.WriteFile(config, []byte(tc.config), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o, err := parseGoSSHArgs([]string{"-F", config, "-l", "root", "example.com"})
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("config %q was accepted", tc.config)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("config %q: %s", tc.config, err)
+			continue
+		}
+		if o.port != tc.port {
+			t.Errorf("config %q: got port %d, expected %d", tc.config, o.port, tc.port)
+		}
+	}
+}
+
+func TestGoSSHHostKeyCallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newKey := func() ssh.PublicKey {
+		public, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := ssh.NewPublicKey(public)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	key, otherKey := newKey(), newKey()
+	knownHosts := filepath.Join(dir, "known_hosts")
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+
+	check := func(mode string, key ssh.PublicKey) error {
+		o := &goSSHOptions{
+			userKnownHosts:        []string{knownHosts},
+			strictHostKeyChecking: mode,
+		}
+		return o.hostKeyCallback("example.com", 22, "")("example.com:22", remote, key)
+	}
+
+	if err := check("yes", key); err == nil {
+		t.Fatal("an unknown host was accepted with StrictHostKeyChecking yes")
+	}
+	if err := check("accept-new", key); err != nil {
+		t.Fatalf("accept-new refused an unknown host: %s", err)
+	}
+	data, err := ioutil.ReadFile(knownHosts)
+	if err != nil || !strings.HasPrefix(string(data), "example.com ssh-ed25519 ") {
+		t.Fatalf("accept-new did not add the key to known_hosts: %q %v", data, err)
+	}
+	for _, mode := range []string{"yes", "accept-new"} {
+		if err := check(mode, key); err != nil {
+			t.Errorf("%s refused the known key: %s", mode, err)
+		}
+		// A changed key is never accepted, not even with accept-new.
+		err := check(mode, otherKey)
+		if err == nil || !strings.Contains(err.Error(), "IDENTIFICATION HAS CHANGED") {
+			t.Errorf("%s accepted a changed key: %v", mode, err)
+		}
+	}
+	if err := check("no", otherKey); err != nil {
+		t.Errorf("StrictHostKeyChecking no refused a changed key: %s", err)
+	}
+}
+
+func TestSSHEnvTransport(t *testing.T) {
+	env := []string{"HOME=/root", "PATH=/bin"}
+	if got := sshEnv(SSHClient{}, env); !reflect.DeepEqual(got, env) {
+		t.Errorf("openssh changed the environment: %q", got)
+	}
+
+	got := sshEnv(SSHClient{Transport: "go-ssh"}, env)
+	expected := []string{"HOME=/root", "PATH=" + sshHelperDirPath + string(os.PathListSeparator) + "/bin"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("go-ssh environment is %q, expected %q", got, expected)
+	}
+	if target, err := os.Readlink(filepath.Join(sshHelperDirPath, "ssh")); err != nil || target == "" {
+		t.Errorf("no ssh helper in %s: %v", sshHelperDirPath, err)
+	}
+}
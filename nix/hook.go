@@ -0,0 +1,114 @@
+package nix
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Hook is a command run before or after a switch.
+type Hook struct {
+	// Name identifies the hook in errors, like pre_switch_hooks[1].
+	Name    string
+	Command string
+	// Sensitive leaves the Command out of errors.
+	Sensitive bool
+	// Remote runs the Command on the TargetHost, with the escalation of the
+	// switch, instead of here.
+	Remote bool
+}
+
+// runHooks runs hooks in order, here with env or on the TargetHost,
+// stopping at the first failure.
+func (cfg *NixosRebuildConfig) runHooks(hooks []Hook, env []string) error {
+	for _, hook := range hooks {
+		name := hook.Name
+		if !hook.Sensitive {
+			name = fmt.Sprintf("%s %q", hook.Name, strings.TrimSpace(hook.Command))
+		}
+		var err error
+		if hook.Remote {
+			err = cfg.runRemoteHook(name, hook.Command)
+		} else {
+			err = cfg.runLocalHook(name, hook.Command, env)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runLocalHook runs hookText here with env, as a script if it starts with a
+// #! line, otherwise with sh. Like commands on the TargetHost it is stopped
+// after the CommandTimeout, and a failure includes its output.
+func (cfg *NixosRebuildConfig) runLocalHook(name, hookText string, env []string) error {
+	if hookText == "" {
+		return nil
+	}
+
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	hookPath := filepath.Join(tmpDir, "hook")
+	err = ioutil.WriteFile(hookPath, []byte(hookText), 0700)
+	if err != nil {
+		return err
+	}
+
+	hook := exec.Command(hookPath)
+	if !strings.HasPrefix(hookText, "#!") {
+		hook = exec.Command("sh", hookPath)
+	}
+	hook.Env = env
+	output := bytes.NewBuffer(nil)
+	return hookErr(name, cfg.runRemote("the hook", hook, output), output)
+}
+
+// remoteHookScript runs the hook it reads from stdin with sh, from a file so
+// the hook itself reads nothing from stdin.
+const remoteHookScript = `hook=$(mktemp) && trap 'rm -f "$hook"' EXIT && cat > "$hook" && sh "$hook" < /dev/null`
+
+// runRemoteHook runs hookText with sh on the TargetHost, escalated and
+// forwarding the agent like the activation. The hook is sent on stdin, so it
+// is never logged or shown in errors as part of the command. It is stopped
+// after the CommandTimeout, and a failure includes its output.
+func (cfg *NixosRebuildConfig) runRemoteHook(name, hookText string) error {
+	if hookText == "" {
+		return nil
+	}
+	output := bytes.NewBuffer(nil)
+	// The login shell of the target user may not be sh.
+	cmd := cfg.agentRootSSHCommand("sh -c " + shellQuote(remoteHookScript))
+	cmd.Stdin = strings.NewReader(hookText)
+	return hookErr(name, cfg.runRemote("the hook", cmd, output), output)
+}
+
+// hookErr returns the error of the hook name that failed with err, with its
+// output.
+func hookErr(name string, err error, output *bytes.Buffer) error {
+	if err == nil || err == ErrCancelled || err == ErrTimeout {
+		return err
+	}
+	// Hooks failing without writing to stderr leave a trailing colon.
+	msg := strings.TrimSuffix(strings.TrimSpace(formatChildErr(err).Error()), ":")
+	if out := strings.TrimSpace(output.String()); out != "" {
+		return fmt.Errorf("%s failed: %s\n%s", name, msg, out)
+	}
+	return fmt.Errorf("%s failed: %s", name, msg)
+}
+
+// RunPreBuildHook runs the PreBuildHook before the system is evaluated or
+// built, with NIX_RESOLVED_CONFIG set to resolvedConfig, the config path or
+// flake reference the build uses.
+func RunPreBuildHook(cfg *NixosRebuildConfig, resolvedConfig string) error {
+	env := append(cfg.GetEnv(), fmt.Sprintf("NIX_RESOLVED_CONFIG=%s", resolvedConfig))
+	return cfg.runLocalHook("pre_build_hook", cfg.PreBuildHook, env)
+}
@@ -0,0 +1,80 @@
+package nix
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoteHookNotInCommandLine(t *testing.T) {
+	const secret = "s3cr3t-t0ken"
+	log := bytes.NewBuffer(nil)
+	cfg := &NixosRebuildConfig{Local: true, TargetHost: "example.com", Log: log}
+
+	// The hook reads nothing of itself from stdin.
+	err := cfg.runRemoteHook("pre_switch[0]", "echo "+secret+" > /dev/null\nif read line; then echo \"read $line\"; exit 1; fi\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(log.String(), secret) {
+		t.Fatalf("the hook was logged:\n%s", log)
+	}
+
+	cfg.CommandTimeout = 100 * time.Millisecond
+	err = cfg.runRemoteHook("pre_switch[0]", "sleep 5 # "+secret)
+	if err == nil || !strings.Contains(err.Error(), "exceeded the command timeout") {
+		t.Fatalf("expected the hook to time out, got %v", err)
+	}
+	if strings.Contains(err.Error(), secret) || strings.Contains(log.String(), secret) {
+		t.Fatalf("the hook was shown in %q or logged:\n%s", err, log)
+	}
+}
+
+func TestRemoteHookFailure(t *testing.T) {
+	cfg := &NixosRebuildConfig{Local: true, TargetHost: "example.com"}
+	err := cfg.runRemoteHook("post_switch[1]", "echo draining\nexit 3")
+	if err == nil {
+		t.Fatal("expected the hook to fail")
+	}
+	if msg := err.Error(); !strings.HasPrefix(msg, "post_switch[1] failed: exit status 3") || !strings.HasSuffix(msg, "\ndraining") {
+		t.Fatalf("unexpected error %q", msg)
+	}
+}
+
+func TestRunHooksStopsAtFailure(t *testing.T) {
+	dir := fakeCommands(t, nil)
+	ran := dir + "/ran"
+	hooks := []Hook{
+		{Name: "pre_switch_hooks[0]", Command: "echo 0 >> " + ran, Sensitive: true},
+		{Name: "pre_switch_hooks[1]", Command: "echo 1 >> " + ran + "\necho s3cr3t; exit 2", Sensitive: true},
+		{Name: "pre_switch_hooks[2]", Command: "echo 2 >> " + ran, Sensitive: true},
+	}
+
+	cfg := &NixosRebuildConfig{Local: true, TargetHost: "example.com"}
+	err := cfg.runHooks(hooks, nil)
+	if err == nil {
+		t.Fatal("expected the second hook to fail")
+	}
+	// The output is the hook's own, only the command is left out.
+	if msg := err.Error(); msg != "pre_switch_hooks[1] failed: exit status 2\ns3cr3t" {
+		t.Fatalf("unexpected error %q", msg)
+	}
+
+	out, err := ioutil.ReadFile(ran)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "0\n1\n" {
+		t.Fatalf("expected the hooks to run in order until the failure, ran %q", out)
+	}
+}
+
+func TestRunHooksNamesInsensitiveCommand(t *testing.T) {
+	cfg := &NixosRebuildConfig{Local: true, TargetHost: "example.com"}
+	err := cfg.runHooks([]Hook{{Name: "check", Command: "exit 1\n"}}, nil)
+	if err == nil || err.Error() != `check "exit 1" failed: exit status 1` {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+package nix
+
+import (
+	"net"
+	"strings"
+)
+
+// isIPv6 reports whether host is an IPv6 literal, with or without brackets
+// and a zone such as %eth0.
+func isIPv6(host string) bool {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if i := strings.Index(host, "%"); i >= 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
+
+// sshHost returns host as ssh expects it on its command line, where IPv6
+// literals are not bracketed.
+func sshHost(host string) string {
+	if isIPv6(host) {
+		return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	return host
+}
+
+// urlHost returns host for use in a store URL, where IPv6 literals are
+// bracketed and their zone is escaped.
+func urlHost(host string) string {
+	if !isIPv6(host) {
+		return host
+	}
+	return "[" + strings.Replace(sshHost(host), "%", "%25", 1) + "]"
+}
+
+// sshDestination returns the user@host ssh connects to for the TargetHost.
+func (cfg *NixosRebuildConfig) sshDestination() string {
+	return cfg.TargetUser + "@" + sshHost(cfg.TargetHost)
+}
@@ -0,0 +1,38 @@
+package nix
+
+import "testing"
+
+func TestHostFormats(t *testing.T) {
+	for _, tc := range []struct {
+		host        string
+		ipv6        bool
+		ssh         string
+		url         string
+		destination string
+	}{
+		{"example.com", false, "example.com", "example.com", "root@example.com"},
+		{"192.0.2.1", false, "192.0.2.1", "192.0.2.1", "root@192.0.2.1"},
+		{"2001:db8::10", true, "2001:db8::10", "[2001:db8::10]", "root@2001:db8::10"},
+		{"[2001:db8::10]", true, "2001:db8::10", "[2001:db8::10]", "root@2001:db8::10"},
+		{"fe80::1%eth0", true, "fe80::1%eth0", "[fe80::1%25eth0]", "root@fe80::1%eth0"},
+		{"[fe80::1%eth0]", true, "fe80::1%eth0", "[fe80::1%25eth0]", "root@fe80::1%eth0"},
+		{"::ffff:192.0.2.1", false, "::ffff:192.0.2.1", "::ffff:192.0.2.1", "root@::ffff:192.0.2.1"},
+	} {
+		if got := isIPv6(tc.host); got != tc.ipv6 {
+			t.Errorf("isIPv6(%q) = %v, expected %v", tc.host, got, tc.ipv6)
+		}
+		if got := sshHost(tc.host); got != tc.ssh {
+			t.Errorf("sshHost(%q) = %q, expected %q", tc.host, got, tc.ssh)
+		}
+		if got := urlHost(tc.host); got != tc.url {
+			t.Errorf("urlHost(%q) = %q, expected %q", tc.host, got, tc.url)
+		}
+		cfg := &NixosRebuildConfig{TargetUser: "root", TargetHost: tc.host}
+		if got := cfg.sshDestination(); got != tc.destination {
+			t.Errorf("sshDestination of %q = %q, expected %q", tc.host, got, tc.destination)
+		}
+		if got, expected := cfg.storeURI(), "ssh://root@"+tc.url; got != expected {
+			t.Errorf("storeURI of %q = %q, expected %q", tc.host, got, expected)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package nix
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// IsHostKeyChangedError reports whether err is ssh refusing to connect
+// because the host key differs from the one in known_hosts.
+func IsHostKeyChangedError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "REMOTE HOST IDENTIFICATION HAS CHANGED")
+}
+
+// ForgetHostKey removes the entries ssh checks the host key of host against
+// from the user known_hosts files, like ssh-keygen -R.
+func ForgetHostKey(user, host, sshOpts string, client SSHClient) error {
+	cmd := exec.Command("sh", "-c", fmt.Sprintf("exec ssh %s %s@%s -G", sshOpts, user, sshHost(host)))
+	cmd.Env = sshEnv(client, os.Environ())
+	out, err := cmd.Output()
+	if err != nil {
+		return err
+	}
+
+	name, alias, port := "", "", ""
+	var files []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "hostname":
+			name = fields[1]
+		case "hostkeyalias":
+			alias = fields[1]
+		case "port":
+			port = fields[1]
+		case "userknownhostsfile":
+			files = fields[1:]
+		}
+	}
+	if alias != "" {
+		name = alias
+	} else if port != "22" {
+		name = fmt.Sprintf("[%s]:%s", name, port)
+	}
+
+	for _, file := range files {
+		file = expandHome(file)
+		if _, err := os.Stat(file); err != nil {
+			continue
+		}
+		err = runCommandWithLogging(exec.Command("ssh-keygen", "-R", name, "-f", file), ioutil.Discard)
+		if err != nil {
+			return fmt.Errorf("unable to remove the host key of %s from %s: %s", name, file, formatChildErr(err))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package nix
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const lockPath = "/run/terraform-nix.lock"
+
+// RemoteLock is an advisory flock held on the TargetHost for the lifetime
+// of an ssh session. If the session dies, for example because terraform
+// was killed, the remote flock process exits and the lock is released, so
+// stale locks clear themselves.
+type RemoteLock struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stderr *bytes.Buffer
+}
+
+// LockError is returned by AcquireLock when another deployer held the lock
+// for the whole timeout.
+type LockError struct {
+	Host    string
+	Timeout time.Duration
+	// Holder is what the lock file says about the holder.
+	Holder string
+}
+
+func (e *LockError) Error() string {
+	return fmt.Sprintf("unable to acquire deployment lock on %s within %s: %s", e.Host, e.Timeout, e.Holder)
+}
+
+// AcquireLock takes the deployment lock on the TargetHost, waiting up to
+// timeout for other holders. The lock file records the current holder. The
+// wait stops once terraform is interrupted or the Context is done, the lock
+// is kept until Release after that.
+func AcquireLock(cfg *NixosRebuildConfig, timeout time.Duration) (*RemoteLock, error) {
+	hostname, _ := os.Hostname()
+	holder := fmt.Sprintf("%s pid %d", hostname, os.Getpid())
+
+	script := fmt.Sprintf(
+		"exec 9>>%[1]s; if ! flock -w %[2]d 9; then echo \"lock held by $(cat %[1]s)\" >&2; exit 1; fi; echo %[3]s > %[1]s; echo locked; cat >/dev/null",
+		lockPath, int(timeout.Seconds()), shellQuote(holder))
+
+	cmd := cfg.rootSSHCommand(script)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr := bytes.NewBuffer(nil)
+	cmd.Stderr = stderr
+
+	log.Printf("acquiring deployment lock %s on %s", lockPath, cfg.TargetHost)
+	ctx := cfg.context()
+	if err := stopErr(ctx); err != nil {
+		return nil, err
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	// Stop waiting for the lock when asked to, like runCancellable.
+	waited := make(chan struct{})
+	go func() {
+		select {
+		case <-waited:
+			return
+		case <-stopCtx.Done():
+		case <-ctx.Done():
+		}
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}()
+	line, _ := bufio.NewReader(stdout).ReadString('\n')
+	close(waited)
+
+	if strings.TrimSpace(line) != "locked" {
+		_ = stdin.Close()
+		_ = cmd.Wait()
+		if err := stopErr(ctx); err != nil {
+			return nil, err
+		}
+		return nil, &LockError{Host: cfg.TargetHost, Timeout: timeout, Holder: strings.TrimSpace(stderr.String())}
+	}
+
+	return &RemoteLock{cmd: cmd, stdin: stdin, stderr: stderr}, nil
+}
+
+// Release releases the deployment lock.
+func (l *RemoteLock) Release() error {
+	_ = l.stdin.Close()
+	err := l.cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("releasing deployment lock failed: %s %s", err, strings.TrimSpace(l.stderr.String()))
+	}
+	return nil
+}
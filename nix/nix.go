@@ -2,13 +2,20 @@ package nix
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"math/rand"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -24,8 +31,122 @@ func formatChildErr(err error) error {
 	return err
 }
 
+// failedBuilderRegexp matches the derivations nix reports as failed.
+var failedBuilderRegexp = regexp.MustCompile(`builder for '(/nix/store/[^']+\.drv)' failed`)
+
+// buildErr formats the error of a build command. With KeepGoing there may be
+// several failed derivations, they are listed after the output.
+func (cfg *NixosRebuildConfig) buildErr(err error) error {
+	err = formatChildErr(err)
+	if err == nil || !cfg.KeepGoing {
+		return err
+	}
+
+	var failed []string
+	seen := make(map[string]bool)
+	for _, match := range failedBuilderRegexp.FindAllStringSubmatch(err.Error(), -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			failed = append(failed, match[1])
+		}
+	}
+	if len(failed) == 0 {
+		return err
+	}
+	return fmt.Errorf("%s\n%d derivations failed to build:\n  %s", err, len(failed), strings.Join(failed, "\n  "))
+}
+
+// transientErrors are known stderr fragments of failures that go away
+// when retried, such as contention with another process using the store.
+var transientErrors = []string{
+	"text file busy",
+	"waiting for the big garbage collector lock",
+	"waiting for lock on",
+	"could not acquire lock",
+	"database is locked",
+}
+
+// IsLockFileError reports whether a build failed because flake.lock needed
+// changes that the lock file mode did not allow.
+func IsLockFileError(err error) bool {
+	return strings.Contains(err.Error(), "requires lock file changes")
+}
+
+// connectionErrors are known stderr fragments of ssh losing or failing to
+// make its connection, rather than of the remote command failing.
+var connectionErrors = []string{
+	"connection reset",
+	"connection timed out",
+	"connection refused",
+	"connection closed by",
+	"closed by remote host",
+	"broken pipe",
+	"no route to host",
+	"network is unreachable",
+	"kex_exchange_identification",
+	"client_loop: send disconnect",
+	"unable to connect to",
+}
+
+// isConnectionError reports whether err is a failure of the ssh connection.
+func isConnectionError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, fragment := range connectionErrors {
+		if strings.Contains(msg, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// retrySSH runs phase, running it again up to SSHRetries times while it
+// fails because the connection to the TargetHost failed. Phases must be
+// safe to run again after being interrupted.
+func (cfg *NixosRebuildConfig) retrySSH(phase string, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt > cfg.SSHRetries || !isConnectionError(err) {
+			return err
+		}
+		delay := time.Duration(attempt*attempt) * 5 * time.Second
+		log.Printf("[INFO] %s lost the connection to %s, retry %d of %d in %s: %s", phase, cfg.TargetHost, attempt, cfg.SSHRetries, delay, err)
+		err = SleepContext(cfg.context(), delay)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func isTransientError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, fragment := range transientErrors {
+		if strings.Contains(msg, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// experimentalFeatureFlags returns the flags enabling the given experimental
+// features, they are placed before all other flags of a nix command.
+func experimentalFeatureFlags(features []string) []string {
+	if len(features) == 0 {
+		return nil
+	}
+	return []string{"--extra-experimental-features", strings.Join(features, " ")}
+}
+
 // BuildExpression builds a nix expression, returning the store path.
-func BuildExpression(nixPath string, expressionPath string, outLink *string) (string, error) {
+func BuildExpression(nixPath string, expressionPath string, outLink *string, experimentalFeatures []string, maxJobs, cores int) (string, error) {
 
 	tempDir, err := ioutil.TempDir("", "")
 	if err != nil {
@@ -33,12 +154,20 @@ func BuildExpression(nixPath string, expressionPath string, outLink *string) (st
 	}
 	defer os.RemoveAll(tempDir)
 
+	release, err := acquireBuildSlot(context.Background(), expressionPath)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
 	var cmd *exec.Cmd
 
+	args := experimentalFeatureFlags(experimentalFeatures)
+	args = append(args, parallelismFlags(maxJobs, cores)...)
 	if outLink == nil {
-		cmd = exec.Command("nix-build", "--no-link", expressionPath)
+		cmd = command("nix-build", append(args, "--no-link", expressionPath)...)
 	} else {
-		cmd = exec.Command("nix-build", "-o", *outLink, expressionPath)
+		cmd = command("nix-build", append(args, "-o", *outLink, expressionPath)...)
 	}
 
 	cmd.Env = []string{fmt.Sprintf("NIX_PATH=%s", nixPath)}
@@ -58,40 +187,471 @@ func BuildExpression(nixPath string, expressionPath string, outLink *string) (st
 
 // NixosRebuildConfig represents a configuration for Nixos rebuild.
 type NixosRebuildConfig struct {
-	TargetHost     string
-	TargetUser     string
-	BuildHost      string
-	NixosConfigPath    string
-	NixPath        string
+	TargetHost      string
+	TargetUser      string
+	BuildHost       string
+	NixosConfigPath string
+	NixPath         string
+	// NixPathEntries are name=path entries searched before the NixPath,
+	// each passed as a -I flag so paths containing colons keep working.
+	NixPathEntries []string
 	SSHOpts        string
-	PreSwitchHook  string
-	PostSwitchHook string
+	// PreSwitchHooks and PostSwitchHooks are run here in order before and
+	// after the switch, stopping at the first failure.
+	PreSwitchHooks  []Hook
+	PostSwitchHooks []Hook
+	// PreBuildHook is run here by RunPreBuildHook before the system is
+	// evaluated or built.
+	PreBuildHook string
+	// ForwardAgent forwards the ssh agent to the TargetHost for the hooks and
+	// the activation, but not for copies or other commands.
+	ForwardAgent bool
+	// SwitchAction is the nixos-rebuild action used by SwitchSystem,
+	// one of switch, boot, test or dry-activate. Empty means switch.
+	SwitchAction string
+	// Specialisation is the name of a specialisation of the system that
+	// SwitchSystem activates instead of the top level system.
+	Specialisation string
+	// SwitchRetries is how many times SwitchSystem retries nixos-rebuild
+	// after a transient failure, such as nix store lock contention.
+	SwitchRetries int
+	// Flake is a flake#attr reference to a nixos configuration, when set
+	// it is built instead of NixosConfigPath and NIX_PATH is not used.
+	Flake string
+	// OverrideInputs maps flake input names to flake references that
+	// replace them when building Flake.
+	OverrideInputs map[string]string
+	// Impure allows flake evaluations to access the environment.
+	Impure bool
+	// ExtraNixOptions are passed as --option name value to nix commands.
+	ExtraNixOptions map[string]string
+	// BuildArgs are passed as --arg name expression when building.
+	BuildArgs map[string]string
+	// BuildArgsStr are passed as --argstr name value when building.
+	BuildArgsStr map[string]string
+	// SystemPath is a prebuilt system toplevel, when set nothing is built,
+	// the closure is copied to the TargetHost and activated.
+	SystemPath string
+	// ExperimentalFeatures are enabled for every local nix command.
+	ExperimentalFeatures []string
+	// UseNewCLI builds with nix build instead of nixos-rebuild build when
+	// building locally.
+	UseNewCLI bool
+	// LockFileMode controls updates to flake.lock, one of locked, update or
+	// no-write. Empty means locked.
+	LockFileMode string
+	// Builders are remote builder specs passed as --builders. A nil slice
+	// leaves the nix configuration alone, an empty one disables remote builders.
+	Builders []string
+	// BuildersUseSubstitutes lets remote builders substitute paths themselves.
+	BuildersUseSubstitutes bool
+	// MaxJobs and Cores are passed as --max-jobs and --cores, zero leaves
+	// the nix configuration alone.
+	MaxJobs int
+	Cores   int
+	// KeepGoing keeps building independent derivations after one fails.
+	KeepGoing bool
+	// Fallback builds paths that fail to substitute from source.
+	Fallback bool
+	// SigningKeyFile is a secret key file SwitchSystem signs the system with
+	// before copying it.
+	SigningKeyFile string
+	// PostBuildPush, if set, is a binary cache SwitchSystem pushes the system
+	// to before copying it to the TargetHost.
+	PostBuildPush *CachePush
+	// CopyCompression compresses closure copies, none, ssh for ssh
+	// compression, or zstd or xz to stream the closure compressed with them.
+	// Empty is none.
+	CopyCompression string
+	// CopyCompressionLevel is the zstd or xz level, zero is the default.
+	CopyCompressionLevel int
+	// CopyParallelism is the number of streams closures are copied with.
+	CopyParallelism int
+	// NoCheckSigs makes the TargetHost accept unsigned paths when copying.
+	NoCheckSigs bool
+	// CopyProtocol is ssh to copy closures with nix-copy-closure, or ssh-ng
+	// to copy them with nix copy. Empty is ssh.
+	CopyProtocol string
+	// UseSubstitutes lets the TargetHost download paths from its binary
+	// caches instead of receiving them in the closure copy.
+	UseSubstitutes bool
+	// Substituters and TrustedPublicKeys replace the binary caches the
+	// TargetHost substitutes from during the switch, if set.
+	Substituters      []string
+	TrustedPublicKeys []string
+	// Sandbox is passed as the sandbox option, true, false or relaxed. Empty
+	// leaves the nix configuration alone.
+	Sandbox string
+	// BuildTimeout kills builds and evaluations running longer than it,
+	// zero never does.
+	BuildTimeout time.Duration
+	// Log receives the output of the commands run for this config, if set.
+	Log io.Writer
+	// System is the nix system to build for, such as aarch64-linux.
+	System string
+	// ReportUnitChanges runs dry-activate before switching, recording the
+	// units that change in Report.
+	ReportUnitChanges bool
+	// Report, if set, records what SwitchSystem did.
+	Report *SwitchReport
+	// BeforeActivate, if set, is called once by SwitchSystem after the
+	// system is built and copied, right before it is activated. The system
+	// is left alone if it fails.
+	BeforeActivate func() error
+	// Transport is the ssh client commands connect to the TargetHost with,
+	// openssh or go-ssh. Empty is openssh.
+	Transport string
+	// SSHPassword, if set, is the password ssh logs in to the TargetHost
+	// with when asked for one.
+	SSHPassword string
+	// SSHPoll is how WaitForSSH polls the TargetHost while it reboots.
+	SSHPoll SSHPoll
+	// SSHRetries is how many times the copy, activation and garbage
+	// collection are run again after losing the connection to the TargetHost.
+	SSHRetries int
+	// Context, if set, stops the commands and waits for this config once it
+	// is done.
+	Context context.Context
+	// Escalation is how commands on the TargetHost that need root get it
+	// when the TargetUser isn't root, none, sudo or doas. Empty is none.
+	Escalation string
+	// EscalationFlags are more flags for sudo or doas, after -n. They are
+	// split by the remote shell.
+	EscalationFlags string
+	// Local runs the commands for the TargetHost on this machine instead of
+	// over ssh, nothing is copied. The TargetHost only names it in logs.
+	Local bool
+	// RemoteTempDir, if set, is the TMPDIR of the commands run on the
+	// TargetHost, created if it is missing.
+	RemoteTempDir string
+	// CommandTimeout stops each command run on the TargetHost that takes
+	// longer than it, zero never does. Copies, builds, nixos-rebuild and
+	// checks have timeouts of their own.
+	CommandTimeout time.Duration
+	// RemoteCommandTemplate, if set, runs the commands on the TargetHost
+	// instead of ssh, see CommandTemplateData for its placeholders.
+	RemoteCommandTemplate string
+	// CopyCommandTemplate, if set, runs the command receiving closures on
+	// the TargetHost instead of the RemoteCommandTemplate or ssh.
+	CopyCommandTemplate string
+	// GC is how CollectGarbage collects garbage on the TargetHost.
+	GC GCOptions
+	// GCOnLowSpace collects garbage on the TargetHost when a copy wouldn't
+	// fit in its free space, instead of failing straight away.
+	GCOnLowSpace bool
+}
+
+// SwitchReport records what happened while switching a target.
+type SwitchReport struct {
+	// CopySkipped is set when the target already had the whole closure of
+	// the new system.
+	CopySkipped bool
+	// Activated is set once the switch may have changed the system of the
+	// target, failures before it leave the target as it was.
+	Activated bool
+	// RequiredCopyBytes is the nar size of the paths copied to the target.
+	RequiredCopyBytes int64
+	// Units are the unit changes of the switch, if ReportUnitChanges is set.
+	Units *UnitChanges
+}
+
+// reportActivated records in the Report that the activation started.
+func (cfg *NixosRebuildConfig) reportActivated() {
+	if cfg.Report != nil {
+		cfg.Report.Activated = true
+	}
+}
+
+// optionFlags returns the --option flags for ExtraNixOptions.
+func (cfg *NixosRebuildConfig) optionFlags() []string {
+	var flags []string
+	for _, name := range sortedKeys(cfg.ExtraNixOptions) {
+		flags = append(flags, "--option", name, cfg.ExtraNixOptions[name])
+	}
+	return flags
+}
+
+// parallelismFlags returns the --max-jobs and --cores flags for the non zero
+// values.
+func parallelismFlags(maxJobs, cores int) []string {
+	var flags []string
+	if maxJobs > 0 {
+		flags = append(flags, "--max-jobs", strconv.Itoa(maxJobs))
+	}
+	if cores > 0 {
+		flags = append(flags, "--cores", strconv.Itoa(cores))
+	}
+	return flags
+}
+
+// remoteArgs quotes args for use in a remote shell command.
+func remoteArgs(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// rebuildFlags returns the flags shared by all nixos-rebuild invocations.
+func (cfg *NixosRebuildConfig) rebuildFlags() []string {
+	flags := experimentalFeatureFlags(cfg.ExperimentalFeatures)
+	flags = append(flags, "--build-host", cfg.BuildHost)
+	if cfg.Flake != "" {
+		flags = append(flags, "--flake", cfg.Flake)
+	}
+	return append(flags, cfg.evalFlags()...)
+}
+
+// evalFlags returns the evaluation and build flags understood by both
+// nixos-rebuild and nix build.
+func (cfg *NixosRebuildConfig) evalFlags() []string {
+	var flags []string
+	if cfg.Flake == "" {
+		for _, entry := range cfg.NixPathEntries {
+			flags = append(flags, "-I", entry)
+		}
+	}
+	flags = append(flags, cfg.optionFlags()...)
+	flags = append(flags, parallelismFlags(cfg.MaxJobs, cfg.Cores)...)
+	if cfg.Fallback {
+		flags = append(flags, "--fallback")
+	}
+	if cfg.KeepGoing {
+		flags = append(flags, "--keep-going")
+	}
+	if cfg.Sandbox != "" {
+		flags = append(flags, "--option", "sandbox", cfg.Sandbox)
+	}
+	if cfg.Builders != nil {
+		flags = append(flags, "--builders", strings.Join(cfg.Builders, ";"))
+	}
+	if cfg.BuildersUseSubstitutes {
+		flags = append(flags, "--option", "builders-use-substitutes", "true")
+	}
+	for _, name := range sortedKeys(cfg.BuildArgs) {
+		flags = append(flags, "--arg", name, cfg.BuildArgs[name])
+	}
+	for _, name := range sortedKeys(cfg.BuildArgsStr) {
+		flags = append(flags, "--argstr", name, cfg.BuildArgsStr[name])
+	}
+	// <nixpkgs/nixos> takes the system to build for as an argument, flakes
+	// set it in the configuration.
+	if _, ok := cfg.BuildArgsStr["system"]; cfg.System != "" && cfg.Flake == "" && !ok {
+		flags = append(flags, "--argstr", "system", cfg.System)
+	}
+	if cfg.Flake != "" {
+		for _, name := range sortedKeys(cfg.OverrideInputs) {
+			flags = append(flags, "--override-input", name, cfg.OverrideInputs[name])
+		}
+		switch cfg.LockFileMode {
+		case "update":
+			flags = append(flags, "--recreate-lock-file")
+		case "no-write":
+			flags = append(flags, "--no-write-lock-file")
+		default:
+			flags = append(flags, "--no-update-lock-file")
+		}
+		// Evaluations without a flake are always impure.
+		if cfg.Impure {
+			flags = append(flags, "--impure")
+		}
+	}
+	return flags
+}
+
+func (cfg *NixosRebuildConfig) switchAction() string {
+	if cfg.SwitchAction == "" {
+		return "switch"
+	}
+	return cfg.SwitchAction
+}
+
+// rebuildRunsTarget reports whether nixos-rebuild can run the commands on
+// the TargetHost itself. It only escalates with plain sudo, leaves their
+// TMPDIR alone and only connects with ssh.
+func (cfg *NixosRebuildConfig) rebuildRunsTarget() bool {
+	return (!cfg.escalates() || cfg.remoteSudo()) && cfg.RemoteTempDir == "" && !cfg.templated()
+}
+
+// tempDirCommand returns command run with its TMPDIR in the RemoteTempDir,
+// created first, if it is set.
+func (cfg *NixosRebuildConfig) tempDirCommand(command string) string {
+	if cfg.RemoteTempDir == "" {
+		return command
+	}
+	return fmt.Sprintf("mkdir -p %[1]s || exit 1; TMPDIR=%[1]s; export TMPDIR; %[2]s", shellQuote(cfg.RemoteTempDir), command)
+}
+
+// reportsUnitChanges reports whether the unit changes are found before
+// switching, only actions activating the system change units.
+func (cfg *NixosRebuildConfig) reportsUnitChanges() bool {
+	action := cfg.switchAction()
+	return cfg.ReportUnitChanges && (action == "switch" || action == "test")
+}
+
+// needsPrebuild reports whether SwitchSystem builds the system first, then
+// copies and activates it like a prebuilt system, instead of leaving it all
+// to nixos-rebuild, which copies the system as soon as it is built.
+func (cfg *NixosRebuildConfig) needsPrebuild() bool {
+	// nixos-rebuild can't be killed once it is activating the new system.
+	return cfg.BuildTimeout > 0 ||
+		// The system is signed before it is copied.
+		cfg.SigningKeyFile != "" ||
+		// nixos-rebuild always checks signatures.
+		cfg.NoCheckSigs ||
+		// The system is pushed to a cache before it is copied.
+		cfg.PostBuildPush != nil ||
+		// nixos-rebuild can't copy a compressed stream.
+		cfg.streamCompressed() ||
+		// nixos-rebuild only copies over ssh.
+		cfg.templated() ||
+		// nixos-rebuild copies with a single stream.
+		cfg.CopyParallelism > 1 ||
+		// The target substitutes from other caches before the copy.
+		cfg.substituteOnTarget() ||
+		// The unit changes are found between the copy and the activation.
+		cfg.reportsUnitChanges() ||
+		// The agent is only forwarded to the activation.
+		cfg.ForwardAgent ||
+		// The copy and the activation are retried separately.
+		cfg.SSHRetries > 0 ||
+		// nixos-rebuild can't run the target commands as configured.
+		!cfg.rebuildRunsTarget() ||
+		// nixos-rebuild activates the system as soon as it is copied.
+		cfg.BeforeActivate != nil
 }
 
 // GetEnv returns an OS env suitable for nixos-rebuild.
 func (cfg *NixosRebuildConfig) GetEnv() []string {
 	env := os.Environ()
-	env = append(env, fmt.Sprintf("NIX_PATH=%s", cfg.NixPath))
+	if cfg.Flake == "" {
+		env = append(env, fmt.Sprintf("NIX_PATH=%s", cfg.NixPath))
+		env = append(env, fmt.Sprintf("NIXOS_CONFIG=%s", cfg.NixosConfigPath))
+	}
 	env = append(env, fmt.Sprintf("NIX_TARGET_HOST=%s", cfg.TargetHost))
 	env = append(env, fmt.Sprintf("NIX_TARGET_USER=%s", cfg.TargetUser))
 	env = append(env, fmt.Sprintf("NIX_SSHOPTS=%s", cfg.SSHOpts))
-	env = append(env, fmt.Sprintf("NIXOS_CONFIG=%s", cfg.NixosConfigPath))
-	return env
+	// Hooks running commands as root on the target can prefix them with it.
+	env = append(env, fmt.Sprintf("NIX_TARGET_ESCALATION=%s", cfg.escalationPrefix()))
+	env = append(env, fmt.Sprintf("NIX_REMOTE_TMPDIR=%s", cfg.RemoteTempDir))
+	return sshEnv(cfg.sshClient(), env)
+}
+
+// shellQuote quotes s so it is passed through sh as a single word.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+// sshCommand runs command with the remote shell of the TargetHost.
+func (cfg *NixosRebuildConfig) sshCommand(command string) *exec.Cmd {
+	return cfg.sshCommandWithOpts(cfg.SSHOpts, command)
+}
+
+// agentSSHCommand is sshCommand forwarding the ssh agent if ForwardAgent
+// is set.
+func (cfg *NixosRebuildConfig) agentSSHCommand(command string) *exec.Cmd {
+	return cfg.sshCommandWithOpts(cfg.agentSSHOpts(), command)
+}
+
+// agentSSHOpts returns the SSHOpts, with agent forwarding if ForwardAgent
+// is set.
+func (cfg *NixosRebuildConfig) agentSSHOpts() string {
+	if cfg.ForwardAgent {
+		return strings.TrimSpace(cfg.SSHOpts + " -A")
+	}
+	return cfg.SSHOpts
+}
+
+// sshCommandWithOpts is sshCommand connecting with sshOpts. With Local
+// command runs here with sh instead, and with a RemoteCommandTemplate it
+// runs with the template.
+func (cfg *NixosRebuildConfig) sshCommandWithOpts(sshOpts, command string) *exec.Cmd {
+	command = cfg.tempDirCommand(command)
+	if cfg.Local {
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Env = os.Environ()
+		return cmd
+	}
+	if cfg.RemoteCommandTemplate != "" {
+		cmd := exec.Command("sh", "-c", templateScript(cfg.RemoteCommandTemplate, cfg.TargetUser, cfg.TargetHost, command))
+		cmd.Env = os.Environ()
+		return cmd
+	}
+	cmd := exec.Command("sh", "-c", fmt.Sprintf("exec ssh %s %s -- %s", sshOpts, cfg.sshDestination(), shellQuote(command)))
+	cmd.Env = sshEnv(cfg.sshClient(), os.Environ())
+	return cmd
+}
+
+// systemLink is the link on the TargetHost pointing at the system installed
+// by SwitchSystem.
+func (cfg *NixosRebuildConfig) systemLink() string {
+	// The profile always points at the top level system, even when a
+	// specialisation is active. test leaves the profile alone, so a tested
+	// specialisation can only be read as the specialisation itself.
+	if cfg.switchAction() == "boot" || (cfg.Specialisation != "" && setsProfile(cfg.switchAction())) {
+		return systemProfile
+	}
+	return "/run/current-system"
+}
+
+// SSHPoll is how often WaitForSSH tries to reach a host, first after
+// Interval, then backing off exponentially up to MaxInterval. Zero values
+// are the defaults, 2 and 30 seconds.
+type SSHPoll struct {
+	Interval    time.Duration
+	MaxInterval time.Duration
+}
+
+// delay returns how long to wait after the given failed attempt, counting
+// from 1. It is jittered, so many hosts waited for at once aren't polled in
+// lockstep.
+func (p SSHPoll) delay(attempt int) time.Duration {
+	interval := p.Interval
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+	max := p.MaxInterval
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+	if max < interval {
+		max = interval
+	}
+
+	delay := interval
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
 }
 
-// WaitForSSH waits until the given ssh host is up and ready for commands.
-func WaitForSSH(user, host, sshOpts string, timeout time.Duration) error {
+// WaitForSSH waits until the given ssh host is up and ready for commands,
+// connecting with client, polling it as poll says. With a CommandTemplate
+// the host is ready once the template runs. Waiting stops early once ctx is
+// done.
+func WaitForSSH(ctx context.Context, user, host, sshOpts string, client SSHClient, poll SSHPoll, timeout time.Duration) error {
+	if client.CommandTemplate != "" {
+		return waitForTemplate(ctx, user, host, client.CommandTemplate, poll, timeout)
+	}
 	deadline := time.Now().Add(timeout)
 
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("exec ssh %s %s@%s -G", sshOpts, user, host))
-	out, err := cmd.Output() // Not interested in this in the logs...
+	cmd := exec.Command("sh", "-c", fmt.Sprintf("exec ssh %s %s@%s -G", sshOpts, user, sshHost(host)))
+	cmd.Env = sshEnv(client, os.Environ())
+	out := bytes.NewBuffer(nil)
+	cmd.Stdout = out // Not interested in this in the logs...
+	err := runCancellable(ctx, cmd)
 	if err != nil {
 		return err
 	}
-	outs := string(out)
+	outs := out.String()
 
 	host = ""
 	port := ""
+	proxied := false
 
 	lines := strings.Split(outs, "\n")
 	for _, line := range lines {
@@ -104,25 +664,47 @@ func WaitForSSH(user, host, sshOpts string, timeout time.Duration) error {
 		if strings.HasPrefix(line, "port") {
 			port = line[5:]
 		}
+
+		if (strings.HasPrefix(line, "proxyjump ") || strings.HasPrefix(line, "proxycommand ")) && !strings.HasSuffix(line, " none") {
+			proxied = true
+		}
 	}
 
-	for {
-		if time.Now().After(deadline) {
+	// Hosts behind a proxy can't be reached directly, only by ssh.
+	addr := net.JoinHostPort(host, port)
+	for attempt := 1; !proxied; attempt++ {
+		if err := stopErr(ctx); err != nil {
+			return err
+		}
+		if !time.Now().Before(deadline) {
 			return errors.New("ssh server down or not responsive")
 		}
 		dialer := net.Dialer{
 			Timeout: 10 * time.Second,
 		}
-		c, err := dialer.Dial("tcp", fmt.Sprintf("%s:%s", host, port))
+		if remaining := time.Until(deadline); remaining < dialer.Timeout {
+			dialer.Timeout = remaining
+		}
+		c, err := dialer.DialContext(ctx, "tcp", addr)
 		if err == nil {
+			log.Printf("[DEBUG] attempt %d to reach %s succeeded", attempt, addr)
 			_ = c.Close()
 			break
 		}
-		time.Sleep(2 * time.Second)
+		delay := poll.delay(attempt)
+		if remaining := time.Until(deadline); remaining < delay {
+			delay = remaining
+		}
+		log.Printf("[DEBUG] attempt %d to reach %s failed, retrying in %s: %s", attempt, addr, delay.Round(time.Millisecond), err)
+		err = SleepContext(ctx, delay)
+		if err != nil {
+			return err
+		}
 	}
 
-	cmd = exec.Command("sh", "-c", fmt.Sprintf("exec timeout 10s ssh %s %s@%s -- true", sshOpts, user, host))
-	err = runCommandWithLogging(cmd, ioutil.Discard)
+	cmd = exec.Command("sh", "-c", fmt.Sprintf("exec timeout 10s ssh %s %s@%s -- true", sshOpts, user, sshHost(host)))
+	cmd.Env = sshEnv(client, os.Environ())
+	err = runCommandWithLog(ctx, cmd, ioutil.Discard, nil, "", nil)
 	if err != nil {
 		return err
 	}
@@ -132,6 +714,10 @@ func WaitForSSH(user, host, sshOpts string, timeout time.Duration) error {
 
 // BuildSystem builds a nixos system config and returns the store path.
 func BuildSystem(cfg *NixosRebuildConfig) (string, error) {
+	if cfg.SystemPath != "" {
+		return cfg.SystemPath, CheckSystemPath(cfg.SystemPath)
+	}
+
 	tmp, err := ioutil.TempDir("", "")
 	if err != nil {
 		return "", err
@@ -144,77 +730,501 @@ func BuildSystem(cfg *NixosRebuildConfig) (string, error) {
 		return "", err
 	}
 
-	cmd := exec.Command("nixos-rebuild", "build", "--build-host", cfg.BuildHost)
-	cmd.Dir = tmp
-	cmd.Env = cfg.GetEnv()
-	err = runCommandWithLogging(cmd, ioutil.Discard)
+	release, err := acquireBuildSlot(cfg.context(), cfg.TargetHost)
 	if err != nil {
-		return "", formatChildErr(err)
+		return "", err
+	}
+	defer release()
+
+	build := func(jsonLog bool) error {
+		cmd := cfg.buildCommand(outLink, jsonLog)
+		cmd.Dir = tmp
+		cmd.Env = cfg.GetEnv()
+		return cfg.runWithTimeout(cfg.BuildTimeout, func(cfg *NixosRebuildConfig) error {
+			if jsonLog {
+				return cfg.runCommandWithProgress(cmd, ioutil.Discard)
+			}
+			return cfg.runCommand(cmd, ioutil.Discard)
+		})
+	}
+
+	// nix build reports structured progress, older versions of nix without
+	// --log-format are streamed as plain text.
+	err = build(cfg.usesNixBuild())
+	if err != nil && cfg.usesNixBuild() && strings.Contains(err.Error(), "'--log-format'") {
+		log.Printf("[INFO] nix does not support --log-format internal-json, building without progress reports")
+		err = build(false)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s%s", cfg.buildErr(err), cfg.crossBuildHint())
 	}
 
 	return os.Readlink(outLink)
 }
 
+// CheckSystemPath checks a local store path is a nixos system toplevel.
+func CheckSystemPath(systemPath string) error {
+	_, err := os.Stat(filepath.Join(systemPath, "bin", "switch-to-configuration"))
+	if err != nil {
+		return fmt.Errorf("%s is not a nixos system, bin/switch-to-configuration is missing", systemPath)
+	}
+	return nil
+}
+
 // CurrentSystem returns the store path of the system on the TargetHost.
+//
+// With the boot action the new system only becomes current after a reboot,
+// so the system profile is read instead of /run/current-system.
 func CurrentSystem(cfg *NixosRebuildConfig) (string, error) {
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("exec timeout 10s ssh %s %s@%s -- readlink /run/current-system", cfg.SSHOpts, cfg.TargetUser, cfg.TargetHost))
+	cmd := cfg.sshCommand("readlink -f " + cfg.systemLink())
+	if !cfg.Local && cfg.RemoteCommandTemplate == "" {
+		cmd = exec.Command("sh", "-c", fmt.Sprintf("exec timeout 10s ssh %s %s -- readlink -f %s", cfg.SSHOpts, cfg.sshDestination(), cfg.systemLink()))
+		cmd.Env = sshEnv(cfg.sshClient(), os.Environ())
+	}
 
 	output := bytes.NewBuffer(nil)
-	err := runCommandWithLogging(cmd, output)
+	err := cfg.runRemote("reading the current system", cmd, output)
 	return strings.TrimSpace(output.String()), formatChildErr(err)
 }
 
-// SwitchSystem is the equivalent of nixos-rebuild switch.
+// SwitchSystem is the equivalent of nixos-rebuild switch, or of whichever
+// action is configured in cfg.SwitchAction.
 func SwitchSystem(cfg *NixosRebuildConfig) error {
-	tmpDir, err := ioutil.TempDir("", "")
+	env := cfg.copySSHEnv()
+	// Hooks connecting to the TargetHost with NIX_SSHOPTS forward the agent.
+	hookEnv := append(cfg.GetEnv(), fmt.Sprintf("NIX_SSHOPTS=%s", cfg.agentSSHOpts()))
+
+	err := CheckTargetSystem(cfg)
 	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(tmpDir)
 
-	env := cfg.GetEnv()
-	hookPath := filepath.Join(tmpDir, "hook")
+	system := cfg.SystemPath
+	if system == "" && cfg.needsPrebuild() {
+		system, err = BuildSystem(cfg)
+		if err != nil {
+			return err
+		}
+	}
 
-	runHook := func(hookText string) error {
-		if hookText == "" {
-			return nil
+	if cfg.SigningKeyFile != "" {
+		err = SignClosure(cfg, cfg.SigningKeyFile, system)
+		if err != nil {
+			return err
 		}
+	}
 
-		err := ioutil.WriteFile(hookPath, []byte(hookText), 0700)
+	// The target can substitute from the cache instead of receiving a copy.
+	if system != "" {
+		err = PushToCache(cfg, system)
 		if err != nil {
 			return err
 		}
+	}
+
+	err = cfg.runHooks(cfg.PreSwitchHooks, hookEnv)
+	if err != nil {
+		return err
+	}
+
+	args := append([]string{cfg.switchAction()}, cfg.rebuildFlags()...)
+	if !cfg.Local {
+		args = append(args, "--target-host", cfg.sshDestination())
+	}
+	if cfg.remoteSudo() {
+		args = append(args, "--use-remote-sudo")
+	}
+	if cfg.UseSubstitutes {
+		args = append(args, "--use-substitutes")
+	}
+	if cfg.Specialisation != "" {
+		args = append(args, "--specialisation", cfg.Specialisation)
+	}
+
+	beforeActivate := cfg.BeforeActivate
+	activate := func() error {
+		if system != "" {
+			err := CopyClosure(cfg, system)
+			if err != nil {
+				return err
+			}
+			if cfg.reportsUnitChanges() {
+				reportUnitChanges(cfg, system)
+			}
+			// Retries only repeat the activation.
+			if beforeActivate != nil {
+				err = beforeActivate()
+				if err != nil {
+					return err
+				}
+				beforeActivate = nil
+			}
+			cfg.reportActivated()
+			return SwitchToSystem(cfg, system)
+		}
+		// nixos-rebuild builds the system before activating it, a failure
+		// can't be told apart from a failed activation.
+		release, err := acquireBuildSlot(cfg.context(), cfg.TargetHost)
+		if err != nil {
+			return err
+		}
+		defer release()
+		cfg.reportActivated()
+		cmd := command("nixos-rebuild", args...)
+		cmd.Env = env
+		err = cfg.runCommand(cmd, ioutil.Discard)
+		if err != nil {
+			return cfg.buildErr(err)
+		}
+		return nil
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = activate()
+		if err == nil {
+			break
+		}
+		if attempt > cfg.SwitchRetries || !isTransientError(err) {
+			if attempt > 1 {
+				return fmt.Errorf("switch failed after %d attempts: %s", attempt, formatChildErr(err))
+			}
+			return formatChildErr(err)
+		}
+		delay := time.Duration(attempt*attempt) * 5 * time.Second
+		log.Printf("[INFO] switch attempt %d failed with a transient error, retrying in %s", attempt, delay)
+		err = SleepContext(cfg.context(), delay)
+		if err != nil {
+			return err
+		}
+	}
+
+	return cfg.runHooks(cfg.PostSwitchHooks, hookEnv)
+}
+
+const systemProfile = "/nix/var/nix/profiles/system"
+
+// setsProfile reports whether action makes the activated system the newest
+// generation of the system profile, which it boots into. Like nixos-rebuild
+// only switch and boot do, test and dry-activate leave the profile alone.
+func setsProfile(action string) bool {
+	return action == "switch" || action == "boot"
+}
+
+// setSystemScript returns a remote script activating system with action,
+// first making it the current generation of the system profile if the
+// action sets it.
+func setSystemScript(system, action string) string {
+	return activationScript(system, "", action)
+}
+
+// activationScript is setSystemScript activating the specialisation of
+// system if it is set. The profile always points at the top level system.
+func activationScript(system, specialisation, action string) string {
+	toplevel := system
+	if specialisation != "" {
+		toplevel = fmt.Sprintf("%s/specialisation/%s", system, specialisation)
+	}
+	activate := fmt.Sprintf("%s/bin/switch-to-configuration %s", toplevel, action)
+	if !setsProfile(action) {
+		return activate
+	}
+	return fmt.Sprintf("nix-env -p %s --set %s && %s", systemProfile, system, activate)
+}
+
+// SwitchToSystem activates an existing system closure on the TargetHost,
+// making it the newest generation of the system profile.
+func SwitchToSystem(cfg *NixosRebuildConfig, system string) error {
+	attempt := 0
+	return cfg.retrySSH("activation", func() error {
+		attempt++
+		// An interrupted activation may have finished on the target.
+		if attempt > 1 {
+			current, err := CurrentSystem(cfg)
+			if err != nil {
+				return err
+			}
+			if current == system {
+				return nil
+			}
+		}
+		return switchToSystem(cfg, system)
+	})
+}
 
-		hook := exec.Command(hookPath)
-		hook.Env = env
+func switchToSystem(cfg *NixosRebuildConfig, system string) error {
+	activate := activationScript(system, cfg.Specialisation, cfg.switchAction())
+	script := fmt.Sprintf("if ! test -x %[1]s/bin/switch-to-configuration; then echo \"%[1]s is not a nixos system on this host\" >&2; exit 1; fi; %[2]s", system, activate)
+	err := cfg.runRemote("activation", cfg.agentRootSSHCommand(script), ioutil.Discard)
+	return formatChildErr(err)
+}
 
-		err = runCommandWithLogging(hook, ioutil.Discard)
+// SwitchGeneration activates an existing generation of the system profile
+// on the TargetHost.
+func SwitchGeneration(cfg *NixosRebuildConfig, generation int) error {
+	link := fmt.Sprintf("%s-%d-link", systemProfile, generation)
+	activate := fmt.Sprintf("%s/bin/switch-to-configuration %s", link, cfg.switchAction())
+	if setsProfile(cfg.switchAction()) {
+		activate = fmt.Sprintf("nix-env -p %s --switch-generation %d && %s/bin/switch-to-configuration %s", systemProfile, generation, systemProfile, cfg.switchAction())
+	}
+	script := fmt.Sprintf("if ! test -e %[1]s; then echo \"generation %[2]d does not exist, it may have been garbage collected\" >&2; exit 1; fi; %[3]s", link, generation, activate)
+	err := cfg.runRemote("activation", cfg.agentRootSSHCommand(script), ioutil.Discard)
+	return formatChildErr(err)
+}
+
+// RollbackSystem reverts the TargetHost to previousSystem, the store path of
+// the system it ran before a failed switch. Rolling back the profile instead
+// could revert to a generation this provider never deployed, so anything
+// else is refused.
+func RollbackSystem(cfg *NixosRebuildConfig, previousSystem string) error {
+	action := cfg.switchAction()
+	if action == "dry-activate" {
+		return nil
+	}
+	if !strings.HasPrefix(previousSystem, "/nix/store/") {
+		return fmt.Errorf("refusing to roll back %s to %q, it is not a store path", cfg.TargetHost, previousSystem)
+	}
+
+	err := cfg.runRemote("rollback", cfg.rootSSHCommand(setSystemScript(previousSystem, action)), ioutil.Discard)
+	return formatChildErr(err)
+}
+
+// storeURI is the store of the TargetHost for nix copy.
+func (cfg *NixosRebuildConfig) storeURI() string {
+	protocol := "ssh"
+	if cfg.CopyProtocol == "ssh-ng" {
+		protocol = "ssh-ng"
+	}
+	return fmt.Sprintf("%s://%s@%s", protocol, cfg.TargetUser, urlHost(cfg.TargetHost))
+}
+
+// CopyClosure copies the closure of storePath to the TargetHost.
+func CopyClosure(cfg *NixosRebuildConfig, storePath string) error {
+	// The local store already has it.
+	if cfg.Local {
+		if cfg.Report != nil {
+			cfg.Report.CopySkipped = true
+		}
+		return nil
+	}
+	return cfg.retrySSH("copy", func() error {
+		return copyClosure(cfg, storePath)
+	})
+}
+
+func copyClosure(cfg *NixosRebuildConfig, storePath string) error {
+	// A valid path implies its whole closure is valid too.
+	valid, err := RemotePathValid(cfg, storePath)
+	if err != nil {
 		return err
 	}
+	if valid {
+		log.Printf("[INFO] %s already has %s, skipping the copy", cfg.TargetHost, storePath)
+		if cfg.Report != nil {
+			cfg.Report.CopySkipped = true
+		}
+		return nil
+	}
+	err = checkFreeSpace(cfg, storePath)
+	if err != nil {
+		return err
+	}
+	if cfg.substituteOnTarget() {
+		err = substitute(cfg, storePath)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.streamCompressed() || cfg.templated() {
+		return copyStream(cfg, storePath)
+	}
+	if cfg.CopyParallelism > 1 {
+		return copyParallel(cfg, storePath)
+	}
+	err = copyPaths(cfg, []string{storePath})
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] copied the closure of %s to %s, substitutes used: %t", storePath, cfg.TargetHost, cfg.UseSubstitutes)
+	return nil
+}
+
+// copyPaths copies the closures of paths to the TargetHost in one stream,
+// with as many commands as it takes to fit paths in their arguments.
+func copyPaths(cfg *NixosRebuildConfig, paths []string) error {
+	for _, batch := range argBatches(paths) {
+		err := copyBatch(cfg, batch)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyBatch copies the closures of paths to the TargetHost with one command.
+func copyBatch(cfg *NixosRebuildConfig, paths []string) error {
+	var cmd *exec.Cmd
+	// nix-copy-closure can't skip signature checks, nix copy is used instead.
+	if cfg.CopyProtocol == "ssh-ng" || cfg.NoCheckSigs {
+		// nix copy reads the ssh options from NIX_SSHOPTS too.
+		args := append([]string{"copy"}, experimentalFeatureFlags(append([]string{"nix-command"}, cfg.ExperimentalFeatures...))...)
+		if cfg.UseSubstitutes {
+			args = append(args, "--substitute-on-destination")
+		}
+		if cfg.NoCheckSigs {
+			log.Printf("[WARN] signature verification is disabled copying to %s", cfg.TargetHost)
+			args = append(args, "--no-check-sigs")
+		}
+		to := cfg.storeURI()
+		if cfg.CopyCompression == "ssh" {
+			to += "?compress=true"
+		}
+		args = append(args, "--to", to)
+		cmd = command("nix", append(args, paths...)...)
+	} else {
+		args := experimentalFeatureFlags(cfg.ExperimentalFeatures)
+		if cfg.UseSubstitutes {
+			args = append(args, "--use-substitutes")
+		}
+		args = append(args, "--to", cfg.sshDestination())
+		cmd = command("nix-copy-closure", append(args, paths...)...)
+	}
+	cmd.Env = cfg.copySSHEnv()
+	err := cfg.runCommand(cmd, ioutil.Discard)
+	return formatChildErr(err)
+}
+
+// RunCheck runs a check command with sh, either locally with the rebuild env,
+// or on the TargetHost if remote is set. The output of the command is returned
+// for error reporting.
+func RunCheck(cfg *NixosRebuildConfig, command string, remote bool) (string, error) {
+	var cmd *exec.Cmd
+	if remote {
+		cmd = cfg.sshCommand(command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+		cmd.Env = cfg.GetEnv()
+	}
+
+	output := bytes.NewBuffer(nil)
+	err := cfg.runCommand(cmd, output)
+	return output.String(), formatChildErr(err)
+}
+
+// BootedSystem returns the store path of the system the TargetHost booted.
+func BootedSystem(cfg *NixosRebuildConfig) (string, error) {
+	cmd := cfg.sshCommand("readlink -f /run/booted-system")
+	output := bytes.NewBuffer(nil)
+	err := cfg.runRemote("reading the booted system", cmd, output)
+	return strings.TrimSpace(output.String()), formatChildErr(err)
+}
 
-	err = runHook(cfg.PreSwitchHook)
+// NeedsReboot reports whether the kernel, initrd or kernel modules of the
+// installed system differ from the booted system on the TargetHost.
+func NeedsReboot(cfg *NixosRebuildConfig) (bool, error) {
+	script := fmt.Sprintf("for f in kernel initrd kernel-modules; do echo \"$(readlink -f /run/booted-system/$f) $(readlink -f %s/$f)\"; done", cfg.systemLink())
+	cmd := cfg.sshCommand(script)
+
+	output := bytes.NewBuffer(nil)
+	err := cfg.runRemote("checking for a reboot", cmd, output)
 	if err != nil {
-		return formatChildErr(err)
+		return false, formatChildErr(err)
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		paths := strings.Fields(line)
+		if len(paths) != 2 || paths[0] != paths[1] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func bootID(cfg *NixosRebuildConfig) (string, error) {
+	cmd := cfg.sshCommand("cat /proc/sys/kernel/random/boot_id")
+	output := bytes.NewBuffer(nil)
+	err := cfg.runRemote("reading the boot id", cmd, output)
+	return strings.TrimSpace(output.String()), formatChildErr(err)
+}
+
+// RebootSystem reboots the TargetHost and waits until it is reachable
+// over ssh with a new boot id.
+func RebootSystem(cfg *NixosRebuildConfig, timeout time.Duration) error {
+	if cfg.Local {
+		return fmt.Errorf("%s needs a reboot, but it is the machine running terraform, reboot it by hand", cfg.TargetHost)
 	}
 
-	cmd := exec.Command("nixos-rebuild", "switch", "--build-host", cfg.BuildHost, "--target-host", fmt.Sprintf("%s@%s", cfg.TargetUser, cfg.TargetHost))
-	cmd.Env = env
-	err = runCommandWithLogging(cmd, ioutil.Discard)
+	oldBootID, err := bootID(cfg)
 	if err != nil {
-		return formatChildErr(err)
+		return err
 	}
 
-	err = runHook(cfg.PostSwitchHook)
+	script := "nohup sh -c " + shellQuote(cfg.rootCommand("sleep 1; systemctl reboot")) + " >/dev/null 2>&1 &"
+	if cfg.escalates() {
+		// The reboot runs in the background, the escalation is checked
+		// first so a password prompt fails here.
+		script = cfg.rootCommand("true") + " && " + script
+	}
+	cmd := cfg.sshCommand(script)
+	err = cfg.runRemote("reboot", cmd, ioutil.Discard)
 	if err != nil {
-		return formatChildErr(err)
+		return fmt.Errorf("unable to issue reboot: %s", formatChildErr(err))
 	}
 
-	return err
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		err = SleepContext(cfg.context(), 5*time.Second)
+		if err != nil {
+			return err
+		}
+		err = WaitForSSH(cfg.context(), cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts, cfg.sshClient(), cfg.SSHPoll, time.Until(deadline))
+		if err != nil {
+			break
+		}
+		newBootID, err := bootID(cfg)
+		if err == nil && newBootID != oldBootID {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("reboot issued but %s was unreachable after %s", cfg.TargetHost, timeout)
+}
+
+const revertUnit = "terraform-nix-revert"
+
+// ScheduleRevert installs a transient systemd timer on the TargetHost that
+// switches back to previousSystem after the given delay unless it is
+// cancelled with CancelRevert first. The timer runs on the target itself,
+// so it still fires if the new system cuts off ssh access.
+func ScheduleRevert(cfg *NixosRebuildConfig, previousSystem string, after time.Duration) error {
+	if !strings.HasPrefix(previousSystem, "/nix/store/") {
+		return fmt.Errorf("unable to schedule a revert to unknown system %q", previousSystem)
+	}
+
+	revert := setSystemScript(previousSystem, "switch")
+	cmd := cfg.rootSSHCommand(fmt.Sprintf(
+		"systemctl stop %[1]s.timer %[1]s.service >/dev/null 2>&1; systemctl reset-failed %[1]s.timer %[1]s.service >/dev/null 2>&1; systemd-run --unit=%[1]s --on-active=%[2]d /bin/sh -c %[3]s",
+		revertUnit, int(after.Seconds()), shellQuote(revert)))
+	err := cfg.runRemote("scheduling the revert", cmd, ioutil.Discard)
+	return formatChildErr(err)
+}
+
+// CommitSystem makes system permanent on the TargetHost by setting it as the
+// newest generation of the system profile and installing it, or its
+// Specialisation, in the bootloader. It is used after activating system with
+// the test action, which leaves the profile and bootloader alone.
+func CommitSystem(cfg *NixosRebuildConfig, system string) error {
+	if !strings.HasPrefix(system, "/nix/store/") {
+		return fmt.Errorf("refusing to commit %q on %s, it is not a store path", system, cfg.TargetHost)
+	}
+	script := activationScript(system, cfg.Specialisation, "boot")
+	err := cfg.runRemote("committing the system", cfg.rootSSHCommand(script), ioutil.Discard)
+	return formatChildErr(err)
 }
 
-// CollectGarbage runs nix-collect-garbage -d on the remote host.
-func CollectGarbage(user, host, sshOpts string) error {
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("exec ssh %s %s@%s -- nix-collect-garbage -d", sshOpts, user, host))
-	err := runCommandWithLogging(cmd, ioutil.Discard)
+// CancelRevert cancels a revert installed by ScheduleRevert, confirming
+// the currently active system.
+func CancelRevert(cfg *NixosRebuildConfig) error {
+	cmd := cfg.rootSSHCommand(fmt.Sprintf("systemctl stop %s.timer", revertUnit))
+	err := cfg.runRemote("cancelling the revert", cmd, ioutil.Discard)
 	return formatChildErr(err)
 }
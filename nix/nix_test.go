@@ -0,0 +1,146 @@
+package nix
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestActivationScript(t *testing.T) {
+	const system = "/nix/store/abc-nixos-system"
+	for _, tc := range []struct {
+		specialisation string
+		action         string
+		expected       string
+	}{
+		{"", "switch", "nix-env -p /nix/var/nix/profiles/system --set /nix/store/abc-nixos-system && /nix/store/abc-nixos-system/bin/switch-to-configuration switch"},
+		{"", "boot", "nix-env -p /nix/var/nix/profiles/system --set /nix/store/abc-nixos-system && /nix/store/abc-nixos-system/bin/switch-to-configuration boot"},
+		// An unconfirmed or tested system must not become the boot default.
+		{"", "test", "/nix/store/abc-nixos-system/bin/switch-to-configuration test"},
+		{"", "dry-activate", "/nix/store/abc-nixos-system/bin/switch-to-configuration dry-activate"},
+		// The profile always holds the toplevel, not the specialisation.
+		{"gpu", "switch", "nix-env -p /nix/var/nix/profiles/system --set /nix/store/abc-nixos-system && /nix/store/abc-nixos-system/specialisation/gpu/bin/switch-to-configuration switch"},
+		{"gpu", "boot", "nix-env -p /nix/var/nix/profiles/system --set /nix/store/abc-nixos-system && /nix/store/abc-nixos-system/specialisation/gpu/bin/switch-to-configuration boot"},
+		{"gpu", "test", "/nix/store/abc-nixos-system/specialisation/gpu/bin/switch-to-configuration test"},
+	} {
+		got := activationScript(system, tc.specialisation, tc.action)
+		if got != tc.expected {
+			t.Errorf("activationScript(%q, %q):\n got %q\nwant %q", tc.specialisation, tc.action, got, tc.expected)
+		}
+	}
+}
+
+func TestCommitSystemNeedsStorePath(t *testing.T) {
+	cfg := &NixosRebuildConfig{TargetHost: "example.com"}
+	for _, system := range []string{"", "/run/current-system", "result"} {
+		err := CommitSystem(cfg, system)
+		if err == nil || !strings.Contains(err.Error(), "not a store path") {
+			t.Errorf("CommitSystem(%q) = %v, expected it to refuse", system, err)
+		}
+	}
+}
+
+func TestNixPathEntryFlags(t *testing.T) {
+	cfg := &NixosRebuildConfig{NixPathEntries: []string{"nixpkgs=https://example.com/nixpkgs.tar.gz", "nixos-config=/etc/nixos/configuration.nix"}}
+	expected := []string{"-I", "nixpkgs=https://example.com/nixpkgs.tar.gz", "-I", "nixos-config=/etc/nixos/configuration.nix"}
+	if flags := cfg.evalFlags(); !reflect.DeepEqual(flags, expected) {
+		t.Fatalf("got %q, expected %q", flags, expected)
+	}
+
+	// Flakes don't search the nix path.
+	cfg.Flake = "/src/deploy#host"
+	for _, flag := range cfg.evalFlags() {
+		if flag == "-I" {
+			t.Fatalf("flake evaluations got -I flags: %q", cfg.evalFlags())
+		}
+	}
+}
+
+func TestNeedsReboot(t *testing.T) {
+	// readlink -f resolves the links written under dir/links.
+	dir := fakeCommands(t, map[string]string{"readlink": `cat "$(dirname "$0")/links$2"`})
+	link := func(path, target string) {
+		path = filepath.Join(dir, "links", path)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte(target+"\n"), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		current  map[string]string
+		expected bool
+	}{
+		{"same boot files", map[string]string{}, false},
+		{"new kernel", map[string]string{"kernel": "/nix/store/k2-linux/bzImage"}, true},
+		{"new initrd", map[string]string{"initrd": "/nix/store/i2-initrd/initrd"}, true},
+		{"new modules", map[string]string{"kernel-modules": "/nix/store/m2-modules"}, true},
+	} {
+		booted := map[string]string{
+			"kernel":         "/nix/store/k1-linux/bzImage",
+			"initrd":         "/nix/store/i1-initrd/initrd",
+			"kernel-modules": "/nix/store/m1-modules",
+		}
+		for name, target := range booted {
+			link("/run/booted-system/"+name, target)
+			if changed, ok := tc.current[name]; ok {
+				target = changed
+			}
+			link("/run/current-system/"+name, target)
+		}
+
+		cfg := &NixosRebuildConfig{Local: true, TargetHost: "example.com"}
+		needsReboot, err := NeedsReboot(cfg)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if needsReboot != tc.expected {
+			t.Errorf("%s: got needs_reboot %v, expected %v", tc.name, needsReboot, tc.expected)
+		}
+	}
+
+	// The boot action leaves the running system alone, the profile is what
+	// boots next.
+	link(systemProfile+"/kernel", "/nix/store/k2-linux/bzImage")
+	link(systemProfile+"/initrd", "/nix/store/i1-initrd/initrd")
+	link(systemProfile+"/kernel-modules", "/nix/store/m1-modules")
+	cfg := &NixosRebuildConfig{Local: true, TargetHost: "example.com", SwitchAction: "boot"}
+	if needsReboot, err := NeedsReboot(cfg); err != nil || !needsReboot {
+		t.Errorf("boot action: got needs_reboot %v, %v, expected true", needsReboot, err)
+	}
+}
+
+func TestNeedsPrebuild(t *testing.T) {
+	for _, tc := range []struct {
+		cfg      NixosRebuildConfig
+		expected bool
+	}{
+		{NixosRebuildConfig{}, false},
+		{NixosRebuildConfig{Escalation: "sudo"}, false},
+		{NixosRebuildConfig{CopyParallelism: 1, CopyCompression: "ssh"}, false},
+		{NixosRebuildConfig{BuildTimeout: 60}, true},
+		{NixosRebuildConfig{NoCheckSigs: true}, true},
+		{NixosRebuildConfig{CopyCompression: "zstd"}, true},
+		{NixosRebuildConfig{CopyParallelism: 4}, true},
+		{NixosRebuildConfig{RemoteCommandTemplate: "ssm {{.Host}} {{.Command}}"}, true},
+		{NixosRebuildConfig{UseSubstitutes: true, Substituters: []string{"https://cache.example.com"}}, true},
+		{NixosRebuildConfig{ReportUnitChanges: true}, true},
+		// Only activating actions change units.
+		{NixosRebuildConfig{ReportUnitChanges: true, SwitchAction: "boot"}, false},
+		{NixosRebuildConfig{SSHRetries: 2}, true},
+		{NixosRebuildConfig{Escalation: "doas"}, true},
+		{NixosRebuildConfig{RemoteTempDir: "/var/tmp"}, true},
+		{NixosRebuildConfig{BeforeActivate: func() error { return nil }}, true},
+	} {
+		if got := tc.cfg.needsPrebuild(); got != tc.expected {
+			t.Errorf("%+v: needsPrebuild() = %v, expected %v", tc.cfg, got, tc.expected)
+		}
+	}
+}
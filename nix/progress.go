@@ -0,0 +1,133 @@
+package nix
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// internalJSONPrefix starts each line nix logs with --log-format internal-json.
+const internalJSONPrefix = "@nix "
+
+// Activity and result types from nix/src/libutil/logging.hh.
+const (
+	actFileTransfer = 101
+	actBuilds       = 104
+	actBuild        = 105
+
+	resProgress = 105
+)
+
+// internalJSONEvent is a line logged with --log-format internal-json.
+type internalJSONEvent struct {
+	Action string            `json:"action"`
+	ID     int64             `json:"id"`
+	Type   int               `json:"type"`
+	Level  int               `json:"level"`
+	Msg    string            `json:"msg"`
+	Text   string            `json:"text"`
+	Fields []json.RawMessage `json:"fields"`
+}
+
+// buildProgress summarises the activities of a nix command logging with
+// --log-format internal-json.
+type buildProgress struct {
+	activities map[int64]int
+	built      int64
+	toBuild    int64
+	downloaded map[int64]int64
+
+	interval    time.Duration
+	lastSummary string
+	lastLogged  time.Time
+}
+
+func newBuildProgress() *buildProgress {
+	return &buildProgress{
+		activities: make(map[int64]int),
+		downloaded: make(map[int64]int64),
+		interval:   2 * time.Second,
+	}
+}
+
+// handle processes a line logged by nix without its prefix. It returns the
+// text to treat as ordinary output, if any, and a progress summary when it is
+// time to report one.
+func (p *buildProgress) handle(line string) (string, string) {
+	var event internalJSONEvent
+	err := json.Unmarshal([]byte(line), &event)
+	if err != nil {
+		// Not something we understand, pass it on as is.
+		return internalJSONPrefix + line, ""
+	}
+
+	text := ""
+	switch event.Action {
+	case "msg":
+		text = event.Msg + "\n"
+	case "start":
+		p.activities[event.ID] = event.Type
+		if event.Type == actBuild {
+			text = event.Text + "\n"
+		}
+	case "stop":
+		delete(p.activities, event.ID)
+	case "result":
+		if event.Type != resProgress || len(event.Fields) < 2 {
+			break
+		}
+		var done, expected int64
+		if json.Unmarshal(event.Fields[0], &done) != nil || json.Unmarshal(event.Fields[1], &expected) != nil {
+			break
+		}
+		switch p.activities[event.ID] {
+		case actBuilds:
+			p.built, p.toBuild = done, expected
+		case actFileTransfer:
+			p.downloaded[event.ID] = done
+		}
+	}
+
+	return text, p.summary()
+}
+
+// summary returns the current progress if it changed since it was last
+// returned and the reporting interval has passed, or "".
+func (p *buildProgress) summary() string {
+	var downloaded int64
+	for _, n := range p.downloaded {
+		downloaded += n
+	}
+
+	var parts []string
+	if p.toBuild > 0 {
+		parts = append(parts, fmt.Sprintf("built %d/%d derivations", p.built, p.toBuild))
+	}
+	if downloaded > 0 {
+		parts = append(parts, "downloaded "+formatBytes(downloaded))
+	}
+	summary := strings.Join(parts, ", ")
+
+	finished := p.toBuild > 0 && p.built == p.toBuild
+	if summary == "" || summary == p.lastSummary || (!finished && time.Since(p.lastLogged) < p.interval) {
+		return ""
+	}
+	p.lastSummary = summary
+	p.lastLogged = time.Now()
+	return summary
+}
+
+// formatBytes formats n as a human readable binary size.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,109 @@
+package nix
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// replayProgress passes the lines of the log fixture name through p,
+// returning the text and the summaries it produced.
+func replayProgress(t *testing.T, p *buildProgress, name string) (string, []string) {
+	data, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := ""
+	var summaries []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if !strings.HasPrefix(line, internalJSONPrefix) {
+			t.Fatalf("%s: line without the internal-json prefix: %q", name, line)
+		}
+		s, summary := p.handle(strings.TrimPrefix(line, internalJSONPrefix))
+		text += s
+		if summary != "" {
+			summaries = append(summaries, summary)
+		}
+	}
+	return text, summaries
+}
+
+func TestBuildProgress(t *testing.T) {
+	p := newBuildProgress()
+	p.interval = 0
+	text, summaries := replayProgress(t, p, "build-internal-json.log")
+
+	expectedText := `warning: Git tree '/src/deploy' is dirty
+building '/nix/store/6c7h3vwmx6k5x3dqzf5ijfb0jrsq4vq1-etc.drv'
+building '/nix/store/2zj3nfkfdnc1dgmv0vqh4ms9yn8lsbdm-system-path.drv'
+building '/nix/store/yxm0k3lhk11fqbbq4aqz3qjmjbcfrmc4-nixos-system-host.drv'
+@nix not json from an older nix`
+	if text != expectedText {
+		t.Errorf("got text\n%s\nexpected\n%s", text, expectedText)
+	}
+
+	expectedSummaries := []string{
+		"built 0/3 derivations",
+		"built 0/3 derivations, downloaded 512.0 KiB",
+		"built 0/3 derivations, downloaded 1.0 MiB",
+		"built 1/3 derivations, downloaded 1.0 MiB",
+		"built 2/3 derivations, downloaded 1.0 MiB",
+		"built 3/3 derivations, downloaded 1.0 MiB",
+	}
+	if !reflect.DeepEqual(summaries, expectedSummaries) {
+		t.Errorf("got summaries\n%q\nexpected\n%q", summaries, expectedSummaries)
+	}
+}
+
+func TestBuildProgressInterval(t *testing.T) {
+	// Within the interval only the first summary and the finished build
+	// are reported.
+	_, summaries := replayProgress(t, newBuildProgress(), "build-internal-json.log")
+	expected := []string{"built 0/3 derivations", "built 3/3 derivations, downloaded 1.0 MiB"}
+	if !reflect.DeepEqual(summaries, expected) {
+		t.Errorf("got summaries %q, expected %q", summaries, expected)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, expected := range map[int64]string{
+		0:          "0 B",
+		1023:       "1023 B",
+		1024:       "1.0 KiB",
+		1536:       "1.5 KiB",
+		1288490188: "1.2 GiB",
+		5 << 50:    "5.0 PiB",
+	} {
+		if got := formatBytes(n); got != expected {
+			t.Errorf("formatBytes(%d) = %q, expected %q", n, got, expected)
+		}
+	}
+}
+
+func TestBuildWithoutLogFormat(t *testing.T) {
+	dir := fakeCommands(t, map[string]string{"nix": `echo "$*" >> "$(dirname "$0")/calls"
+case "$*" in
+*--log-format*) echo "error: unrecognised flag '--log-format'" >&2; exit 1 ;;
+esac
+while [ "$1" != --out-link ]; do shift; done
+ln -s /nix/store/00000000000000000000000000000000-nixos-system "$2"
+`})
+	cfg := &NixosRebuildConfig{TargetHost: "example.com", UseNewCLI: true}
+	system, err := BuildSystem(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if system != "/nix/store/00000000000000000000000000000000-nixos-system" {
+		t.Errorf("got system %q", system)
+	}
+
+	calls, err := ioutil.ReadFile(dir + "/calls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	builds := strings.Split(strings.TrimSpace(string(calls)), "\n")
+	if len(builds) != 2 || !strings.Contains(builds[0], "--log-format internal-json") || strings.Contains(builds[1], "--log-format") {
+		t.Errorf("expected a build with --log-format, then one without, got %q", builds)
+	}
+}
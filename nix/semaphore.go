@@ -0,0 +1,52 @@
+package nix
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+var (
+	buildSlotsMu sync.Mutex
+	buildSlots   = make(chan struct{}, 2)
+)
+
+// SetMaxConcurrentBuilds limits how many builds run at once in this process,
+// zero or less removes the limit. Builds already running keep their slots.
+func SetMaxConcurrentBuilds(n int) {
+	buildSlotsMu.Lock()
+	defer buildSlotsMu.Unlock()
+	if n <= 0 {
+		buildSlots = nil
+		return
+	}
+	buildSlots = make(chan struct{}, n)
+}
+
+// acquireBuildSlot waits until a build may start, and returns a function
+// releasing the slot when the build is done. Like SleepContext it stops
+// waiting with ErrCancelled or ErrTimeout once the stop context or ctx is
+// done.
+func acquireBuildSlot(ctx context.Context, what string) (func(), error) {
+	buildSlotsMu.Lock()
+	slots := buildSlots
+	buildSlotsMu.Unlock()
+
+	if slots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case slots <- struct{}{}:
+	default:
+		log.Printf("[INFO] %d builds already running, %s is waiting to build", cap(slots), what)
+		select {
+		case slots <- struct{}{}:
+		case <-stopCtx.Done():
+			return nil, ErrCancelled
+		case <-ctx.Done():
+			return nil, ErrTimeout
+		}
+	}
+	return func() { <-slots }, nil
+}
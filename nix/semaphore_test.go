@@ -0,0 +1,38 @@
+package nix
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAcquireBuildSlotStopsWithContext(t *testing.T) {
+	SetMaxConcurrentBuilds(1)
+	t.Cleanup(func() { SetMaxConcurrentBuilds(2) })
+
+	release, err := acquireBuildSlot(context.Background(), "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second build waits for the slot of the first until its context is
+	// done.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = acquireBuildSlot(ctx, "second")
+	if err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+	if waited := time.Since(start); waited > 5*time.Second {
+		t.Fatalf("waited %s after the context was done", waited)
+	}
+
+	// The slot is free again once released.
+	release()
+	release, err = acquireBuildSlot(context.Background(), "third")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
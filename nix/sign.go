@@ -0,0 +1,38 @@
+package nix
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// SignClosure signs the closure of storePath in the local store with the
+// secret key in keyFile, so targets requiring signatures accept it.
+func SignClosure(cfg *NixosRebuildConfig, keyFile string, storePath string) error {
+	// Only check the key can be read, its contents must never reach a log.
+	f, err := os.Open(keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to read signing key file: %s", err)
+	}
+	_ = f.Close()
+
+	features := experimentalFeatureFlags(append([]string{"nix-command"}, cfg.ExperimentalFeatures...))
+	sign := func(subcommand ...string) error {
+		args := append(subcommand, features...)
+		args = append(args, "--recursive", "--key-file", keyFile, storePath)
+		cmd := command("nix", args...)
+		cmd.Env = cfg.GetEnv()
+		return formatChildErr(cfg.runCommand(cmd, ioutil.Discard))
+	}
+
+	err = sign("store", "sign")
+	// nix before 2.4 only has nix sign-paths.
+	if err != nil && strings.Contains(err.Error(), "'store'") {
+		err = sign("sign-paths")
+	}
+	if err != nil {
+		return fmt.Errorf("signing %s failed: %s", storePath, err)
+	}
+	return nil
+}
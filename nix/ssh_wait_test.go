@@ -0,0 +1,102 @@
+package nix
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fakeSSH answers ssh -G with a closed port, so every attempt to reach the
+// host fails straight away.
+const fakeSSH = `for arg; do [ "$arg" = -G ] && printf 'hostname 127.0.0.1\nport 1\n' && exit 0; done
+exit 255
+`
+
+func TestWaitForSSHStopsWithContext(t *testing.T) {
+	fakeCommands(t, map[string]string{"ssh": fakeSSH})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	poll := SSHPoll{Interval: time.Minute, MaxInterval: time.Minute}
+	err := WaitForSSH(ctx, "root", "example.com", "", SSHClient{}, poll, time.Hour)
+	if err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+	if waited := time.Since(start); waited > 5*time.Second {
+		t.Fatalf("waited %s after the context was done", waited)
+	}
+}
+
+func TestWaitForTemplateStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	poll := SSHPoll{Interval: time.Minute, MaxInterval: time.Minute}
+	err := WaitForSSH(ctx, "root", "example.com", "", SSHClient{CommandTemplate: "false"}, poll, time.Hour)
+	if err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+	if waited := time.Since(start); waited > 5*time.Second {
+		t.Fatalf("waited %s after the context was done", waited)
+	}
+}
+
+func TestWaitForSSHStopsHungCommands(t *testing.T) {
+	// The host is behind a proxy, so it is only reached by ssh, which hangs.
+	fakeCommands(t, map[string]string{"ssh": `for arg; do [ "$arg" = -G ] && printf 'hostname 127.0.0.1\nport 22\nproxyjump bastion\n' && exit 0; done
+sleep 30
+`})
+
+	for _, client := range []SSHClient{{}, {CommandTemplate: "sleep 30"}} {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		start := time.Now()
+		err := WaitForSSH(ctx, "root", "example.com", "", client, SSHPoll{}, time.Hour)
+		cancel()
+		if err != ErrTimeout {
+			t.Fatalf("template %q: expected ErrTimeout, got %v", client.CommandTemplate, err)
+		}
+		if waited := time.Since(start); waited > 5*time.Second {
+			t.Fatalf("template %q: waited %s after the context was done", client.CommandTemplate, waited)
+		}
+	}
+}
+
+func TestSSHPollSchedule(t *testing.T) {
+	for _, tc := range []struct {
+		poll     SSHPoll
+		expected []time.Duration
+	}{
+		// The defaults.
+		{SSHPoll{}, []time.Duration{2, 4, 8, 16, 30, 30}},
+		{SSHPoll{Interval: 1 * time.Second, MaxInterval: 5 * time.Second}, []time.Duration{1, 2, 4, 5, 5}},
+		// A maximum below the interval polls at the interval.
+		{SSHPoll{Interval: 10 * time.Second, MaxInterval: 5 * time.Second}, []time.Duration{10, 10, 10}},
+	} {
+		for i, seconds := range tc.expected {
+			attempt := i + 1
+			expected := seconds * time.Second
+			// Jittered between half the delay and the whole delay.
+			for n := 0; n < 100; n++ {
+				delay := tc.poll.delay(attempt)
+				if delay < expected/2 || delay > expected {
+					t.Fatalf("%+v: attempt %d waits %s, expected %s to %s", tc.poll, attempt, delay, expected/2, expected)
+				}
+			}
+		}
+	}
+}
+
+func TestWaitForSSHDeadline(t *testing.T) {
+	fakeCommands(t, map[string]string{"ssh": fakeSSH})
+	start := time.Now()
+	poll := SSHPoll{Interval: 50 * time.Millisecond, MaxInterval: 200 * time.Millisecond}
+	err := WaitForSSH(context.Background(), "root", "example.com", "", SSHClient{}, poll, time.Second)
+	if err == nil || err.Error() != "ssh server down or not responsive" {
+		t.Fatalf("expected the host to be unreachable, got %v", err)
+	}
+	if waited := time.Since(start); waited < time.Second || waited > 3*time.Second {
+		t.Fatalf("waited %s, expected the timeout of 1s", waited)
+	}
+}
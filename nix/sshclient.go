@@ -0,0 +1,134 @@
+package nix
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// SSHClient is how commands connect to a host with ssh.
+type SSHClient struct {
+	// Transport is openssh to run the ssh binary, or go-ssh to connect with
+	// golang.org/x/crypto/ssh. Empty is openssh.
+	Transport string
+	// Password, if set, is given to ssh when it asks for a password.
+	Password string
+	// CommandTemplate, if set, runs commands on the host instead of ssh.
+	CommandTemplate string
+}
+
+// sshClient returns the SSHClient of the TargetHost.
+func (cfg *NixosRebuildConfig) sshClient() SSHClient {
+	return SSHClient{
+		Transport:       cfg.Transport,
+		Password:        cfg.SSHPassword,
+		CommandTemplate: cfg.RemoteCommandTemplate,
+	}
+}
+
+// sshPasswordEnv passes the ssh password to the helpers, so it's never on
+// disk or on a command line.
+const sshPasswordEnv = "TERRAFORM_NIX_SSH_PASSWORD"
+
+// The helpers are the provider binary run under another name. Commands
+// still run ssh, but with a PATH that finds the provider binary under that
+// name first for the go-ssh transport, which then acts as a small ssh
+// client, see goSSHMain. That way the transport also covers the closure
+// copies and nixos-rebuild, which run ssh themselves. The ssh-askpass
+// helper gives openssh the password.
+
+var (
+	sshHelperDirOnce sync.Once
+	sshHelperDirPath string
+	sshHelperDirErr  error
+)
+
+// PrepareSSHHelpers creates the directory holding the ssh helpers, links
+// to the provider binary.
+func PrepareSSHHelpers() error {
+	sshHelperDirOnce.Do(func() {
+		exe, err := os.Executable()
+		if err != nil {
+			sshHelperDirErr = err
+			return
+		}
+		dir, err := ioutil.TempDir("", "terraform-nix-ssh-helpers")
+		if err != nil {
+			sshHelperDirErr = err
+			return
+		}
+		for _, name := range []string{"ssh", "ssh-askpass"} {
+			err = os.Symlink(exe, filepath.Join(dir, name))
+			if err != nil {
+				sshHelperDirErr = err
+				return
+			}
+		}
+		sshHelperDirPath = dir
+	})
+	if sshHelperDirErr != nil {
+		return fmt.Errorf("unable to set up the ssh helpers: %s", sshHelperDirErr)
+	}
+	return nil
+}
+
+// RunSSHHelper runs the ssh helper the provider was run as, if it was,
+// returning the exit status.
+func RunSSHHelper(args []string) (int, bool) {
+	switch filepath.Base(args[0]) {
+	case "ssh":
+		return goSSHMain(args[1:]), true
+	case "ssh-askpass":
+		return askpassMain(args[1:]), true
+	}
+	return 0, false
+}
+
+// askpassMain answers the password prompts of openssh with the ssh
+// password. Other prompts, like for accepting a host key, are refused.
+func askpassMain(args []string) int {
+	password := os.Getenv(sshPasswordEnv)
+	if password == "" || len(args) == 0 || !strings.Contains(strings.ToLower(args[0]), "password") {
+		return 1
+	}
+	fmt.Println(password)
+	return 0
+}
+
+// sshEnv returns env changed so that ssh connects as client says.
+func sshEnv(client SSHClient, env []string) []string {
+	if (client.Transport != "go-ssh" && client.Password == "") || PrepareSSHHelpers() != nil {
+		return env
+	}
+
+	path := os.Getenv("PATH")
+	result := make([]string, 0, len(env)+5)
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "PATH=") {
+			path = kv[len("PATH="):]
+			continue
+		}
+		result = append(result, kv)
+	}
+	if client.Transport == "go-ssh" {
+		path = sshHelperDirPath + string(os.PathListSeparator) + path
+	}
+	result = append(result, "PATH="+path)
+
+	if client.Password != "" {
+		result = append(result,
+			sshPasswordEnv+"="+client.Password,
+			"SSH_ASKPASS="+filepath.Join(sshHelperDirPath, "ssh-askpass"),
+			// Use the askpass even with a terminal, older versions of
+			// openssh only use it without one and with a DISPLAY.
+			"SSH_ASKPASS_REQUIRE=force",
+		)
+		if os.Getenv("DISPLAY") == "" {
+			result = append(result, "DISPLAY=none")
+		}
+	}
+	return result
+}
@@ -0,0 +1,111 @@
+package nix
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"text/template"
+	"time"
+)
+
+// CommandTemplateData are the placeholders of remote and copy command
+// templates.
+type CommandTemplateData struct {
+	// Host is the TargetHost.
+	Host string
+	// User is the TargetUser.
+	User string
+	// Command is the command to run on the host, quoted as a single shell
+	// word.
+	Command string
+	// RawCommand is Command unquoted, for templates quoting it themselves.
+	RawCommand string
+}
+
+// RenderCommandTemplate renders a command template running command as user
+// on host. The result is run with sh.
+func RenderCommandTemplate(text, user, host, command string) (string, error) {
+	tmpl, err := template.New("command").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	buf := bytes.NewBuffer(nil)
+	err = tmpl.Execute(buf, CommandTemplateData{
+		Host:       host,
+		User:       user,
+		Command:    shellQuote(command),
+		RawCommand: command,
+	})
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// templateScript returns the shell script running command on host with the
+// template text. A template that fails to render gives a script failing
+// with the error.
+func templateScript(text, user, host, command string) string {
+	script, err := RenderCommandTemplate(text, user, host, command)
+	if err != nil {
+		return fmt.Sprintf("echo %s >&2; exit 1", shellQuote("unable to render the command template: "+err.Error()))
+	}
+	return script
+}
+
+// templated reports whether closures are copied with a command template
+// rather than by ssh.
+func (cfg *NixosRebuildConfig) templated() bool {
+	return cfg.RemoteCommandTemplate != "" || cfg.CopyCommandTemplate != ""
+}
+
+// copyShell returns the shell command running command on the TargetHost to
+// receive a closure stream on its stdin, with the CopyCommandTemplate, the
+// RemoteCommandTemplate or ssh.
+func (cfg *NixosRebuildConfig) copyShell(command string) string {
+	text := cfg.CopyCommandTemplate
+	if text == "" {
+		text = cfg.RemoteCommandTemplate
+	}
+	if text != "" {
+		return templateScript(text, cfg.TargetUser, cfg.TargetHost, command)
+	}
+	return fmt.Sprintf("ssh %s %s -- %s", cfg.SSHOpts, cfg.sshDestination(), shellQuote(command))
+}
+
+// waitForTemplate waits until true runs on host with the template text,
+// polling it as poll says, until ctx is done.
+func waitForTemplate(ctx context.Context, user, host, text string, poll SSHPoll, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		cmd := exec.Command("sh", "-c", templateScript(text, user, host, "true"))
+		cmd.Env = os.Environ()
+		err := runCommandWithLog(attemptCtx, cmd, ioutil.Discard, nil, "", nil)
+		cancel()
+		if err == nil {
+			log.Printf("[DEBUG] attempt %d to reach %s with the remote command template succeeded", attempt, host)
+			return nil
+		}
+		// Only the attempt timing out is retried.
+		if stop := stopErr(ctx); stop != nil {
+			return stop
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("%s was not reachable with the remote command template: %s", host, err)
+		}
+		delay := poll.delay(attempt)
+		if remaining := time.Until(deadline); remaining < delay {
+			delay = remaining
+		}
+		log.Printf("[DEBUG] attempt %d to reach %s with the remote command template failed, retrying in %s: %s", attempt, host, delay.Round(time.Millisecond), err)
+		err = SleepContext(ctx, delay)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package nix
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestRenderCommandTemplate(t *testing.T) {
+	const command = `echo "it's $HOME" | tr a-z A-Z`
+	for _, tc := range []struct {
+		text     string
+		expected string
+	}{
+		{"ssh {{.User}}@{{.Host}} -- {{.Command}}", `ssh admin@example.com -- 'echo "it'"'"'s $HOME" | tr a-z A-Z'`},
+		{
+			"aws ssm start-session --target {{.Host}} --document-name AWS-StartNonInteractiveCommand --parameters command={{.Command}}",
+			`aws ssm start-session --target example.com --document-name AWS-StartNonInteractiveCommand --parameters command='echo "it'"'"'s $HOME" | tr a-z A-Z'`,
+		},
+		{"run --as {{.User}} -- {{.RawCommand}}", `run --as admin -- echo "it's $HOME" | tr a-z A-Z`},
+	} {
+		got, err := RenderCommandTemplate(tc.text, "admin", "example.com", command)
+		if err != nil {
+			t.Errorf("%q: %s", tc.text, err)
+			continue
+		}
+		if got != tc.expected {
+			t.Errorf("%q:\n got %s\nwant %s", tc.text, got, tc.expected)
+		}
+	}
+
+	for _, text := range []string{"ssh {{.Port}} {{.Command}}", "ssh {{.Host"} {
+		if _, err := RenderCommandTemplate(text, "admin", "example.com", command); err == nil {
+			t.Errorf("%q was rendered", text)
+		}
+	}
+}
+
+func TestTemplateScript(t *testing.T) {
+	// {{.Command}} is the command as a single word for the sh running the
+	// script.
+	script := templateScript("printf '%s\\n' {{.User}} {{.Host}} {{.Command}}", "admin", "example.com", "echo 'a  b' $HOME")
+	out, err := exec.Command("sh", "-c", script).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "admin\nexample.com\necho 'a  b' $HOME\n" {
+		t.Errorf("%s printed %q", script, out)
+	}
+
+	// A template failing to render fails when it is run.
+	script = templateScript("ssh {{.Port}}", "admin", "example.com", "true")
+	out, err = exec.Command("sh", "-c", script).CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "unable to render the command template") {
+		t.Errorf("%s: %v %q", script, err, out)
+	}
+}
+
+func TestCopyShell(t *testing.T) {
+	const command = "nix-store --import"
+	for _, tc := range []struct {
+		cfg      NixosRebuildConfig
+		expected string
+	}{
+		{NixosRebuildConfig{TargetUser: "admin", TargetHost: "example.com", SSHOpts: "-p 2222"}, "ssh -p 2222 admin@example.com -- 'nix-store --import'"},
+		{
+			NixosRebuildConfig{TargetUser: "admin", TargetHost: "example.com", RemoteCommandTemplate: "ssm {{.Host}} {{.Command}}"},
+			"ssm example.com 'nix-store --import'",
+		},
+		// The copy template wins over the remote template.
+		{
+			NixosRebuildConfig{TargetUser: "admin", TargetHost: "example.com", RemoteCommandTemplate: "ssm {{.Host}} {{.Command}}", CopyCommandTemplate: "copy {{.User}} {{.RawCommand}}"},
+			"copy admin nix-store --import",
+		},
+	} {
+		if got := tc.cfg.copyShell(command); got != tc.expected {
+			t.Errorf("%+v:\n got %s\nwant %s", tc.cfg, got, tc.expected)
+		}
+	}
+}
+
+func TestRemoteCommandTemplate(t *testing.T) {
+	cfg := &NixosRebuildConfig{
+		TargetUser:            "admin",
+		TargetHost:            "example.com",
+		RemoteCommandTemplate: "echo {{.User}}@{{.Host}}; sh -c {{.Command}}",
+	}
+	out, err := RunCheck(cfg, `echo "it's here"`, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "admin@example.com\nit's here\n" {
+		t.Errorf("the command ran with the template printed %q", out)
+	}
+}
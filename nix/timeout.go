@@ -0,0 +1,29 @@
+package nix
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// runWithTimeout calls run with a copy of cfg whose commands are stopped,
+// with their whole process groups, once timeout has passed. A zero timeout
+// never stops them.
+func (cfg *NixosRebuildConfig) runWithTimeout(timeout time.Duration, run func(cfg *NixosRebuildConfig) error) error {
+	if timeout <= 0 {
+		return run(cfg)
+	}
+
+	// nix starts builders and nixos-rebuild starts nix, runCancellable
+	// stops them all.
+	ctx, cancel := context.WithTimeout(cfg.context(), timeout)
+	defer cancel()
+	timed := *cfg
+	timed.Context = ctx
+
+	err := run(&timed)
+	if err == ErrTimeout && cfg.context().Err() == nil {
+		return fmt.Errorf("the build exceeded the build timeout of %d seconds and was killed", int(timeout/time.Second))
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+package nix
+
+import (
+	"context"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRunWithTimeout(t *testing.T) {
+	cfg := &NixosRebuildConfig{}
+	cmd := exec.Command("sh", "-c", "sleep 30; true")
+	attrs := &syscall.SysProcAttr{}
+	cmd.SysProcAttr = attrs
+
+	start := time.Now()
+	err := cfg.runWithTimeout(200*time.Millisecond, func(cfg *NixosRebuildConfig) error {
+		return cfg.runCommand(cmd, ioutil.Discard)
+	})
+	if err == nil || !strings.Contains(err.Error(), "exceeded the build timeout") {
+		t.Fatalf("expected the build timeout, got %v", err)
+	}
+	if waited := time.Since(start); waited > 5*time.Second {
+		t.Fatalf("the command ran for %s", waited)
+	}
+	// The attributes of the command are kept, its group is added.
+	if cmd.SysProcAttr != attrs || !attrs.Setpgid {
+		t.Fatalf("unexpected process attributes %+v", cmd.SysProcAttr)
+	}
+}
+
+func TestRunWithTimeoutContextDone(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	cfg := &NixosRebuildConfig{Context: ctx}
+
+	// The resource timing out is not the build timing out.
+	err := cfg.runWithTimeout(time.Hour, func(cfg *NixosRebuildConfig) error {
+		return cfg.runCommand(exec.Command("sleep", "30"), ioutil.Discard)
+	})
+	if err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+}
+
+func TestRunWithoutTimeout(t *testing.T) {
+	cfg := &NixosRebuildConfig{}
+	err := cfg.runWithTimeout(0, func(cfg *NixosRebuildConfig) error {
+		return cfg.runCommand(exec.Command("sh", "-c", "exit 3"), ioutil.Discard)
+	})
+	if err == nil || !strings.HasPrefix(err.Error(), "exit status 3") {
+		t.Fatalf("expected the command to fail, got %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package nix
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// UnitChanges are the systemd units switch-to-configuration would change.
+type UnitChanges struct {
+	Stop    []string
+	Restart []string
+	Reload  []string
+	Start   []string
+	// Other holds the lines of the dry-activate output that could not be
+	// classified, as they were printed.
+	Other []string
+}
+
+// unitChangeRegexp matches the unit lists printed by dry-activate, such as
+// "would restart the following units: nginx.service, sshd.service". Older
+// and newer releases word these slightly differently.
+var unitChangeRegexp = regexp.MustCompile(`^would (stop|restart|reload|start) (?:the )?following (?:systemd )?units?: *(.*)$`)
+
+// parseUnitChanges classifies the output of switch-to-configuration
+// dry-activate.
+func parseUnitChanges(output string) *UnitChanges {
+	changes := &UnitChanges{}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		m := unitChangeRegexp.FindStringSubmatch(strings.ToLower(line))
+		if m == nil {
+			if strings.HasPrefix(line, "would ") {
+				changes.Other = append(changes.Other, line)
+			}
+			continue
+		}
+		var units []string
+		for _, unit := range strings.Split(m[2], ",") {
+			if unit = strings.TrimSpace(unit); unit != "" {
+				units = append(units, unit)
+			}
+		}
+		switch m[1] {
+		case "stop":
+			changes.Stop = append(changes.Stop, units...)
+		case "restart":
+			changes.Restart = append(changes.Restart, units...)
+		case "reload":
+			changes.Reload = append(changes.Reload, units...)
+		case "start":
+			changes.Start = append(changes.Start, units...)
+		}
+	}
+	return changes
+}
+
+// DryActivate runs switch-to-configuration dry-activate for system on the
+// TargetHost, where it must already have been copied, and returns the unit
+// changes the real switch would make.
+func DryActivate(cfg *NixosRebuildConfig, system string) (*UnitChanges, error) {
+	toplevel := system
+	if cfg.Specialisation != "" {
+		toplevel = fmt.Sprintf("%s/specialisation/%s", system, cfg.Specialisation)
+	}
+	// The changes are printed on stderr.
+	output := bytes.NewBuffer(nil)
+	err := cfg.runRemote("dry activation", cfg.rootSSHCommand(shellQuote(toplevel+"/bin/switch-to-configuration")+" dry-activate 2>&1"), output)
+	if err != nil {
+		return nil, formatChildErr(err)
+	}
+	return parseUnitChanges(output.String()), nil
+}
+
+// reportUnitChanges records the unit changes switching to system will make
+// in cfg.Report, a failure to find them does not stop the switch.
+func reportUnitChanges(cfg *NixosRebuildConfig, system string) {
+	changes, err := DryActivate(cfg, system)
+	if err != nil {
+		log.Printf("[WARN] unable to find the units %s will change: %s", cfg.TargetHost, err)
+		return
+	}
+	log.Printf("[INFO] switching %s stops %v, restarts %v, reloads %v and starts %v", cfg.TargetHost, changes.Stop, changes.Restart, changes.Reload, changes.Start)
+	for _, line := range changes.Other {
+		log.Printf("[INFO] switching %s: %s", cfg.TargetHost, line)
+	}
+	if cfg.Report != nil {
+		cfg.Report.Units = changes
+	}
+}
@@ -3,21 +3,166 @@ package main
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
+	"github.com/andrewchambers/terraform-provider-nix/nix"
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
 )
 
 // Provider creates the root nix terraform provider.
 func Provider() *schema.Provider {
-	return &schema.Provider{
+	p := &schema.Provider{
+		Schema: map[string]*schema.Schema{
+			"dry_run": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"use_new_cli": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"experimental_features": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			"max_jobs": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      0,
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"cores": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      0,
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"nix_binary": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"nix_build_binary": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"nixos_rebuild_binary": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"required_nix_version": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"plan_mode": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "build",
+				ValidateFunc: validation.StringInSlice([]string{"build", "defer"}, false),
+			},
+			"max_concurrent_builds": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      2,
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+		},
+		ConfigureFunc: providerConfigure,
 		DataSourcesMap: map[string]*schema.Resource{
-			"nix_build": dataSourceNixBuild(),
+			"nix_build":        dataSourceNixBuild(),
+			"nix_nixos_system": dataSourceNixOSSystem(),
+			"nix_eval":         dataSourceNixEval(),
 		},
 		ResourcesMap: map[string]*schema.Resource{
-			"nix_nixos": resourceNixOS(),
-			"nix_build": resourceNixBuild(),
+			"nix_nixos":            resourceNixOS(),
+			"nix_build":            resourceNixBuild(),
+			"nix_nixos_rollback":   resourceNixOSRollback(),
+			"nix_nixos_activation": resourceNixOSActivation(),
+			"nix_copy":             resourceNixCopy(),
+			"nix_gc_root":          resourceNixGCRoot(),
+			"nix_gc":               resourceNixGC(),
+			"nix_cache_push":       resourceNixCachePush(),
 		},
 	}
+	// Interrupting terraform stops the commands the resources run.
+	nix.SetStopContext(p.StopContext())
+	go func() {
+		<-p.StopContext().Done()
+		closeSSHMasters()
+	}()
+	return p
+}
+
+// providerConfig is the provider wide configuration passed to resources as meta.
+type providerConfig struct {
+	DryRun               bool
+	ExperimentalFeatures []string
+	UseNewCLI            bool
+	// MaxJobs and Cores are defaults for resources that don't set their own,
+	// zero leaves the nix configuration alone.
+	MaxJobs  int
+	Cores    int
+	PlanMode string
+	// builds deduplicates identical system builds between resources.
+	builds *buildGroup
+	// preBuildHooks records the pre_build_hooks that have run.
+	preBuildHooks *runOnce
+}
+
+func providerConfigure(d *schema.ResourceData) (interface{}, error) {
+	nix.SetMaxConcurrentBuilds(d.Get("max_concurrent_builds").(int))
+	nix.SetBinaries(nix.Binaries{
+		Nix:          d.Get("nix_binary").(string),
+		NixBuild:     d.Get("nix_build_binary").(string),
+		NixosRebuild: d.Get("nixos_rebuild_binary").(string),
+	})
+
+	_, nixosRebuild := d.GetOk("nixos_rebuild_binary")
+	err := nix.CheckBinaries(nixosRebuild)
+	if err != nil {
+		return nil, err
+	}
+
+	if constraint, ok := d.GetOk("required_nix_version"); ok {
+		err := nix.CheckNixVersion(constraint.(string))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &providerConfig{
+		DryRun:               d.Get("dry_run").(bool),
+		ExperimentalFeatures: stringList(d.Get("experimental_features")),
+		UseNewCLI:            d.Get("use_new_cli").(bool),
+		MaxJobs:              d.Get("max_jobs").(int),
+		Cores:                d.Get("cores").(int),
+		PlanMode:             d.Get("plan_mode").(string),
+		builds:               newBuildGroup(),
+		preBuildHooks:        newRunOnce(),
+	}, nil
+}
+
+// getProviderConfig returns the provider configuration from a resource meta
+// value, which may be nil if the provider was not configured.
+func getProviderConfig(m interface{}) *providerConfig {
+	if cfg, ok := m.(*providerConfig); ok && cfg != nil {
+		return cfg
+	}
+	return &providerConfig{}
+}
+
+// intOrDefault returns v, or def if v is zero.
+func intOrDefault(v interface{}, def int) int {
+	if i := v.(int); i != 0 {
+		return i
+	}
+	return def
 }
 
 func randomID() string {
@@ -29,6 +174,69 @@ func randomID() string {
 	return hex.EncodeToString(b)
 }
 
+func stringList(v interface{}) []string {
+	var l []string
+	for _, v := range v.([]interface{}) {
+		l = append(l, v.(string))
+	}
+	return l
+}
+
+func stringMap(v interface{}) map[string]string {
+	m := make(map[string]string)
+	for k, v := range v.(map[string]interface{}) {
+		m[k] = v.(string)
+	}
+	return m
+}
+
+// getNixPath returns the NIX_PATH for a resource, either from nix_path or
+// from the environment, or the nix_path_entries replacing it as name=path
+// entries for -I flags. Relative paths in nix_path_entries are made
+// absolute.
+func getNixPath(d resourceLike, baseDir string) (string, []string, error) {
+	if p, ok := d.GetOk("nix_path"); ok {
+		return p.(string), nil, nil
+	}
+
+	entries := stringMap(d.Get("nix_path_entries"))
+	if len(entries) == 0 {
+		return os.Getenv("NIX_PATH"), nil, nil
+	}
+
+	var nixPath []string
+	for _, name := range sortedKeys(entries) {
+		p := entries[name]
+		if !strings.Contains(p, "://") {
+			var err error
+			p, err = absPath(baseDir, p)
+			if err != nil {
+				return "", nil, err
+			}
+		}
+		nixPath = append(nixPath, name+"="+p)
+	}
+	return "", nixPath, nil
+}
+
+// absPath makes p absolute, resolving relative paths against baseDir if
+// it is set, or the working directory otherwise.
+func absPath(baseDir, p string) (string, error) {
+	if baseDir != "" && !filepath.IsAbs(p) {
+		p = filepath.Join(baseDir, p)
+	}
+	return filepath.Abs(p)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 type resourceLike interface {
 	GetOk(string) (interface{}, bool)
 	Get(string) interface{}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func TestGetNixPath(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		raw      map[string]interface{}
+		nixPath  string
+		entries  []string
+		baseDir  string
+		expected []string
+	}{
+		{
+			name:    "nix_path",
+			raw:     map[string]interface{}{"nix_path": "nixpkgs=/src/nixpkgs:/src/channels"},
+			nixPath: "nixpkgs=/src/nixpkgs:/src/channels",
+		},
+		{
+			name: "entries",
+			raw: map[string]interface{}{"nix_path_entries": map[string]interface{}{
+				"nixpkgs":        "https://github.com/NixOS/nixpkgs/archive/nixos-21.05.tar.gz",
+				"nixos-config":   "./configuration.nix",
+				"nixos-hardware": "/src/nixos-hardware",
+			}},
+			// Sorted, made absolute, and the urls keep their colons.
+			entries: []string{
+				"nixos-config=" + wd + "/configuration.nix",
+				"nixos-hardware=/src/nixos-hardware",
+				"nixpkgs=https://github.com/NixOS/nixpkgs/archive/nixos-21.05.tar.gz",
+			},
+		},
+		{
+			name:    "entries in config_dir",
+			raw:     map[string]interface{}{"nix_path_entries": map[string]interface{}{"nixpkgs": "nixpkgs"}},
+			baseDir: "/deploy",
+			entries: []string{"nixpkgs=/deploy/nixpkgs"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := schema.TestResourceDataRaw(t, resourceNixOS().Schema, tc.raw)
+			nixPath, entries, err := getNixPath(d, tc.baseDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if nixPath != tc.nixPath || !reflect.DeepEqual(entries, tc.entries) {
+				t.Fatalf("got %q and %q, expected %q and %q", nixPath, entries, tc.nixPath, tc.entries)
+			}
+		})
+	}
+}
@@ -45,10 +45,13 @@ func resourceNixBuild() *schema.Resource {
 }
 
 type nixBuildResourceConfig struct {
-	Expression     string
-	ExpressionPath string
-	NixPath        string
-	OutLink        string
+	Expression           string
+	ExpressionPath       string
+	NixPath              string
+	OutLink              string
+	ExperimentalFeatures []string
+	MaxJobs              int
+	Cores                int
 }
 
 func (cfg *nixBuildResourceConfig) DoBuild() (string, error) {
@@ -75,10 +78,10 @@ func (cfg *nixBuildResourceConfig) doBuild(outLink *string) (string, error) {
 		}
 	}
 
-	return nix.BuildExpression(cfg.NixPath, cfg.ExpressionPath, outLink)
+	return nix.BuildExpression(cfg.NixPath, cfg.ExpressionPath, outLink, cfg.ExperimentalFeatures, cfg.MaxJobs, cfg.Cores)
 }
 
-func getBuildConfig(d resourceLike) (nixBuildResourceConfig, error) {
+func getBuildConfig(d resourceLike, m interface{}) (nixBuildResourceConfig, error) {
 
 	nixPath := os.Getenv("NIX_PATH")
 	if p, ok := d.GetOk("nix_path"); ok {
@@ -100,10 +103,13 @@ func getBuildConfig(d resourceLike) (nixBuildResourceConfig, error) {
 	}
 
 	return nixBuildResourceConfig{
-		NixPath:        nixPath,
-		Expression:     expression.(string),
-		ExpressionPath: expressionPath,
-		OutLink:        outLink,
+		NixPath:              nixPath,
+		Expression:           expression.(string),
+		ExpressionPath:       expressionPath,
+		OutLink:              outLink,
+		ExperimentalFeatures: getProviderConfig(m).ExperimentalFeatures,
+		MaxJobs:              getProviderConfig(m).MaxJobs,
+		Cores:                getProviderConfig(m).Cores,
 	}, nil
 }
 
@@ -114,7 +120,7 @@ func resourceNixBuildCreateUpdate(d *schema.ResourceData, m interface{}) error {
 		d.SetId(randomID())
 	}
 
-	cfg, err := getBuildConfig(d)
+	cfg, err := getBuildConfig(d, m)
 	if err != nil {
 		return err
 	}
@@ -157,7 +163,7 @@ func resourceNixBuildCreateUpdate(d *schema.ResourceData, m interface{}) error {
 
 func resourceNixBuildRead(d *schema.ResourceData, m interface{}) error {
 
-	cfg, err := getBuildConfig(d)
+	cfg, err := getBuildConfig(d, m)
 	if err != nil {
 		return err
 	}
@@ -176,7 +182,7 @@ func resourceNixBuildRead(d *schema.ResourceData, m interface{}) error {
 }
 
 func resourceNixBuildDelete(d *schema.ResourceData, m interface{}) error {
-	cfg, err := getBuildConfig(d)
+	cfg, err := getBuildConfig(d, m)
 	if err != nil {
 		return err
 	}
@@ -197,7 +203,7 @@ func resourceNixBuildDelete(d *schema.ResourceData, m interface{}) error {
 }
 
 func resourceNixBuildExists(d *schema.ResourceData, m interface{}) (bool, error) {
-	cfg, err := getBuildConfig(d)
+	cfg, err := getBuildConfig(d, m)
 	if err != nil {
 		return false, err
 	}
@@ -221,7 +227,7 @@ func resourceNixBuildCustomizeDiff(d *schema.ResourceDiff, m interface{}) error
 		return nil
 	}
 
-	cfg, err := getBuildConfig(d)
+	cfg, err := getBuildConfig(d, m)
 	if err != nil {
 		return err
 	}
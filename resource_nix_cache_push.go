@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+// A store path uploaded to a binary cache, so hosts can substitute it.
+func resourceNixCachePush() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceNixCachePushCreateUpdate,
+		Update: resourceNixCachePushCreateUpdate,
+		Read:   resourceNixCachePushRead,
+		Delete: resourceNixCachePushDelete,
+
+		Schema: map[string]*schema.Schema{
+			"store_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"cache_url": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"tool": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "nix",
+				ValidateFunc: validation.StringInSlice([]string{"nix", "attic", "cachix"}, false),
+			},
+			"cache_name": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"signing_key_file": &schema.Schema{
+				Type:      schema.TypeString,
+				Optional:  true,
+				Sensitive: true,
+			},
+			"auth_token_env": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"availability_timeout": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      300,
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+		},
+	}
+}
+
+type nixCachePushConfig struct {
+	StorePath           string
+	Push                *nix.CachePush
+	Token               string
+	AvailabilityTimeout time.Duration
+}
+
+func getNixCachePushConfig(d resourceLike) (*nixCachePushConfig, error) {
+	cfg := &nixCachePushConfig{
+		StorePath: d.Get("store_path").(string),
+		Push: &nix.CachePush{
+			URL:            d.Get("cache_url").(string),
+			SigningKeyFile: d.Get("signing_key_file").(string),
+			Tool:           d.Get("tool").(string),
+			Name:           d.Get("cache_name").(string),
+		},
+		AvailabilityTimeout: time.Duration(d.Get("availability_timeout").(int)) * time.Second,
+	}
+
+	if cfg.Push.Tool != "nix" && cfg.Push.Name == "" {
+		return nil, fmt.Errorf("cache_name must be set when pushing with %s", cfg.Push.Tool)
+	}
+	if cfg.Push.Tool != "nix" && cfg.Push.SigningKeyFile != "" {
+		return nil, fmt.Errorf("signing_key_file is only used with tool = \"nix\", %s signs paths itself", cfg.Push.Tool)
+	}
+
+	if name, ok := d.GetOk("auth_token_env"); ok {
+		cfg.Token = os.Getenv(name.(string))
+		if cfg.Token == "" {
+			return nil, fmt.Errorf("the auth_token_env variable %s is not set", name)
+		}
+		if cfg.Push.Tool == "cachix" {
+			cfg.Push.Env = []string{"CACHIX_AUTH_TOKEN=" + cfg.Token}
+		}
+	}
+
+	return cfg, nil
+}
+
+func resourceNixCachePushCreateUpdate(d *schema.ResourceData, m interface{}) error {
+	cfg, err := getNixCachePushConfig(d)
+	if err != nil {
+		return err
+	}
+
+	providerConfig := getProviderConfig(m)
+	err = nix.PushToCache(&nix.NixosRebuildConfig{
+		ExperimentalFeatures: providerConfig.ExperimentalFeatures,
+		PostBuildPush:        cfg.Push,
+	}, cfg.StorePath)
+	if err != nil {
+		return err
+	}
+
+	// Caches may take a while to make uploads available.
+	deadline := time.Now().Add(cfg.AvailabilityTimeout)
+	for {
+		available, err := nix.CacheHasPath(cfg.Push.URL, cfg.StorePath, cfg.Token)
+		if err == nil && available {
+			break
+		}
+		if err != nil {
+			log.Printf("[INFO] unable to check %s for %s: %s", cfg.Push.URL, cfg.StorePath, err)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s was pushed but is not available from %s after %s", cfg.StorePath, cfg.Push.URL, cfg.AvailabilityTimeout)
+		}
+		err = nix.Sleep(5 * time.Second)
+		if err != nil {
+			return err
+		}
+	}
+
+	if d.Id() == "" {
+		d.SetId(randomID())
+	}
+
+	return nil
+}
+
+func resourceNixCachePushRead(d *schema.ResourceData, m interface{}) error {
+	cfg, err := getNixCachePushConfig(d)
+	if err != nil {
+		return err
+	}
+
+	available, err := nix.CacheHasPath(cfg.Push.URL, cfg.StorePath, cfg.Token)
+	if err != nil {
+		// Leave the state alone while the cache is unreachable.
+		log.Printf("[WARN] unable to check %s for %s: %s", cfg.Push.URL, cfg.StorePath, err)
+		return nil
+	}
+	if !available {
+		log.Printf("[INFO] %s is no longer available from %s, it will be pushed again", cfg.StorePath, cfg.Push.URL)
+		d.SetId("")
+	}
+
+	return nil
+}
+
+func resourceNixCachePushDelete(d *schema.ResourceData, m interface{}) error {
+	// Binary caches have no standard way to delete paths, they are left for
+	// the cache's own garbage collection.
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+// An arbitrary store path copied to a server, such as the output of a
+// nix_build data source.
+func resourceNixCopy() *schema.Resource {
+	return &schema.Resource{
+		Create: withSSHFiles(resourceNixCopyCreateUpdate),
+		Update: withSSHFiles(resourceNixCopyCreateUpdate),
+		Read:   withSSHFiles(resourceNixCopyRead),
+		Delete: withSSHFiles(resourceNixCopyDelete),
+
+		Schema: sshSchema(map[string]*schema.Schema{
+			"store_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"target_host": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			"target_user": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "root",
+				ForceNew: true,
+			},
+			"target_port": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      22,
+				ValidateFunc: validation.IntBetween(1, 65535),
+			},
+			"ssh_opts": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "-o StrictHostKeyChecking=accept-new -o BatchMode=yes",
+			},
+			"ssh_timeout": &schema.Schema{
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  180,
+			},
+			"check_sigs": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+			},
+			"gc_root": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+			},
+		}, false),
+	}
+}
+
+func getNixCopyConfig(d resourceLike) *nix.NixosRebuildConfig {
+	target := getSSHTarget(d, d.Get("ssh_opts").(string))
+	return &nix.NixosRebuildConfig{
+		TargetHost:            target.Host,
+		TargetUser:            target.User,
+		SSHOpts:               target.SSHOpts,
+		Transport:             target.Transport,
+		SSHPassword:           target.Password,
+		SSHRetries:            target.Retries,
+		Escalation:            target.Escalation,
+		EscalationFlags:       target.EscalationFlags,
+		RemoteTempDir:         target.TempDir,
+		CommandTimeout:        target.CommandTimeout,
+		RemoteCommandTemplate: target.CommandTemplate,
+		CopyCommandTemplate:   target.CopyTemplate,
+		UseSubstitutes:        true,
+		NoCheckSigs:           !d.Get("check_sigs").(bool),
+	}
+}
+
+// copyGCRoot is the root protecting the path copied by a nix_copy resource.
+func copyGCRoot(id string) string {
+	return nix.RemoteGCRoot("copy-" + id)
+}
+
+func resourceNixCopyCreateUpdate(d *schema.ResourceData, m interface{}) error {
+	id := d.Id()
+	if id == "" {
+		d.SetId(randomID())
+	}
+
+	cfg := getNixCopyConfig(d)
+	storePath := d.Get("store_path").(string)
+
+	err := waitForSSH(context.Background(), d, cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts, time.Duration(d.Get("ssh_timeout").(int))*time.Second)
+	if err != nil {
+		return err
+	}
+
+	err = nix.CopyClosure(cfg, storePath)
+	if err != nil {
+		return err
+	}
+
+	if d.Get("gc_root").(bool) {
+		err = nix.AddRemoteGCRoot(cfg, copyGCRoot(d.Id()), storePath)
+	} else if d.HasChange("gc_root") {
+		err = nix.RemoveRemoteGCRoot(cfg, copyGCRoot(d.Id()))
+	}
+	if err != nil {
+		return err
+	}
+
+	return resourceNixCopyRead(d, m)
+}
+
+func resourceNixCopyRead(d *schema.ResourceData, m interface{}) error {
+	cfg := getNixCopyConfig(d)
+
+	// Leave the state alone while the target is unreachable.
+	err := waitForSSH(context.Background(), d, cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts, time.Duration(d.Get("ssh_timeout").(int))*time.Second)
+	if err != nil {
+		return nil
+	}
+
+	storePath := d.Get("store_path").(string)
+	valid, err := nix.RemotePathValid(cfg, storePath)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		log.Printf("[INFO] %s no longer has %s, it will be copied again", cfg.TargetHost, storePath)
+		d.SetId("")
+	}
+
+	return nil
+}
+
+func resourceNixCopyDelete(d *schema.ResourceData, m interface{}) error {
+	if !d.Get("gc_root").(bool) {
+		return nil
+	}
+
+	cfg := getNixCopyConfig(d)
+	err := waitForSSH(context.Background(), d, cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts, time.Duration(d.Get("ssh_timeout").(int))*time.Second)
+	if err != nil {
+		return err
+	}
+	return nix.RemoveRemoteGCRoot(cfg, copyGCRoot(d.Id()))
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+// A garbage collection of a server, run again whenever its options or
+// triggers change.
+func resourceNixGC() *schema.Resource {
+	return &schema.Resource{
+		Create: withSSHFiles(resourceNixGCCreateUpdate),
+		Update: withSSHFiles(resourceNixGCCreateUpdate),
+		Read:   resourceNixGCRead,
+		Delete: resourceNixGCDelete,
+
+		Schema: sshSchema(map[string]*schema.Schema{
+			"target_host": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			"target_user": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "root",
+			},
+			"target_port": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      22,
+				ValidateFunc: validation.IntBetween(1, 65535),
+			},
+			"ssh_opts": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "-o StrictHostKeyChecking=accept-new -o BatchMode=yes",
+			},
+			"ssh_timeout": &schema.Schema{
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  180,
+			},
+			"keep_generations": &schema.Schema{
+				Type:          schema.TypeInt,
+				Optional:      true,
+				ValidateFunc:  validation.IntAtLeast(1),
+				ConflictsWith: []string{"delete_older_than"},
+			},
+			"delete_older_than": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validation.StringMatch(gcAgeRegexp, "must be a number of days like 14d"),
+			},
+			"max_freed_bytes": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validateByteSize,
+			},
+			"triggers": &schema.Schema{
+				Type:     schema.TypeMap,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			"freed_bytes": &schema.Schema{
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+			"collected_at": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+		}, false),
+	}
+}
+
+func getNixGCConfig(d resourceLike) (*nix.NixosRebuildConfig, error) {
+	var maxFreed int64
+	if size := d.Get("max_freed_bytes").(string); size != "" {
+		var err error
+		maxFreed, err = parseByteSize(size)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	target := getSSHTarget(d, d.Get("ssh_opts").(string))
+	return &nix.NixosRebuildConfig{
+		TargetHost:            target.Host,
+		TargetUser:            target.User,
+		SSHOpts:               target.SSHOpts,
+		Transport:             target.Transport,
+		SSHPassword:           target.Password,
+		SSHRetries:            target.Retries,
+		Escalation:            target.Escalation,
+		EscalationFlags:       target.EscalationFlags,
+		RemoteTempDir:         target.TempDir,
+		CommandTimeout:        target.CommandTimeout,
+		RemoteCommandTemplate: target.CommandTemplate,
+		CopyCommandTemplate:   target.CopyTemplate,
+		GC: nix.GCOptions{
+			KeepGenerations: d.Get("keep_generations").(int),
+			DeleteOlderThan: d.Get("delete_older_than").(string),
+			MaxFreed:        maxFreed,
+		},
+	}, nil
+}
+
+func resourceNixGCCreateUpdate(d *schema.ResourceData, m interface{}) error {
+	cfg, err := getNixGCConfig(d)
+	if err != nil {
+		return err
+	}
+
+	err = waitForSSH(context.Background(), d, cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts, time.Duration(d.Get("ssh_timeout").(int))*time.Second)
+	if err != nil {
+		return err
+	}
+
+	freed, err := nix.CollectGarbage(cfg)
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] garbage collection on %s freed %s", cfg.TargetHost, formatBytes(freed))
+
+	if d.Id() == "" {
+		d.SetId(randomID())
+	}
+
+	err = d.Set("freed_bytes", int(freed))
+	if err != nil {
+		return err
+	}
+	return d.Set("collected_at", time.Now().UTC().Format(time.RFC3339))
+}
+
+// resourceNixGCRead leaves the state alone, there is nothing on the target
+// to compare it with.
+func resourceNixGCRead(d *schema.ResourceData, m interface{}) error {
+	return nil
+}
+
+// resourceNixGCDelete only forgets the collection, it can't be undone.
+func resourceNixGCDelete(d *schema.ResourceData, m interface{}) error {
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+var gcRootNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// A gc root on a server protecting a store path from its garbage collection.
+func resourceNixGCRoot() *schema.Resource {
+	return &schema.Resource{
+		Create: withSSHFiles(resourceNixGCRootCreateUpdate),
+		Update: withSSHFiles(resourceNixGCRootCreateUpdate),
+		Read:   withSSHFiles(resourceNixGCRootRead),
+		Delete: withSSHFiles(resourceNixGCRootDelete),
+
+		Schema: sshSchema(map[string]*schema.Schema{
+			"store_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"name": &schema.Schema{
+				Type:         schema.TypeString,
+				Required:     true,
+				ForceNew:     true,
+				ValidateFunc: validation.StringMatch(gcRootNameRegexp, "must only contain letters, digits, '.', '_' and '-'"),
+			},
+			"target_host": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			"target_user": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "root",
+				ForceNew: true,
+			},
+			"target_port": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      22,
+				ValidateFunc: validation.IntBetween(1, 65535),
+			},
+			"ssh_opts": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "-o StrictHostKeyChecking=accept-new -o BatchMode=yes",
+			},
+			"ssh_timeout": &schema.Schema{
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  180,
+			},
+			"root": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+		}, false),
+	}
+}
+
+func getNixGCRootConfig(d resourceLike) *nix.NixosRebuildConfig {
+	target := getSSHTarget(d, d.Get("ssh_opts").(string))
+	return &nix.NixosRebuildConfig{
+		TargetHost:            target.Host,
+		TargetUser:            target.User,
+		SSHOpts:               target.SSHOpts,
+		Transport:             target.Transport,
+		SSHPassword:           target.Password,
+		SSHRetries:            target.Retries,
+		Escalation:            target.Escalation,
+		EscalationFlags:       target.EscalationFlags,
+		RemoteTempDir:         target.TempDir,
+		CommandTimeout:        target.CommandTimeout,
+		RemoteCommandTemplate: target.CommandTemplate,
+		CopyCommandTemplate:   target.CopyTemplate,
+	}
+}
+
+func resourceNixGCRootCreateUpdate(d *schema.ResourceData, m interface{}) error {
+	cfg := getNixGCRootConfig(d)
+	storePath := d.Get("store_path").(string)
+	root := nix.RemoteGCRoot(d.Get("name").(string))
+
+	err := waitForSSH(context.Background(), d, cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts, time.Duration(d.Get("ssh_timeout").(int))*time.Second)
+	if err != nil {
+		return err
+	}
+
+	// A root pointing at a missing path would protect nothing.
+	valid, err := nix.RemotePathValid(cfg, storePath)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return fmt.Errorf("%s is not in the store of %s, copy it there first", storePath, cfg.TargetHost)
+	}
+
+	err = nix.AddRemoteGCRoot(cfg, root, storePath)
+	if err != nil {
+		return err
+	}
+
+	if d.Id() == "" {
+		d.SetId(randomID())
+	}
+
+	err = d.Set("root", root)
+	if err != nil {
+		return err
+	}
+
+	return resourceNixGCRootRead(d, m)
+}
+
+func resourceNixGCRootRead(d *schema.ResourceData, m interface{}) error {
+	cfg := getNixGCRootConfig(d)
+
+	// Leave the state alone while the target is unreachable.
+	err := waitForSSH(context.Background(), d, cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts, time.Duration(d.Get("ssh_timeout").(int))*time.Second)
+	if err != nil {
+		return nil
+	}
+
+	root := nix.RemoteGCRoot(d.Get("name").(string))
+	target, err := nix.RemoteGCRootTarget(cfg, root)
+	if err != nil {
+		return err
+	}
+	if target == "" {
+		log.Printf("[INFO] gc root %s is missing on %s", root, cfg.TargetHost)
+		d.SetId("")
+		return nil
+	}
+
+	valid, err := nix.RemotePathValid(cfg, target)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		log.Printf("[INFO] %s pointed at by gc root %s is missing on %s", target, root, cfg.TargetHost)
+		d.SetId("")
+		return nil
+	}
+
+	return d.Set("store_path", target)
+}
+
+func resourceNixGCRootDelete(d *schema.ResourceData, m interface{}) error {
+	cfg := getNixGCRootConfig(d)
+	err := waitForSSH(context.Background(), d, cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts, time.Duration(d.Get("ssh_timeout").(int))*time.Second)
+	if err != nil {
+		return err
+	}
+	return nix.RemoveRemoteGCRoot(cfg, nix.RemoteGCRoot(d.Get("name").(string)))
+}
@@ -1,25 +1,42 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/andrewchambers/terraform-provider-nix/nix"
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
 )
 
 // A nixos server somewhere in the ether.
 func resourceNixOS() *schema.Resource {
 	return &schema.Resource{
-		Create:        resourceNixOSCreateUpdate,
-		Update:        resourceNixOSCreateUpdate,
-		Read:          resourceNixOSRead,
-		Delete:        resourceNixOSDelete,
-		CustomizeDiff: resourceNixOSCustomizeDiff,
+		Create:        withSSHFiles(resourceNixOSCreateUpdate),
+		Update:        withSSHFiles(resourceNixOSCreateUpdate),
+		Read:          withSSHFiles(resourceNixOSRead),
+		Delete:        withSSHFiles(resourceNixOSDelete),
+		CustomizeDiff: withSSHFilesDiff(resourceNixOSCustomizeDiff),
 
-		Schema: map[string]*schema.Schema{
+		// Builds can take long, the defaults only catch runaway applies.
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(2 * time.Hour),
+			Update: schema.DefaultTimeout(2 * time.Hour),
+			Read:   schema.DefaultTimeout(10 * time.Minute),
+		},
+
+		Schema: sshSchema(map[string]*schema.Schema{
 			"target_host": &schema.Schema{
 				Type:     schema.TypeString,
 				Required: true,
@@ -29,18 +46,203 @@ func resourceNixOS() *schema.Resource {
 				Optional: true,
 				Default:  "root",
 			},
+			"target_port": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      22,
+				ValidateFunc: validation.IntBetween(1, 65535),
+			},
 			"build_host": &schema.Schema{
 				Type:     schema.TypeString,
 				Optional: true,
 				Default:  "localhost",
 			},
 			"nixos_config": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"flake"},
+			},
+			"nixos_config_expr": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"nixos_config", "nixos_config_path", "flake"},
+			},
+			"config_dir": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"log_file": &schema.Schema{
 				Type:     schema.TypeString,
 				Optional: true,
 			},
+			"deployment_log": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"resolved_config_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
 			"nixos_config_path": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"flake"},
+			},
+			"flake": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"nixos_config", "nixos_config_expr", "nixos_config_path"},
+			},
+			"flake_attr": &schema.Schema{
 				Type:     schema.TypeString,
-				Required: true,
+				Optional: true,
+			},
+			"impure": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"experimental_features": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			"extra_nix_options": &schema.Schema{
+				Type:     schema.TypeMap,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			"build_args": &schema.Schema{
+				Type:         schema.TypeMap,
+				Optional:     true,
+				Elem:         &schema.Schema{Type: schema.TypeString},
+				ValidateFunc: validateNixIdentifierKeys,
+			},
+			"build_args_str": &schema.Schema{
+				Type:         schema.TypeMap,
+				Optional:     true,
+				Elem:         &schema.Schema{Type: schema.TypeString},
+				ValidateFunc: validateNixIdentifierKeys,
+			},
+			"lock_file_mode": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "locked",
+				ValidateFunc: validation.StringInSlice([]string{"locked", "update", "no-write"}, false),
+			},
+			"override_inputs": &schema.Schema{
+				Type:     schema.TypeMap,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			"signing_key_file": &schema.Schema{
+				Type:      schema.TypeString,
+				Optional:  true,
+				Sensitive: true,
+			},
+			"copy_compression": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "none",
+				ValidateFunc: validation.StringInSlice([]string{"none", "ssh", "zstd", "xz"}, false),
+			},
+			"copy_compression_level": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      0,
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"copy_parallelism": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      1,
+				ValidateFunc: validation.IntAtLeast(1),
+			},
+			"check_sigs": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+			},
+			"copy_protocol": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "ssh",
+				ValidateFunc: validation.StringInSlice([]string{"ssh", "ssh-ng"}, false),
+			},
+			"use_substitutes": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+			},
+			"substituters": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			"trusted_public_keys": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type:         schema.TypeString,
+					ValidateFunc: validateTrustedPublicKey,
+				},
+			},
+			"sandbox": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validation.StringInSlice([]string{"true", "false", "relaxed"}, false),
+			},
+			"build_timeout": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      0,
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"keep_going": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"fallback": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"system": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"max_jobs": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      0,
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"cores": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      0,
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"keep_result_gc_root": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"build_on_target": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"builders": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			"builders_use_substitutes": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
 			},
 			"ssh_opts": &schema.Schema{
 				Type:     schema.TypeString,
@@ -48,203 +250,1859 @@ func resourceNixOS() *schema.Resource {
 				Default:  "-o StrictHostKeyChecking=accept-new -o BatchMode=yes",
 			},
 			"nix_path": &schema.Schema{
-				Type:     schema.TypeString,
-				Optional: true,
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"nix_path_entries"},
+			},
+			"nix_path_entries": &schema.Schema{
+				Type:          schema.TypeMap,
+				Optional:      true,
+				Elem:          &schema.Schema{Type: schema.TypeString},
+				ConflictsWith: []string{"nix_path"},
 			},
 			"ssh_timeout": &schema.Schema{
 				Type:     schema.TypeInt,
 				Optional: true,
 				Default:  180,
 			},
+			"wait_for_ssh": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+			},
+			"local": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"switch_action": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "switch",
+				ValidateFunc: validation.StringInSlice([]string{"switch", "boot", "test", "dry-activate"}, false),
+			},
+			"specialisation": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"switch_retries": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      0,
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"deploy_lock": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+			},
+			"lock_timeout": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      300,
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"plan_mode": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validation.StringInSlice([]string{"build", "defer"}, false),
+			},
+			"dry_run": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"rollback_on_failure": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+			},
+			"magic_rollback": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"confirm_timeout": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      300,
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"require_confirmation": &schema.Schema{
+				Type:          schema.TypeBool,
+				Optional:      true,
+				Default:       false,
+				ConflictsWith: []string{"magic_rollback"},
+			},
+			"confirmation_command": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "true",
+			},
+			"confirmation_timeout": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      300,
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"post_build_push": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				MaxItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"cache_url": &schema.Schema{
+							Type:     schema.TypeString,
+							Required: true,
+						},
+						"signing_key_file": &schema.Schema{
+							Type:      schema.TypeString,
+							Optional:  true,
+							Sensitive: true,
+						},
+						"on_push_failure": &schema.Schema{
+							Type:         schema.TypeString,
+							Optional:     true,
+							Default:      "fail",
+							ValidateFunc: validation.StringInSlice([]string{"fail", "warn"}, false),
+						},
+					},
+				},
+			},
+			"health_check": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				MaxItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"command": &schema.Schema{
+							Type:     schema.TypeString,
+							Required: true,
+						},
+						"on_target": &schema.Schema{
+							Type:     schema.TypeBool,
+							Optional: true,
+							Default:  false,
+						},
+						"retries": &schema.Schema{
+							Type:         schema.TypeInt,
+							Optional:     true,
+							Default:      10,
+							ValidateFunc: validation.IntAtLeast(0),
+						},
+						"interval": &schema.Schema{
+							Type:         schema.TypeInt,
+							Optional:     true,
+							Default:      5,
+							ValidateFunc: validation.IntAtLeast(0),
+						},
+					},
+				},
+			},
+			"health_http_url": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"health_http_expected_status": &schema.Schema{
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  200,
+			},
+			"health_http_timeout": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      300,
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"insecure_skip_verify": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"reboot_if_needed": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"reboot_timeout": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      600,
+				ValidateFunc: validation.IntAtLeast(0),
+			},
 			"collect_garbage": &schema.Schema{
 				Type:     schema.TypeBool,
 				Optional: true,
 				Default:  true,
 			},
+			"gc_before_switch": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"on_gc_failure": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "warn",
+				ValidateFunc: validation.StringInSlice([]string{"error", "warn"}, false),
+			},
+			"gc_keep_generations": &schema.Schema{
+				Type:          schema.TypeInt,
+				Optional:      true,
+				ValidateFunc:  validation.IntAtLeast(1),
+				ConflictsWith: []string{"gc_delete_older_than"},
+			},
+			"gc_delete_older_than": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validation.StringMatch(gcAgeRegexp, "must be a number of days like 14d"),
+			},
+			"gc_max_freed_bytes": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validateByteSize,
+			},
+			"gc_freed_bytes": &schema.Schema{
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+			"store_optimise": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"collect_garbage_build_host": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				MaxItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"keep_generations": &schema.Schema{
+							Type:          schema.TypeInt,
+							Optional:      true,
+							ValidateFunc:  validation.IntAtLeast(1),
+							ConflictsWith: []string{"collect_garbage_build_host.0.delete_older_than"},
+						},
+						"delete_older_than": &schema.Schema{
+							Type:         schema.TypeString,
+							Optional:     true,
+							ValidateFunc: validation.StringMatch(gcAgeRegexp, "must be a number of days like 14d"),
+						},
+						"delete_generations": &schema.Schema{
+							Type:     schema.TypeBool,
+							Optional: true,
+							Default:  false,
+						},
+						"max_freed_bytes": &schema.Schema{
+							Type:         schema.TypeString,
+							Optional:     true,
+							ValidateFunc: validateByteSize,
+						},
+					},
+				},
+			},
+			"gc_on_low_space": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"required_copy_bytes": &schema.Schema{
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+			"gc_when_used_percent_above": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ValidateFunc: validation.IntBetween(0, 100),
+			},
+			"store_used_percent": &schema.Schema{
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
 			"nixos_system": &schema.Schema{
 				Type:     schema.TypeString,
 				Computed: true,
 			},
-			"pre_switch_hook": &schema.Schema{
+			"flake_lock_hash": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"booted_system": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"needs_reboot": &schema.Schema{
+				Type:     schema.TypeBool,
+				Computed: true,
+			},
+			"copy_skipped": &schema.Schema{
+				Type:     schema.TypeBool,
+				Computed: true,
+			},
+			"bootstrap_user": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"bootstrap_ssh_opts": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"connected_user": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"closure_size_bytes": &schema.Schema{
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+			"change_summary": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"report_unit_changes": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"units_to_restart": &schema.Schema{
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			"units_to_stop": &schema.Schema{
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			"units_to_reload": &schema.Schema{
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			"pre_build_hook": &schema.Schema{
 				Type:      schema.TypeString,
 				Optional:  true,
 				Default:   "",
 				Sensitive: true,
 			},
+			"pre_switch_hook": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				Default:       "",
+				Sensitive:     true,
+				ConflictsWith: []string{"pre_switch_hooks", "pre_switch"},
+			},
 			"post_switch_hook": &schema.Schema{
-				Type:      schema.TypeString,
-				Optional:  true,
-				Default:   "",
-				Sensitive: true,
+				Type:          schema.TypeString,
+				Optional:      true,
+				Default:       "",
+				Sensitive:     true,
+				ConflictsWith: []string{"post_switch_hooks", "post_switch"},
+			},
+			"pre_switch_hooks": &schema.Schema{
+				Type:          schema.TypeList,
+				Optional:      true,
+				Sensitive:     true,
+				Elem:          &schema.Schema{Type: schema.TypeString},
+				ConflictsWith: []string{"pre_switch"},
+			},
+			"post_switch_hooks": &schema.Schema{
+				Type:          schema.TypeList,
+				Optional:      true,
+				Sensitive:     true,
+				Elem:          &schema.Schema{Type: schema.TypeString},
+				ConflictsWith: []string{"post_switch"},
+			},
+			"pre_switch":  hookBlockSchema(),
+			"post_switch": hookBlockSchema(),
+			"forward_agent": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+		}, false),
+	}
+}
+
+// hookBlockSchema is the schema of the pre_switch and post_switch blocks,
+// hooks run locally or on the target in the order they are written.
+func hookBlockSchema() *schema.Schema {
+	return &schema.Schema{
+		Type:     schema.TypeList,
+		Optional: true,
+		Elem: &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"command": &schema.Schema{
+					Type:      schema.TypeString,
+					Required:  true,
+					Sensitive: true,
+				},
+				"where": &schema.Schema{
+					Type:         schema.TypeString,
+					Optional:     true,
+					Default:      "local",
+					ValidateFunc: validation.StringInSlice([]string{"local", "remote"}, false),
+				},
 			},
 		},
 	}
 }
 
-type nixosResourceConfig struct {
-	TargetHost      string
-	TargetUser      string
-	BuildHost       string
-	NixosConfig     string
-	NixosConfigPath string
-	CollectGarbage  bool
-	NixPath         string
-	SSHOpts         string
-	PreSwitchHook   string
-	PostSwitchHook  string
-	SSHTimeout      time.Duration
+// getHooks returns the hooks of the attribute name_hook, of its plural list
+// form, or of the name blocks. Hook commands are all sensitive.
+func getHooks(d resourceLike, name string) []nix.Hook {
+	if hook := d.Get(name + "_hook").(string); hook != "" {
+		return []nix.Hook{{Name: name + "_hook", Command: hook, Sensitive: true}}
+	}
+	var hooks []nix.Hook
+	for i, hook := range stringList(d.Get(name + "_hooks")) {
+		hooks = append(hooks, nix.Hook{Name: fmt.Sprintf("%s_hooks[%d]", name, i), Command: hook, Sensitive: true})
+	}
+	for i, v := range d.Get(name).([]interface{}) {
+		block, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		hooks = append(hooks, nix.Hook{
+			Name:      fmt.Sprintf("%s[%d] (%s)", name, i, block["where"]),
+			Command:   block["command"].(string),
+			Sensitive: true,
+			Remote:    block["where"].(string) == "remote",
+		})
+	}
+	return hooks
+}
+
+// switchTriggers are the attributes that require a switch when changed.
+var switchTriggers = []string{
+	"nixos_system",
+	"target_host",
+	"pre_switch_hook",
+	"post_switch_hook",
+	"pre_switch_hooks",
+	"post_switch_hooks",
+	"pre_switch",
+	"post_switch",
+	"switch_action",
+	"specialisation",
+}
+
+// switchNeeded reports whether applying d has to switch the target.
+func switchNeeded(d *schema.ResourceData) bool {
+	for _, k := range switchTriggers {
+		if d.HasChange(k) {
+			return true
+		}
+	}
+	return false
+}
+
+// unknownSkipsBuild are the attributes that can't be planned with while
+// their value is unknown.
+var unknownSkipsBuild = []string{
+	"target_host",
+	"nixos_config_path",
+	"config_dir",
+	"flake",
+	"flake_attr",
+	"nix_path",
+	"nix_path_entries",
+	"build_args",
+	"build_args_str",
+	"override_inputs",
+}
+
+type nixosResourceConfig struct {
+	TargetHost            string
+	TargetUser            string
+	BuildHost             string
+	NixosConfig           string
+	NixosConfigPath       string
+	CollectGarbage        bool
+	GCBeforeSwitch        bool
+	OnGCFailure           string
+	GC                    nix.GCOptions
+	GCUsedPercentAbove    int
+	StoreOptimise         bool
+	GCOnLowSpace          bool
+	BuildHostGC           *nix.GCOptions
+	RollbackOnFailure     bool
+	MagicRollback         bool
+	ConfirmTimeout        time.Duration
+	NixPath               string
+	NixPathEntries        []string
+	SSHOpts               string
+	Transport             string
+	SSHPassword           string
+	SSHRetries            int
+	Escalation            string
+	EscalationFlags       string
+	RemoteTempDir         string
+	CommandTimeout        time.Duration
+	RemoteCommandTemplate string
+	CopyCommandTemplate   string
+	SSHPoll               nix.SSHPoll
+	PreSwitchHooks        []nix.Hook
+	PostSwitchHooks       []nix.Hook
+	PreBuildHook          string
+	preBuildHooks         *runOnce
+	ForwardAgent          bool
+	SwitchAction          string
+	SSHTimeout            time.Duration
+	// Context bounds the operation, from the timeouts of the resource.
+	Context                context.Context
+	WaitForSSH             bool
+	Local                  bool
+	BootstrapUser          string
+	BootstrapSSHOpts       string
+	HealthCheck            *healthCheckConfig
+	HTTPProbe              *httpProbeConfig
+	RebootIfNeeded         bool
+	RebootTimeout          time.Duration
+	Specialisation         string
+	SwitchRetries          int
+	DeployLock             bool
+	LockTimeout            time.Duration
+	RequireConfirmation    bool
+	ConfirmationCommand    string
+	ConfirmationTimeout    time.Duration
+	DryRun                 bool
+	Flake                  string
+	OverrideInputs         map[string]string
+	Impure                 bool
+	ExtraNixOptions        map[string]string
+	BuildArgs              map[string]string
+	BuildArgsStr           map[string]string
+	SystemPath             string
+	ExperimentalFeatures   []string
+	UseNewCLI              bool
+	LockFileMode           string
+	BuildOnTarget          bool
+	PlanMode               string
+	Builders               []string
+	BuildersUseSubstitutes bool
+	MaxJobs                int
+	Cores                  int
+	KeepResultGCRoot       bool
+	GCRoot                 string
+	builds                 *buildGroup
+	System                 string
+	Fallback               bool
+	KeepGoing              bool
+	Log                    io.Writer
+	BuildTimeout           time.Duration
+	Sandbox                string
+	UseSubstitutes         bool
+	CopyProtocol           string
+	SigningKeyFile         string
+	NoCheckSigs            bool
+	PostBuildPush          *nix.CachePush
+	CopyCompression        string
+	CopyCompressionLevel   int
+	CopyParallelism        int
+	Report                 *nix.SwitchReport
+	Substituters           []string
+	TrustedPublicKeys      []string
+	ReportUnitChanges      bool
+}
+
+type healthCheckConfig struct {
+	Command  string
+	OnTarget bool
+	Retries  int
+	Interval time.Duration
+}
+
+func (cfg *nixosResourceConfig) GetRebuildConfig() *nix.NixosRebuildConfig {
+	buildHost := cfg.BuildHost
+	// A local target builds here.
+	if cfg.BuildOnTarget && !cfg.Local {
+		buildHost = fmt.Sprintf("%s@%s", cfg.TargetUser, cfg.TargetHost)
+	}
+
+	return &nix.NixosRebuildConfig{
+		TargetHost:             cfg.TargetHost,
+		TargetUser:             cfg.TargetUser,
+		BuildHost:              buildHost,
+		NixosConfigPath:        cfg.NixosConfigPath,
+		NixPath:                cfg.NixPath,
+		NixPathEntries:         cfg.NixPathEntries,
+		SSHOpts:                cfg.SSHOpts,
+		Transport:              cfg.Transport,
+		SSHPassword:            cfg.SSHPassword,
+		SSHRetries:             cfg.SSHRetries,
+		Escalation:             cfg.Escalation,
+		EscalationFlags:        cfg.EscalationFlags,
+		RemoteTempDir:          cfg.RemoteTempDir,
+		CommandTimeout:         cfg.CommandTimeout,
+		RemoteCommandTemplate:  cfg.RemoteCommandTemplate,
+		CopyCommandTemplate:    cfg.CopyCommandTemplate,
+		Context:                cfg.Context,
+		Local:                  cfg.Local,
+		GC:                     cfg.GC,
+		GCOnLowSpace:           cfg.GCOnLowSpace,
+		SSHPoll:                cfg.SSHPoll,
+		PreSwitchHooks:         cfg.PreSwitchHooks,
+		PreBuildHook:           cfg.PreBuildHook,
+		PostSwitchHooks:        cfg.PostSwitchHooks,
+		ForwardAgent:           cfg.ForwardAgent,
+		SwitchAction:           cfg.SwitchAction,
+		Specialisation:         cfg.Specialisation,
+		SwitchRetries:          cfg.SwitchRetries,
+		Flake:                  cfg.Flake,
+		OverrideInputs:         cfg.OverrideInputs,
+		Impure:                 cfg.Impure,
+		ExtraNixOptions:        cfg.ExtraNixOptions,
+		BuildArgs:              cfg.BuildArgs,
+		BuildArgsStr:           cfg.BuildArgsStr,
+		SystemPath:             cfg.SystemPath,
+		ExperimentalFeatures:   cfg.ExperimentalFeatures,
+		UseNewCLI:              cfg.UseNewCLI,
+		LockFileMode:           cfg.LockFileMode,
+		Builders:               cfg.Builders,
+		BuildersUseSubstitutes: cfg.BuildersUseSubstitutes,
+		System:                 cfg.System,
+		Log:                    cfg.Log,
+		Fallback:               cfg.Fallback,
+		KeepGoing:              cfg.KeepGoing,
+		BuildTimeout:           cfg.BuildTimeout,
+		Sandbox:                cfg.Sandbox,
+		UseSubstitutes:         cfg.UseSubstitutes,
+		Substituters:           cfg.Substituters,
+		TrustedPublicKeys:      cfg.TrustedPublicKeys,
+		CopyProtocol:           cfg.CopyProtocol,
+		SigningKeyFile:         cfg.SigningKeyFile,
+		NoCheckSigs:            cfg.NoCheckSigs,
+		PostBuildPush:          cfg.PostBuildPush,
+		CopyCompression:        cfg.CopyCompression,
+		CopyCompressionLevel:   cfg.CopyCompressionLevel,
+		CopyParallelism:        cfg.CopyParallelism,
+		Report:                 cfg.Report,
+		ReportUnitChanges:      cfg.ReportUnitChanges,
+		MaxJobs:                cfg.MaxJobs,
+		Cores:                  cfg.Cores,
+	}
+}
+
+func (cfg *nixosResourceConfig) writeConfig() error {
+	if cfg.NixosConfig != "" {
+		// Leave an unchanged config alone, the builds of other resources may
+		// be reading it.
+		existing, err := ioutil.ReadFile(cfg.NixosConfigPath)
+		if err == nil && string(existing) == cfg.NixosConfig {
+			return nil
+		}
+		err = os.MkdirAll(filepath.Dir(cfg.NixosConfigPath), 0755)
+		if err != nil {
+			return err
+		}
+		f, err := os.Create(cfg.NixosConfigPath)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write([]byte(cfg.NixosConfig))
+		if err != nil {
+			return err
+		}
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configRef is the resolved configuration being deployed, a flake reference,
+// a store path or an absolute config path.
+func (cfg *nixosResourceConfig) configRef() string {
+	if cfg.Flake != "" {
+		return cfg.Flake
+	}
+	if cfg.SystemPath != "" {
+		return cfg.SystemPath
+	}
+	return cfg.NixosConfigPath
+}
+
+// checkConfigExists returns an error if a config that should already exist on
+// disk is missing, so typos fail at plan time instead of being mistaken for a
+// config that is generated during apply.
+func (cfg *nixosResourceConfig) checkConfigExists() error {
+	if cfg.NixosConfig != "" || cfg.SystemPath != "" {
+		return nil
+	}
+
+	path := cfg.NixosConfigPath
+	if cfg.Flake != "" {
+		flake, _ := nix.SplitFlakeRef(cfg.Flake)
+		flake = strings.TrimPrefix(flake, "path:")
+		if !filepath.IsAbs(flake) {
+			// A remote flake.
+			return nil
+		}
+		path = filepath.Join(flake, "flake.nix")
+	}
+
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("nixos_config: no such file or directory: %s", path)
+	}
+	return nil
+}
+
+// DoPreBuildHook runs the pre_build_hook, unless it already ran for this
+// resource during the terraform operation.
+func (cfg *nixosResourceConfig) DoPreBuildHook() error {
+	if cfg.PreBuildHook == "" {
+		return nil
+	}
+	key := cfg.TargetHost + "\x00" + cfg.configRef() + "\x00" + cfg.PreBuildHook
+	return cfg.preBuildHooks.Do(key, func() error {
+		return nix.RunPreBuildHook(cfg.GetRebuildConfig(), cfg.configRef())
+	})
+}
+
+func (cfg *nixosResourceConfig) DoBuild() (string, error) {
+	err := cfg.DoPreBuildHook()
+	if err != nil {
+		return "", err
+	}
+
+	err = cfg.writeConfig()
+	if err != nil {
+		return "", err
+	}
+
+	rebuildConfig := cfg.GetRebuildConfig()
+
+	// Building on the target is only done while switching, so planning
+	// evaluates the system path instead of building it.
+	if cfg.BuildOnTarget {
+		return cfg.builds.Do("eval:"+rebuildConfig.BuildKey(), func() (string, error) {
+			return nix.EvalSystem(rebuildConfig)
+		})
+	}
+
+	system, err := cfg.builds.Do("build:"+rebuildConfig.BuildKey(), func() (string, error) {
+		return nix.BuildSystem(rebuildConfig)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if cfg.GCRoot != "" {
+		err = nix.AddGCRoot(cfg.GCRoot, system)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = nix.PushToCache(rebuildConfig, system)
+	if err != nil {
+		return "", err
+	}
+
+	return system, nil
+}
+
+// UpdateGCRoot points the local gc root of the resource with the given id at
+// system, or removes it if keep_result_gc_root is not set.
+func (cfg *nixosResourceConfig) UpdateGCRoot(id string, system string) error {
+	root, err := systemGCRoot(id)
+	if err != nil {
+		return err
+	}
+
+	if !cfg.KeepResultGCRoot {
+		return nix.RemoveGCRoot(root)
+	}
+
+	// Systems built on the target, or that failed to switch, may not be in
+	// the local store.
+	if _, err := os.Stat(system); err != nil {
+		return nil
+	}
+	return nix.AddGCRoot(root, system)
+}
+
+// UsePlannedBuild switches to the system built at plan time if it is still
+// in the local store, instead of building it again. The system is found by
+// evaluating it, so any change to the inputs since the plan, including the
+// files the config imports, is built as usual. Deferred plans build nothing,
+// so apply always builds.
+func (cfg *nixosResourceConfig) UsePlannedBuild() error {
+	if cfg.BuildOnTarget || cfg.PlanMode == "defer" || cfg.SystemPath != "" {
+		return nil
+	}
+	err := cfg.writeConfig()
+	if err != nil {
+		return err
+	}
+	system, err := nix.EvalSystem(cfg.GetRebuildConfig())
+	if err != nil {
+		// The switch reports the evaluation error if it is real.
+		log.Printf("[WARN] unable to evaluate the system of %s to find its plan time build: %s", cfg.TargetHost, err)
+		return nil
+	}
+	// The build may have been garbage collected since the plan.
+	if nix.CheckSystemPath(system) != nil {
+		return nil
+	}
+	log.Printf("[INFO] using %s built at plan time", system)
+	cfg.SystemPath = system
+	return nil
+}
+
+func (cfg *nixosResourceConfig) DoSwitch() error {
+	return cfg.doSwitch(nil)
+}
+
+// doSwitch switches the system, calling beforeActivate, if set, once the
+// system is built and copied.
+func (cfg *nixosResourceConfig) doSwitch(beforeActivate func() error) error {
+	err := cfg.writeConfig()
+	if err != nil {
+		return err
+	}
+
+	rebuildConfig := cfg.GetRebuildConfig()
+	rebuildConfig.BeforeActivate = beforeActivate
+	return nix.SwitchSystem(rebuildConfig)
+}
+
+func (cfg *nixosResourceConfig) CurrentSystem() (string, error) {
+	return nix.CurrentSystem(cfg.GetRebuildConfig())
+}
+
+// DoCollectGarbage collects garbage on the target, recording what it freed
+// in gc_freed_bytes, unless its store is at most GCUsedPercentAbove full,
+// then optimises the store with store_optimise. A collection failure only
+// fails the apply with on_gc_failure = "error", otherwise it is logged, as
+// optimisation failures always are.
+func (cfg *nixosResourceConfig) DoCollectGarbage(d *schema.ResourceData) error {
+	if cfg.GCUsedPercentAbove > 0 {
+		used, err := nix.StoreUsedPercent(cfg.GetRebuildConfig())
+		if err != nil {
+			log.Printf("[WARN] collecting garbage on %s without knowing how full its store is: %s", cfg.TargetHost, err)
+		} else {
+			err = d.Set("store_used_percent", used)
+			if err != nil {
+				return err
+			}
+			if used <= cfg.GCUsedPercentAbove {
+				log.Printf("[INFO] the store of %s is %d%% full, at most %d%%, skipping garbage collection", cfg.TargetHost, used, cfg.GCUsedPercentAbove)
+				return nil
+			}
+			log.Printf("[INFO] the store of %s is %d%% full, above %d%%, collecting garbage", cfg.TargetHost, used, cfg.GCUsedPercentAbove)
+		}
+	}
+
+	freed, err := nix.CollectGarbage(cfg.GetRebuildConfig())
+	if err != nil {
+		if err == nix.ErrCancelled || err == nix.ErrTimeout || cfg.OnGCFailure == "error" {
+			return err
+		}
+		log.Printf("[WARN] garbage collection on %s failed: %s", cfg.TargetHost, err)
+		return nil
+	}
+	log.Printf("[INFO] garbage collection on %s freed %s", cfg.TargetHost, formatBytes(freed))
+	err = d.Set("gc_freed_bytes", int(freed))
+	if err != nil {
+		return err
+	}
+
+	if cfg.StoreOptimise {
+		saved, err := nix.OptimiseStore(cfg.GetRebuildConfig())
+		if err == nix.ErrCancelled || err == nix.ErrTimeout {
+			return err
+		}
+		if err != nil {
+			log.Printf("[WARN] optimising the store of %s failed: %s", cfg.TargetHost, err)
+			return nil
+		}
+		log.Printf("[INFO] optimising the store of %s saved %s", cfg.TargetHost, formatBytes(saved))
+	}
+	return nil
+}
+
+// DoCollectBuildHostGarbage collects garbage on the build host with
+// collect_garbage_build_host, keeping system, which has been copied to the
+// target by now. Failures are logged.
+func (cfg *nixosResourceConfig) DoCollectBuildHostGarbage(system string) error {
+	if cfg.BuildHostGC == nil {
+		return nil
+	}
+	if cfg.BuildOnTarget {
+		log.Printf("[INFO] %s builds its own system, skipping garbage collection on the build host", cfg.TargetHost)
+		return nil
+	}
+	freed, err := nix.CollectBuildHostGarbage(cfg.GetRebuildConfig(), *cfg.BuildHostGC, system)
+	if err == nix.ErrCancelled || err == nix.ErrTimeout {
+		return err
+	}
+	if err != nil {
+		log.Printf("[WARN] garbage collection on the build host %s failed: %s", cfg.BuildHost, err)
+		return nil
+	}
+	log.Printf("[INFO] garbage collection on the build host %s freed %s", cfg.BuildHost, formatBytes(freed))
+	return nil
+}
+
+// DoDeploySwitch switches the target to the new system, reboots and checks
+// it, rolling back if that fails with rollback_on_failure. The deployment
+// lock is held throughout, so no other deployer switches the target before
+// a rollback.
+func (cfg *nixosResourceConfig) DoDeploySwitch(d *schema.ResourceData) error {
+	if cfg.DeployLock {
+		// Nothing has changed yet, a held lock never rolls back.
+		lock, err := nix.AcquireLock(cfg.GetRebuildConfig(), cfg.LockTimeout)
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+	}
+
+	var err error
+	if cfg.RequireConfirmation {
+		err = cfg.DoSwitchWithConfirmation()
+	} else if cfg.MagicRollback {
+		err = cfg.DoSwitchWithMagicRollback()
+	} else {
+		err = cfg.DoSwitch()
+	}
+	if err == nil {
+		err = cfg.DoRebootIfNeeded()
+	}
+	if err == nil {
+		err = cfg.DoHealthCheck()
+	}
+	if err != nil && cfg.RollbackOnFailure {
+		err = cfg.DoRollback(d, err)
+	}
+	return err
+}
+
+// DoRollback switches the target back to the system it ran before the
+// switch that failed with err. It only does so once the activation started
+// and the previous system is known, so new hosts and failures before the
+// activation, such as build or lock failures, leave the target alone.
+func (cfg *nixosResourceConfig) DoRollback(d *schema.ResourceData, err error) error {
+	previousSystem, _ := d.GetChange("nixos_system")
+	switch {
+	case cfg.Report == nil || !cfg.Report.Activated:
+		log.Printf("[INFO] the switch of %s failed before activating, not rolling back", cfg.TargetHost)
+		return err
+	case d.IsNewResource():
+		log.Printf("[WARN] not rolling back %s, it had no system deployed by this resource", cfg.TargetHost)
+		return err
+	case !strings.HasPrefix(previousSystem.(string), "/nix/store/"):
+		log.Printf("[WARN] not rolling back %s, its previous system %q is unknown", cfg.TargetHost, previousSystem)
+		return err
+	}
+
+	// The rollback still runs once the timeout has passed.
+	rollbackConfig := cfg.GetRebuildConfig()
+	rollbackConfig.Context = nil
+	rollbackErr := nix.RollbackSystem(rollbackConfig, previousSystem.(string))
+	if rollbackErr != nil {
+		return fmt.Errorf("%s\nrollback also failed: %s", err, rollbackErr)
+	}
+	return err
+}
+
+// DoRebootIfNeeded reboots the target if the new system can't be fully
+// applied without a reboot.
+func (cfg *nixosResourceConfig) DoRebootIfNeeded() error {
+	if !cfg.RebootIfNeeded || cfg.SwitchAction == "dry-activate" {
+		return nil
+	}
+
+	rebuildConfig := cfg.GetRebuildConfig()
+	needsReboot, err := nix.NeedsReboot(rebuildConfig)
+	if err != nil {
+		return err
+	}
+	if !needsReboot {
+		return nil
+	}
+	if cfg.Local {
+		// Rebooting would stop terraform midway through the apply.
+		log.Printf("[WARN] %s needs a reboot to apply the new system, it runs terraform so it is not rebooted", cfg.TargetHost)
+		return nil
+	}
+
+	log.Printf("[INFO] rebooting %s to apply the new system", cfg.TargetHost)
+	return nix.RebootSystem(rebuildConfig, cfg.RebootTimeout)
+}
+
+// DoHealthCheck polls the configured health check and http probe until
+// they pass or the retries are exhausted.
+func (cfg *nixosResourceConfig) DoHealthCheck() error {
+	if cfg.HTTPProbe != nil {
+		err := waitForHTTP(cfg.Context, cfg.HTTPProbe)
+		if err != nil {
+			return err
+		}
+	}
+
+	check := cfg.HealthCheck
+	if check == nil {
+		return nil
+	}
+
+	var outputs []string
+	for attempt := 1; ; attempt++ {
+		output, err := nix.RunCheck(cfg.GetRebuildConfig(), check.Command, check.OnTarget)
+		if err == nil {
+			return nil
+		}
+		outputs = append(outputs, fmt.Sprintf("attempt %d: %s%s", attempt, output, err))
+		if attempt > check.Retries {
+			return fmt.Errorf("health check failed after %d attempts:\n%s", attempt, strings.Join(outputs, "\n"))
+		}
+		err = nix.SleepContext(cfg.Context, check.Interval)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// DoSwitchWithMagicRollback switches the system with a revert scheduled on the
+// target, and only cancels the revert once ssh works again with the new system.
+//
+// The revert is scheduled once the system is built and copied, so slow builds
+// and copies don't use up the confirm_timeout.
+func (cfg *nixosResourceConfig) DoSwitchWithMagicRollback() error {
+	rebuildConfig := cfg.GetRebuildConfig()
+
+	previousSystem, err := nix.CurrentSystem(rebuildConfig)
+	if err != nil {
+		return err
+	}
+
+	var deadline time.Time
+	err = cfg.doSwitch(func() error {
+		deadline = time.Now().Add(cfg.ConfirmTimeout)
+		return nix.ScheduleRevert(rebuildConfig, previousSystem, cfg.ConfirmTimeout)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = cfg.waitForSSH(time.Until(deadline))
+	if err == nil {
+		err = nix.CancelRevert(rebuildConfig)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to confirm the new system, it will be reverted to %s: %s", previousSystem, err)
+	}
+
+	return nil
+}
+
+// waitForSSH waits up to timeout for ssh to work on the target, a local
+// target is always reachable.
+func (cfg *nixosResourceConfig) waitForSSH(timeout time.Duration) error {
+	if cfg.Local {
+		return nil
+	}
+	return nix.WaitForSSH(cfg.context(), cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts, nix.SSHClient{Transport: cfg.Transport, Password: cfg.SSHPassword, CommandTemplate: cfg.RemoteCommandTemplate}, cfg.SSHPoll, timeout)
+}
+
+// DoSwitchWithConfirmation activates the system without making it the
+// system profile, with a revert scheduled on the target once the system is
+// built and copied. The system is only committed to the profile once the
+// confirmation command passes on the target.
+func (cfg *nixosResourceConfig) DoSwitchWithConfirmation() error {
+	rebuildConfig := cfg.GetRebuildConfig()
+
+	previousSystem, err := nix.CurrentSystem(rebuildConfig)
+	if err != nil {
+		return err
+	}
+
+	// The running system is the specialisation when one is set, so the
+	// toplevel to commit is found before activating.
+	system, err := nix.EvalSystem(rebuildConfig)
+	if err != nil {
+		return err
+	}
+
+	activateConfig := *cfg
+	activateConfig.SwitchAction = "test"
+	var deadline time.Time
+	err = activateConfig.doSwitch(func() error {
+		deadline = time.Now().Add(cfg.ConfirmationTimeout)
+		return nix.ScheduleRevert(rebuildConfig, previousSystem, cfg.ConfirmationTimeout)
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		err = cfg.waitForSSH(time.Until(deadline))
+		if err == nil {
+			var output string
+			output, err = nix.RunCheck(rebuildConfig, cfg.ConfirmationCommand, true)
+			if err == nil {
+				break
+			}
+			err = fmt.Errorf("%s%s", output, err)
+		}
+		if time.Now().Add(5 * time.Second).After(deadline) {
+			return fmt.Errorf("new system was not confirmed within %s, it will be reverted to %s: %s", cfg.ConfirmationTimeout, previousSystem, err)
+		}
+		if nix.SleepContext(cfg.Context, 5*time.Second) != nil {
+			return fmt.Errorf("cancelled before the new system was confirmed, it will be reverted to %s", previousSystem)
+		}
+	}
+
+	err = nix.CancelRevert(rebuildConfig)
+	if err != nil {
+		return fmt.Errorf("unable to cancel the scheduled revert, it will be reverted to %s: %s", previousSystem, err)
+	}
+
+	return nix.CommitSystem(rebuildConfig, system)
+}
+
+// checkSpecialisation fails if system has no Specialisation. Systems built on
+// the target are only evaluated while planning, so their specialisations are
+// evaluated too.
+func (cfg *nixosResourceConfig) checkSpecialisation(system string) error {
+	if !cfg.BuildOnTarget {
+		_, err := os.Stat(filepath.Join(system, "specialisation", cfg.Specialisation))
+		if err != nil {
+			return fmt.Errorf("specialisation %q does not exist in %s", cfg.Specialisation, system)
+		}
+		return nil
+	}
+
+	names, err := nix.Specialisations(cfg.GetRebuildConfig())
+	if err != nil {
+		// Like a failed evaluation of the system, the switch reports it.
+		log.Printf("[WARN] unable to evaluate the specialisations of %s: %s", system, err)
+		return nil
+	}
+	for _, name := range names {
+		if name == cfg.Specialisation {
+			return nil
+		}
+	}
+	return fmt.Errorf("specialisation %q does not exist in %s", cfg.Specialisation, system)
+}
+
+// inlineConfigPath is where nixos_config is written when nixos_config_path is
+// not set. The name is derived from the config so it is stable between plan
+// and apply.
+func inlineConfigPath(nixosConfig string) string {
+	sum := sha256.Sum256([]byte(nixosConfig))
+	return filepath.Join(nixDataDir(), fmt.Sprintf("nixos-config-%s.nix", hex.EncodeToString(sum[:8])))
+}
+
+// closureSize returns the closure size of a local store path, remembering it
+// next to the plan time builds as store paths never change.
+func closureSize(storePath string) (int64, error) {
+	path := filepath.Join(nixDataDir(), "sizes", filepath.Base(storePath))
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		size, err := strconv.ParseInt(string(data), 10, 64)
+		if err == nil {
+			return size, nil
+		}
+	}
+
+	size, err := nix.ClosureSize(storePath)
+	if err != nil {
+		return 0, err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(path, []byte(strconv.FormatInt(size, 10)), 0644)
+	}
+	if err != nil {
+		log.Printf("[WARN] unable to cache the closure size of %s: %s", storePath, err)
+	}
+	return size, nil
+}
+
+// planClosureSize shows the closure size of the new system in the plan, and
+// logs how much it changes by when the old system is in the local store.
+func planClosureSize(d *schema.ResourceDiff, oldSystem, newSystem string) {
+	size, err := closureSize(newSystem)
+	if err != nil {
+		log.Printf("[WARN] unable to get the closure size of %s: %s", newSystem, err)
+		return
+	}
+	if int64(d.Get("closure_size_bytes").(int)) != size {
+		err = d.SetNew("closure_size_bytes", int(size))
+		if err != nil {
+			log.Printf("[WARN] unable to set closure_size_bytes: %s", err)
+		}
+	}
+
+	if oldSystem == newSystem || nix.CheckSystemPath(oldSystem) != nil {
+		return
+	}
+	oldSize, err := closureSize(oldSystem)
+	if err != nil {
+		log.Printf("[WARN] unable to get the closure size of %s: %s", oldSystem, err)
+		return
+	}
+	if size >= oldSize {
+		log.Printf("[WARN] the closure of %s grows by %s to %s", d.Get("target_host"), formatBytes(size-oldSize), formatBytes(size))
+	} else {
+		log.Printf("[WARN] the closure of %s shrinks by %s to %s", d.Get("target_host"), formatBytes(oldSize-size), formatBytes(size))
+	}
+}
+
+// maxChangeSummaryLines limits the length of change_summary, so a mass
+// rebuild doesn't bury the rest of the plan.
+const maxChangeSummaryLines = 50
+
+// planChangeSummary shows the package changes between the old and new system
+// in the plan. The old system must be in the local store, it is not fetched
+// from the target.
+func (cfg *nixosResourceConfig) planChangeSummary(d *schema.ResourceDiff, oldSystem, newSystem string) {
+	if oldSystem == newSystem {
+		return
+	}
+	if nix.CheckSystemPath(oldSystem) != nil {
+		log.Printf("[INFO] %s is not in the local store, no change summary for %s", oldSystem, d.Get("target_host"))
+		return
+	}
+
+	changes, err := nix.DiffClosures(cfg.GetRebuildConfig(), oldSystem, newSystem)
+	if err != nil {
+		log.Printf("[WARN] unable to diff the closures of %s and %s: %s", oldSystem, newSystem, err)
+		return
+	}
+	if len(changes) > maxChangeSummaryLines {
+		changes = append(changes[:maxChangeSummaryLines], fmt.Sprintf("... and %d more", len(changes)-maxChangeSummaryLines))
+	}
+	summary := strings.Join(changes, "\n")
+	if summary == "" {
+		summary = "no package changes"
+	}
+
+	if d.Get("change_summary").(string) != summary {
+		err = d.SetNew("change_summary", summary)
+		if err != nil {
+			log.Printf("[WARN] unable to set change_summary: %s", err)
+		}
+	}
+}
+
+// formatBytes formats n as a human readable binary size, like 412 MiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
 }
 
-func (cfg *nixosResourceConfig) GetRebuildConfig() *nix.NixosRebuildConfig {
-	return &nix.NixosRebuildConfig{
-		TargetHost:      cfg.TargetHost,
-		TargetUser:      cfg.TargetUser,
-		BuildHost:       cfg.BuildHost,
-		NixosConfigPath: cfg.NixosConfigPath,
-		NixPath:         cfg.NixPath,
-		SSHOpts:         cfg.SSHOpts,
-		PreSwitchHook:   cfg.PreSwitchHook,
-		PostSwitchHook:  cfg.PostSwitchHook,
+// nixDataDir is the directory the provider keeps local state in.
+func nixDataDir() string {
+	dataDir := os.Getenv("TF_DATA_DIR")
+	if dataDir == "" {
+		dataDir = ".terraform"
 	}
+	return filepath.Join(dataDir, "nix")
 }
 
-func (cfg *nixosResourceConfig) writeConfig() error {
-	if cfg.NixosConfig != "" {
-		f, err := os.Create(cfg.NixosConfigPath)
-		if err != nil {
-			return err
-		}
-		_, err = f.Write([]byte(cfg.NixosConfig))
-		if err != nil {
-			return err
-		}
-		err = f.Close()
-		if err != nil {
-			return err
-		}
+// deploymentLogPath returns where the output of applying a resource is
+// written, log_file or a file named after the resource id.
+func deploymentLogPath(d resourceLike, id string) (string, error) {
+	if p, ok := d.GetOk("log_file"); ok {
+		return filepath.Abs(p.(string))
 	}
-	return nil
+	return filepath.Abs(filepath.Join(nixDataDir(), "logs", id+".log"))
 }
 
-func (cfg *nixosResourceConfig) DoBuild() (string, error) {
-	err := cfg.writeConfig()
+// logTail returns the last n lines of the file at path, or "" if it can't
+// be read.
+func logTail(path string, n int) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// systemGCRoot returns the local gc root for the system of the resource with
+// the given id. Roots are namespaced by id, so separate workspaces never share
+// a root.
+func systemGCRoot(id string) (string, error) {
+	cacheDir, err := os.UserCacheDir()
 	if err != nil {
 		return "", err
 	}
+	return filepath.Join(cacheDir, "terraform-nix", id, "system"), nil
+}
 
-	return nix.BuildSystem(cfg.GetRebuildConfig())
+// affectsSystem are the attributes that can change the system recorded in
+// nixos_system: the inputs of its evaluation, and which system of which host
+// is recorded. With plan_mode = "defer" only their changes mark the system as
+// changed, changes to how the target is reached or how the system is built
+// and copied leave it alone.
+var affectsSystem = map[string]bool{
+	"target_host":           true,
+	"local":                 true,
+	"nixos_config":          true,
+	"nixos_config_expr":     true,
+	"nixos_config_path":     true,
+	"config_dir":            true,
+	"pre_build_hook":        true,
+	"flake":                 true,
+	"flake_attr":            true,
+	"override_inputs":       true,
+	"lock_file_mode":        true,
+	"impure":                true,
+	"nix_path":              true,
+	"nix_path_entries":      true,
+	"build_args":            true,
+	"build_args_str":        true,
+	"extra_nix_options":     true,
+	"experimental_features": true,
+	"system":                true,
+	"switch_action":         true,
+	"specialisation":        true,
 }
 
-func (cfg *nixosResourceConfig) DoSwitch() error {
-	err := cfg.writeConfig()
-	if err != nil {
-		return err
+// getPlanMode returns the plan_mode of a resource, or the provider's.
+func getPlanMode(d resourceLike, m interface{}) string {
+	if mode, ok := d.GetOk("plan_mode"); ok {
+		return mode.(string)
 	}
+	if mode := getProviderConfig(m).PlanMode; mode != "" {
+		return mode
+	}
+	return "build"
+}
 
-	return nix.SwitchSystem(cfg.GetRebuildConfig())
+// getBuilders returns the configured remote builders. Terraform can't tell an
+// empty list from an unset one, so empty strings are dropped and a list of
+// only empty strings disables remote builders.
+func getBuilders(d resourceLike) []string {
+	specs := stringList(d.Get("builders"))
+	if len(specs) == 0 {
+		return nil
+	}
+	builders := []string{}
+	for _, spec := range specs {
+		if spec != "" {
+			builders = append(builders, spec)
+		}
+	}
+	return builders
 }
 
-func (cfg *nixosResourceConfig) CurrentSystem() (string, error) {
-	return nix.CurrentSystem(cfg.GetRebuildConfig())
+// getFlakeRef returns the flake#attr reference to build, or "" if the
+// resource is not using a flake. Local flake paths are made absolute.
+func getFlakeRef(d resourceLike, baseDir string) (string, error) {
+	flake := d.Get("flake").(string)
+	if flake == "" {
+		return "", nil
+	}
+
+	attr := strings.TrimPrefix(d.Get("flake_attr").(string), "nixosConfigurations.")
+	if attr == "" {
+		return "", errors.New("flake_attr must be set when using flake")
+	}
+
+	if strings.HasPrefix(flake, "path:") {
+		p, err := absPath(baseDir, strings.TrimPrefix(flake, "path:"))
+		if err != nil {
+			return "", err
+		}
+		flake = "path:" + p
+	} else if strings.HasPrefix(flake, ".") || strings.HasPrefix(flake, "/") {
+		p, err := absPath(baseDir, flake)
+		if err != nil {
+			return "", err
+		}
+		flake = p
+	}
+
+	return flake + "#" + attr, nil
 }
 
-func getNixosConfig(d resourceLike) (nixosResourceConfig, error) {
+func getNixosConfig(d resourceLike, m interface{}) (nixosResourceConfig, error) {
 
-	nixPath, ok := d.GetOk("nix_path")
-	if !ok {
-		nixPath = os.Getenv("NIX_PATH")
+	configDir := d.Get("config_dir").(string)
+
+	nixPath, nixPathEntries, err := getNixPath(d, configDir)
+	if err != nil {
+		return nixosResourceConfig{}, err
 	}
 
 	sshOpts, ok := d.GetOk("ssh_opts")
 	if !ok {
 		sshOpts = os.Getenv("NIX_SSHOPTS")
 	}
+	target := getSSHTarget(d, sshOpts.(string))
 
 	nixosConfig, _ := d.GetOk("nixos_config")
+	// nixos_config_expr is written to a path of its own, like nixos_config
+	// without nixos_config_path.
+	if expr := d.Get("nixos_config_expr").(string); expr != "" {
+		nixosConfig = expr
+	}
 
 	nixosConfigPath := d.Get("nixos_config_path").(string)
-
-	nixosConfigPath, err := filepath.Abs(nixosConfigPath)
+	flake, err := getFlakeRef(d, configDir)
 	if err != nil {
 		return nixosResourceConfig{}, err
 	}
 
+	overrideInputs := stringMap(d.Get("override_inputs"))
+
+	var maxFreed int64
+	if size := d.Get("gc_max_freed_bytes").(string); size != "" {
+		maxFreed, err = parseByteSize(size)
+		if err != nil {
+			return nixosResourceConfig{}, err
+		}
+	}
+	if len(overrideInputs) != 0 && flake == "" {
+		return nixosResourceConfig{}, errors.New("override_inputs can only be set together with flake")
+	}
+
+	// A store path is a prebuilt system, which is activated as is.
+	systemPath := ""
+	if strings.HasPrefix(nixosConfigPath, "/nix/store/") {
+		if nixosConfig.(string) != "" {
+			return nixosResourceConfig{}, errors.New("nixos_config can't be written to a store path")
+		}
+		systemPath = nixosConfigPath
+	} else if flake == "" {
+		if nixosConfigPath != "" {
+			nixosConfigPath, err = absPath(configDir, nixosConfigPath)
+		} else if nixosConfig.(string) != "" {
+			nixosConfigPath, err = filepath.Abs(inlineConfigPath(nixosConfig.(string)))
+		} else {
+			err = errors.New("one of nixos_config, nixos_config_expr, nixos_config_path or flake must be set")
+		}
+		if err != nil {
+			return nixosResourceConfig{}, err
+		}
+	}
+
+	var healthCheck *healthCheckConfig
+	if checks := d.Get("health_check").([]interface{}); len(checks) != 0 && checks[0] != nil {
+		check := checks[0].(map[string]interface{})
+		healthCheck = &healthCheckConfig{
+			Command:  check["command"].(string),
+			OnTarget: check["on_target"].(bool),
+			Retries:  check["retries"].(int),
+			Interval: time.Duration(check["interval"].(int)) * time.Second,
+		}
+	}
+
+	var postBuildPush *nix.CachePush
+	if pushes := d.Get("post_build_push").([]interface{}); len(pushes) != 0 && pushes[0] != nil {
+		push := pushes[0].(map[string]interface{})
+		postBuildPush = &nix.CachePush{
+			URL:            push["cache_url"].(string),
+			SigningKeyFile: push["signing_key_file"].(string),
+			WarnOnFailure:  push["on_push_failure"].(string) == "warn",
+		}
+	}
+
+	var buildHostGC *nix.GCOptions
+	if gcs := d.Get("collect_garbage_build_host").([]interface{}); len(gcs) != 0 {
+		buildHostGC = &nix.GCOptions{KeepProfiles: true}
+		// An empty block has no map, it collects with the defaults.
+		if gc, ok := gcs[0].(map[string]interface{}); ok {
+			buildHostGC.KeepGenerations = gc["keep_generations"].(int)
+			buildHostGC.DeleteOlderThan = gc["delete_older_than"].(string)
+			buildHostGC.KeepProfiles = !gc["delete_generations"].(bool)
+			if size := gc["max_freed_bytes"].(string); size != "" {
+				buildHostGC.MaxFreed, err = parseByteSize(size)
+				if err != nil {
+					return nixosResourceConfig{}, err
+				}
+			}
+		}
+	}
+
+	var httpProbe *httpProbeConfig
+	if url, ok := d.GetOk("health_http_url"); ok {
+		httpProbe = &httpProbeConfig{
+			URL:                url.(string),
+			ExpectedStatus:     d.Get("health_http_expected_status").(int),
+			Timeout:            time.Duration(d.Get("health_http_timeout").(int)) * time.Second,
+			InsecureSkipVerify: d.Get("insecure_skip_verify").(bool),
+		}
+	}
+
 	return nixosResourceConfig{
-		TargetHost:      d.Get("target_host").(string),
-		TargetUser:      d.Get("target_user").(string),
-		BuildHost:       d.Get("build_host").(string),
-		PreSwitchHook:   d.Get("pre_switch_hook").(string),
-		PostSwitchHook:  d.Get("post_switch_hook").(string),
-		NixosConfig:     nixosConfig.(string),
-		NixosConfigPath: nixosConfigPath,
-		NixPath:         nixPath.(string),
-		SSHOpts:         sshOpts.(string),
-		SSHTimeout:      time.Duration(d.Get("ssh_timeout").(int)) * time.Second,
-		CollectGarbage:  d.Get("collect_garbage").(bool),
+		HealthCheck:           healthCheck,
+		HTTPProbe:             httpProbe,
+		RebootIfNeeded:        d.Get("reboot_if_needed").(bool),
+		RebootTimeout:         time.Duration(d.Get("reboot_timeout").(int)) * time.Second,
+		TargetHost:            target.Host,
+		TargetUser:            target.User,
+		BuildHost:             d.Get("build_host").(string),
+		PreSwitchHooks:        getHooks(d, "pre_switch"),
+		PostSwitchHooks:       getHooks(d, "post_switch"),
+		PreBuildHook:          d.Get("pre_build_hook").(string),
+		ForwardAgent:          d.Get("forward_agent").(bool),
+		SwitchAction:          d.Get("switch_action").(string),
+		Specialisation:        d.Get("specialisation").(string),
+		SwitchRetries:         d.Get("switch_retries").(int),
+		DeployLock:            d.Get("deploy_lock").(bool),
+		LockTimeout:           time.Duration(d.Get("lock_timeout").(int)) * time.Second,
+		NixosConfig:           nixosConfig.(string),
+		NixosConfigPath:       nixosConfigPath,
+		NixPath:               nixPath,
+		NixPathEntries:        nixPathEntries,
+		SSHOpts:               target.SSHOpts,
+		Transport:             target.Transport,
+		SSHPassword:           target.Password,
+		SSHRetries:            target.Retries,
+		Escalation:            target.Escalation,
+		EscalationFlags:       target.EscalationFlags,
+		RemoteTempDir:         target.TempDir,
+		CommandTimeout:        target.CommandTimeout,
+		RemoteCommandTemplate: target.CommandTemplate,
+		CopyCommandTemplate:   target.CopyTemplate,
+		SSHPoll:               getSSHPoll(d),
+		SSHTimeout:            time.Duration(d.Get("ssh_timeout").(int)) * time.Second,
+		WaitForSSH:            d.Get("wait_for_ssh").(bool),
+		Local:                 d.Get("local").(bool),
+		BootstrapUser:         d.Get("bootstrap_user").(string),
+		BootstrapSSHOpts:      d.Get("bootstrap_ssh_opts").(string),
+		CollectGarbage:        d.Get("collect_garbage").(bool),
+		GCBeforeSwitch:        d.Get("gc_before_switch").(bool),
+		OnGCFailure:           d.Get("on_gc_failure").(string),
+		GC: nix.GCOptions{
+			KeepGenerations: d.Get("gc_keep_generations").(int),
+			DeleteOlderThan: d.Get("gc_delete_older_than").(string),
+			MaxFreed:        maxFreed,
+		},
+		GCUsedPercentAbove:     d.Get("gc_when_used_percent_above").(int),
+		StoreOptimise:          d.Get("store_optimise").(bool),
+		GCOnLowSpace:           d.Get("gc_on_low_space").(bool),
+		BuildHostGC:            buildHostGC,
+		RollbackOnFailure:      d.Get("rollback_on_failure").(bool),
+		MagicRollback:          d.Get("magic_rollback").(bool),
+		ConfirmTimeout:         time.Duration(d.Get("confirm_timeout").(int)) * time.Second,
+		DryRun:                 d.Get("dry_run").(bool) || getProviderConfig(m).DryRun,
+		Flake:                  flake,
+		SystemPath:             systemPath,
+		UseNewCLI:              getProviderConfig(m).UseNewCLI,
+		LockFileMode:           d.Get("lock_file_mode").(string),
+		BuildOnTarget:          d.Get("build_on_target").(bool),
+		PlanMode:               getPlanMode(d, m),
+		KeepResultGCRoot:       d.Get("keep_result_gc_root").(bool),
+		System:                 d.Get("system").(string),
+		Fallback:               d.Get("fallback").(bool),
+		KeepGoing:              d.Get("keep_going").(bool),
+		BuildTimeout:           time.Duration(d.Get("build_timeout").(int)) * time.Second,
+		Sandbox:                d.Get("sandbox").(string),
+		UseSubstitutes:         d.Get("use_substitutes").(bool),
+		Substituters:           stringList(d.Get("substituters")),
+		ReportUnitChanges:      d.Get("report_unit_changes").(bool),
+		TrustedPublicKeys:      stringList(d.Get("trusted_public_keys")),
+		CopyProtocol:           d.Get("copy_protocol").(string),
+		SigningKeyFile:         d.Get("signing_key_file").(string),
+		NoCheckSigs:            !d.Get("check_sigs").(bool),
+		PostBuildPush:          postBuildPush,
+		CopyCompression:        d.Get("copy_compression").(string),
+		CopyCompressionLevel:   d.Get("copy_compression_level").(int),
+		CopyParallelism:        d.Get("copy_parallelism").(int),
+		builds:                 getProviderConfig(m).builds,
+		preBuildHooks:          getProviderConfig(m).preBuildHooks,
+		Builders:               getBuilders(d),
+		BuildersUseSubstitutes: d.Get("builders_use_substitutes").(bool),
+		MaxJobs:                intOrDefault(d.Get("max_jobs"), getProviderConfig(m).MaxJobs),
+		Cores:                  intOrDefault(d.Get("cores"), getProviderConfig(m).Cores),
+		ExperimentalFeatures:   append(append([]string{}, getProviderConfig(m).ExperimentalFeatures...), stringList(d.Get("experimental_features"))...),
+		OverrideInputs:         overrideInputs,
+		Impure:                 d.Get("impure").(bool),
+		ExtraNixOptions:        stringMap(d.Get("extra_nix_options")),
+		BuildArgs:              stringMap(d.Get("build_args")),
+		BuildArgsStr:           stringMap(d.Get("build_args_str")),
+		RequireConfirmation:    d.Get("require_confirmation").(bool),
+		ConfirmationCommand:    d.Get("confirmation_command").(string),
+		ConfirmationTimeout:    time.Duration(d.Get("confirmation_timeout").(int)) * time.Second,
 	}, nil
 }
 
 func resourceNixOSCreateUpdate(d *schema.ResourceData, m interface{}) error {
 
+	timeout := d.Timeout(schema.TimeoutUpdate)
 	id := d.Id()
 	if id == "" {
+		timeout = d.Timeout(schema.TimeoutCreate)
 		d.SetId(randomID())
 	}
 
-	cfg, err := getNixosConfig(d)
+	cfg, err := getNixosConfig(d, m)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cfg.Context = ctx
+
+	logPath, err := deploymentLogPath(d, d.Id())
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(logPath), 0755)
+	if err != nil {
+		return err
+	}
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return err
+	}
+	cfg.Log = logFile
+
+	err = d.Set("deployment_log", logPath)
+	if err == nil {
+		err = resourceNixOSDeploy(d, m, &cfg)
+	}
+	closeErr := logFile.Close()
+	if err != nil {
+		if tail := logTail(logPath, 50); tail != "" {
+			err = fmt.Errorf("%s\nlast lines of %s:\n%s", err, logPath, tail)
+		}
+		return err
+	}
+	return closeErr
+}
+
+// setUnitChanges records the unit changes of the last switch, clearing them
+// when they were not found.
+func setUnitChanges(d *schema.ResourceData, changes *nix.UnitChanges) error {
+	if changes == nil {
+		changes = &nix.UnitChanges{}
+	}
+	err := d.Set("units_to_restart", changes.Restart)
+	if err != nil {
+		return err
+	}
+	err = d.Set("units_to_stop", changes.Stop)
 	if err != nil {
 		return err
 	}
+	return d.Set("units_to_reload", changes.Reload)
+}
+
+// resourceNixOSDeploy does the work of resourceNixOSCreateUpdate once the
+// deployment log is open.
+func resourceNixOSDeploy(d *schema.ResourceData, m interface{}, cfg *nixosResourceConfig) error {
+	var err error
 
 	// Delete the old config if it was under out control.
-	if d.HasChange("nixos_config_path") {
+	if d.HasChange("nixos_config_path") || d.HasChange("nixos_config") || d.HasChange("nixos_config_expr") {
 		oldConfig, _ := d.GetChange("nixos_config")
-		if oldConfig != "" {
-			old, _ := d.GetChange("nixos_config_path")
-			err := os.Remove(old.(string))
+		oldExpr, _ := d.GetChange("nixos_config_expr")
+		old, _ := d.GetChange("resolved_config_path")
+		oldPath := old.(string)
+		if (oldConfig != "" || oldExpr != "") && oldPath != cfg.NixosConfigPath {
+			err := os.Remove(oldPath)
 			if err != nil && !os.IsNotExist(err) {
 				return err
 			}
 		}
 	}
 
-	err = nix.WaitForSSH(cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts, cfg.SSHTimeout)
+	if !cfg.Local {
+		err = waitForSSH(cfg.context(), d, cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts, cfg.sshTimeout())
+		// Updates never fall back, the target_user of an existing host has
+		// to keep working.
+		if err != nil && d.IsNewResource() && cfg.BootstrapUser != "" {
+			err = cfg.useBootstrapUser(d, err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = d.Set("connected_user", cfg.TargetUser)
 	if err != nil {
 		return err
 	}
 
-	if cfg.CollectGarbage {
-		err = nix.CollectGarbage(cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts)
+	// A dry run builds the system but never touches the target, and the
+	// new system is not recorded so a real apply still switches.
+	if cfg.DryRun {
+		desiredSystem, err := cfg.DoBuild()
 		if err != nil {
 			return err
 		}
+		oldSystem, _ := d.GetChange("nixos_system")
+		log.Printf("[INFO] dry run, %s would switch from %s to %s", cfg.TargetHost, oldSystem, desiredSystem)
+		return resourceNixOSRead(d, m)
 	}
 
-	if d.HasChange("nixos_system") || d.HasChange("target_host") || d.HasChange("pre_switch_hook") || d.HasChange("post_switch_hook") {
-		err = cfg.DoSwitch()
+	if cfg.CollectGarbage && cfg.GCBeforeSwitch {
+		err = cfg.DoCollectGarbage(d)
+		if err != nil {
+			return err
+		}
+	}
+
+	needsSwitch := switchNeeded(d)
+	if needsSwitch {
+		err = cfg.DoPreBuildHook()
+		if err != nil {
+			return err
+		}
+		err = cfg.UsePlannedBuild()
 		if err != nil {
 			return err
 		}
+		cfg.Report = &nix.SwitchReport{}
+		err = cfg.DoDeploySwitch(d)
+		if err != nil {
+			// Record what is really running so the plan stays dirty.
+			_ = resourceNixOSRead(d, m)
+			return err
+		}
+		err = d.Set("copy_skipped", cfg.Report.CopySkipped)
+		if err != nil {
+			return err
+		}
+		err = d.Set("required_copy_bytes", int(cfg.Report.RequiredCopyBytes))
+		if err != nil {
+			return err
+		}
+		err = setUnitChanges(d, cfg.Report.Units)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The generations the switch superseded can be collected now.
+	if cfg.CollectGarbage && !cfg.GCBeforeSwitch {
+		err = cfg.DoCollectGarbage(d)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = resourceNixOSRead(d, m)
+	if err != nil {
+		return err
+	}
+
+	// Only a new build leaves garbage on the build host, it is collected
+	// once the system is on the target.
+	if needsSwitch && cfg.SwitchAction != "dry-activate" {
+		err = cfg.DoCollectBuildHostGarbage(d.Get("nixos_system").(string))
+		if err != nil {
+			return err
+		}
+	}
+
+	return cfg.UpdateGCRoot(d.Id(), d.Get("nixos_system").(string))
+}
+
+// useBootstrapUser switches cfg to connect as the BootstrapUser, with sudo
+// unless another escalation is set, after connecting as the target user
+// failed with err. Later operations connect as the target user again, which
+// the new system should create.
+func (cfg *nixosResourceConfig) useBootstrapUser(d *schema.ResourceData, err error) error {
+	log.Printf("[WARN] unable to connect to %s as %s, trying the bootstrap user %s: %s", cfg.TargetHost, cfg.TargetUser, cfg.BootstrapUser, err)
+	sshOpts := strings.TrimSpace(cfg.BootstrapSSHOpts + " " + cfg.SSHOpts)
+	bootstrapErr := waitForSSH(cfg.context(), d, cfg.BootstrapUser, cfg.TargetHost, sshOpts, cfg.sshTimeout())
+	if bootstrapErr != nil {
+		return fmt.Errorf("%s\nthe bootstrap user %s failed too: %s", err, cfg.BootstrapUser, bootstrapErr)
+	}
+	cfg.TargetUser = cfg.BootstrapUser
+	cfg.SSHOpts = sshOpts
+	if cfg.Escalation == "" || cfg.Escalation == "none" {
+		cfg.Escalation = "sudo"
+	}
+	return nil
+}
+
+// context returns the Context, or the background context without one.
+func (cfg *nixosResourceConfig) context() context.Context {
+	if cfg.Context != nil {
+		return cfg.Context
 	}
+	return context.Background()
+}
 
-	return resourceNixOSRead(d, m)
+// sshTimeout is the SSHTimeout, cut short by the deadline of the Context.
+func (cfg *nixosResourceConfig) sshTimeout() time.Duration {
+	if cfg.Context != nil {
+		if deadline, ok := cfg.Context.Deadline(); ok && time.Until(deadline) < cfg.SSHTimeout {
+			return time.Until(deadline)
+		}
+	}
+	return cfg.SSHTimeout
 }
 
+// quickSSHTimeout is how long Read tries to reach a target with
+// wait_for_ssh = false.
+const quickSSHTimeout = 5 * time.Second
+
 func resourceNixOSRead(d *schema.ResourceData, m interface{}) error {
 
-	cfg, err := getNixosConfig(d)
+	cfg, err := getNixosConfig(d, m)
 	if err != nil {
 		return err
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout(schema.TimeoutRead))
+	defer cancel()
+	cfg.Context = ctx
 
 	currentSystem := "unknown"
+	bootedSystem := "unknown"
+	// An unreachable host is reported as not needing a reboot.
+	needsReboot := false
 
-	err = nix.WaitForSSH(cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts, cfg.SSHTimeout)
-	if err == nil {
+	timeout := cfg.sshTimeout()
+	if !cfg.WaitForSSH {
+		timeout = quickSSHTimeout
+	}
+	if !cfg.Local {
+		err = waitForSSH(cfg.context(), d, cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts, timeout)
+	}
+	if err != nil && !cfg.WaitForSSH {
+		// Without waiting, an unreachable host keeps what was last seen.
+		log.Printf("[WARN] %s is unreachable, keeping its recorded system: %s", cfg.TargetHost, err)
+		currentSystem = d.Get("nixos_system").(string)
+		bootedSystem = d.Get("booted_system").(string)
+		needsReboot = d.Get("needs_reboot").(bool)
+	} else if err == nil {
 		currentSystem, err = cfg.CurrentSystem()
 		if err != nil {
 			return err
 		}
+		bootedSystem, err = nix.BootedSystem(cfg.GetRebuildConfig())
+		if err != nil {
+			return err
+		}
+		needsReboot, err = nix.NeedsReboot(cfg.GetRebuildConfig())
+		if err != nil {
+			return err
+		}
+		// Measured on every refresh, so it can be alerted on.
+		used, err := nix.StoreUsedPercent(cfg.GetRebuildConfig())
+		if err != nil {
+			log.Printf("[WARN] unable to measure the store of %s: %s", cfg.TargetHost, err)
+		} else {
+			err = d.Set("store_used_percent", used)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	err = d.Set("nixos_system", currentSystem)
@@ -252,12 +2110,39 @@ func resourceNixOSRead(d *schema.ResourceData, m interface{}) error {
 		return err
 	}
 
+	if cfg.Flake != "" {
+		lockHash, err := nix.FlakeLockHash(cfg.GetRebuildConfig())
+		if err != nil {
+			log.Printf("[WARN] unable to hash flake lock: %s", err)
+		} else {
+			err = d.Set("flake_lock_hash", lockHash)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = d.Set("resolved_config_path", cfg.configRef())
+	if err != nil {
+		return err
+	}
+
+	err = d.Set("booted_system", bootedSystem)
+	if err != nil {
+		return err
+	}
+
+	err = d.Set("needs_reboot", needsReboot)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
 func resourceNixOSDelete(d *schema.ResourceData, m interface{}) error {
 
-	cfg, err := getNixosConfig(d)
+	cfg, err := getNixosConfig(d, m)
 	if err != nil {
 		return err
 	}
@@ -269,32 +2154,139 @@ func resourceNixOSDelete(d *schema.ResourceData, m interface{}) error {
 		}
 	}
 
+	root, err := systemGCRoot(d.Id())
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(filepath.Dir(root))
+	if err != nil {
+		return err
+	}
+
+	if _, ok := d.GetOk("log_file"); !ok {
+		logPath, err := deploymentLogPath(d, d.Id())
+		if err != nil {
+			return err
+		}
+		err = os.Remove(logPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func resourceNixOSCustomizeDiff(d *schema.ResourceDiff, m interface{}) error {
+	if _, ok := d.GetOk("signing_key_file"); ok && !d.Get("check_sigs").(bool) {
+		return errors.New("signing_key_file has no effect with check_sigs = false, remove one of them")
+	}
+
+	switch compression := d.Get("copy_compression").(string); {
+	case d.Get("copy_compression_level").(int) != 0 && compression != "zstd" && compression != "xz":
+		return errors.New("copy_compression_level needs copy_compression set to zstd or xz")
+	case (compression == "zstd" || compression == "xz") && d.Get("copy_protocol").(string) != "ssh":
+		return fmt.Errorf("copy_compression = %q streams the closure over ssh itself, copy_protocol must be ssh", compression)
+	}
+
+	if booted := d.Get("booted_system").(string); booted != "" && booted != d.Get("nixos_system").(string) {
+		log.Printf("[WARN] %s is running %s but booted %s, a reboot is pending", d.Get("target_host"), d.Get("nixos_system"), booted)
+	}
+
 	// A trick to prevent prematurely writing nix expressions to disks path
 	// when this is the first diff.
-	if d.HasChange("nixos_config") {
+	if d.HasChange("nixos_config") || d.HasChange("nixos_config_expr") {
 		d.SetNewComputed("nixos_system")
 		return nil
 	}
 
-	cfg, err := getNixosConfig(d)
+	// Values computed by other resources are unknown until apply, so there
+	// is nothing that can be built yet.
+	for _, k := range unknownSkipsBuild {
+		if !d.NewValueKnown(k) {
+			d.SetNewComputed("nixos_system")
+			return nil
+		}
+	}
+
+	// Deferred plans never build, any changed input may change the system.
+	if getPlanMode(d, m) == "defer" {
+		for _, k := range d.GetChangedKeysPrefix("") {
+			if affectsSystem[strings.SplitN(k, ".", 2)[0]] {
+				d.SetNewComputed("nixos_system")
+				return nil
+			}
+		}
+		return nil
+	}
+
+	cfg, err := getNixosConfig(d, m)
+	if err != nil {
+		return err
+	}
+
+	// The hook may generate the config, and unlike build failures its
+	// failures stop the plan.
+	err = cfg.DoPreBuildHook()
+	if err != nil {
+		return err
+	}
+
+	err = cfg.checkConfigExists()
 	if err != nil {
 		return err
 	}
 
+	if d.Get("resolved_config_path").(string) != cfg.configRef() {
+		d.SetNew("resolved_config_path", cfg.configRef())
+	}
+
+	// Show moved flake inputs in the plan, so reviewers can see why the
+	// system is being rebuilt.
+	if cfg.Flake != "" {
+		lockHash, err := nix.FlakeLockHash(cfg.GetRebuildConfig())
+		if err != nil {
+			log.Printf("[WARN] unable to hash flake lock: %s", err)
+		} else if d.Get("flake_lock_hash").(string) != lockHash {
+			d.SetNew("flake_lock_hash", lockHash)
+		}
+	}
+
+	// New resources have no id to name a root after yet, apply adds it.
+	if cfg.KeepResultGCRoot && d.Id() != "" {
+		cfg.GCRoot, err = systemGCRoot(d.Id())
+		if err != nil {
+			return err
+		}
+	}
+
 	desiredSystem, err := cfg.DoBuild()
 	if err != nil {
+		if cfg.SystemPath != "" || nix.IsLockFileError(err) {
+			return err
+		}
 		log.Printf("build failed, assuming this is because of generated configs. err=%s", err.Error())
 		// If this really is an error, it will be picked up by the switch command.
 		d.SetNewComputed("nixos_system")
 		return nil
 	}
 
+	planClosureSize(d, d.Get("nixos_system").(string), desiredSystem)
+	cfg.planChangeSummary(d, d.Get("nixos_system").(string), desiredSystem)
+
+	if cfg.Specialisation != "" {
+		err = cfg.checkSpecialisation(desiredSystem)
+		if err != nil {
+			return err
+		}
+	}
+
 	if d.Get("nixos_system").(string) != desiredSystem {
-		d.SetNewComputed("nixos_system")
+		if cfg.SystemPath != "" {
+			d.SetNew("nixos_system", desiredSystem)
+		} else {
+			d.SetNewComputed("nixos_system")
+		}
 	}
 
 	return nil
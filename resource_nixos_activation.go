@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+// A prebuilt nixos system activated on a server, nothing is evaluated or built.
+func resourceNixOSActivation() *schema.Resource {
+	return &schema.Resource{
+		Create:        withSSHFiles(resourceNixOSActivationCreateUpdate),
+		Update:        withSSHFiles(resourceNixOSActivationCreateUpdate),
+		Read:          withSSHFiles(resourceNixOSActivationRead),
+		Delete:        withSSHFiles(resourceNixOSActivationDelete),
+		CustomizeDiff: withSSHFilesDiff(resourceNixOSActivationCustomizeDiff),
+
+		Schema: sshSchema(map[string]*schema.Schema{
+			"system_path": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"target_host": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"target_user": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "root",
+			},
+			"target_port": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      22,
+				ValidateFunc: validation.IntBetween(1, 65535),
+			},
+			"ssh_opts": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "-o StrictHostKeyChecking=accept-new -o BatchMode=yes",
+			},
+			"ssh_timeout": &schema.Schema{
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  180,
+			},
+			"check_sigs": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+			},
+			"copy_protocol": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "ssh",
+				ValidateFunc: validation.StringInSlice([]string{"ssh", "ssh-ng"}, false),
+			},
+			"use_substitutes": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+			},
+			"substituters": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			"trusted_public_keys": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type:         schema.TypeString,
+					ValidateFunc: validateTrustedPublicKey,
+				},
+			},
+			"nixos_system": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+		}, false),
+	}
+}
+
+type nixosActivationConfig struct {
+	SystemPath            string
+	TargetHost            string
+	TargetUser            string
+	SSHOpts               string
+	Transport             string
+	SSHPassword           string
+	SSHRetries            int
+	Escalation            string
+	EscalationFlags       string
+	RemoteTempDir         string
+	CommandTimeout        time.Duration
+	RemoteCommandTemplate string
+	CopyCommandTemplate   string
+	SSHTimeout            time.Duration
+	UseSubstitutes        bool
+	CopyProtocol          string
+	NoCheckSigs           bool
+	Substituters          []string
+	TrustedPublicKeys     []string
+}
+
+func (cfg *nixosActivationConfig) GetRebuildConfig() *nix.NixosRebuildConfig {
+	return &nix.NixosRebuildConfig{
+		TargetHost:            cfg.TargetHost,
+		TargetUser:            cfg.TargetUser,
+		SSHOpts:               cfg.SSHOpts,
+		Transport:             cfg.Transport,
+		SSHPassword:           cfg.SSHPassword,
+		SSHRetries:            cfg.SSHRetries,
+		Escalation:            cfg.Escalation,
+		EscalationFlags:       cfg.EscalationFlags,
+		RemoteTempDir:         cfg.RemoteTempDir,
+		CommandTimeout:        cfg.CommandTimeout,
+		RemoteCommandTemplate: cfg.RemoteCommandTemplate,
+		CopyCommandTemplate:   cfg.CopyCommandTemplate,
+		UseSubstitutes:        cfg.UseSubstitutes,
+		Substituters:          cfg.Substituters,
+		TrustedPublicKeys:     cfg.TrustedPublicKeys,
+		CopyProtocol:          cfg.CopyProtocol,
+		NoCheckSigs:           cfg.NoCheckSigs,
+	}
+}
+
+func getNixosActivationConfig(d resourceLike) nixosActivationConfig {
+	target := getSSHTarget(d, d.Get("ssh_opts").(string))
+	return nixosActivationConfig{
+		SystemPath:            d.Get("system_path").(string),
+		TargetHost:            target.Host,
+		TargetUser:            target.User,
+		SSHOpts:               target.SSHOpts,
+		Transport:             target.Transport,
+		SSHPassword:           target.Password,
+		SSHRetries:            target.Retries,
+		Escalation:            target.Escalation,
+		EscalationFlags:       target.EscalationFlags,
+		RemoteTempDir:         target.TempDir,
+		CommandTimeout:        target.CommandTimeout,
+		RemoteCommandTemplate: target.CommandTemplate,
+		CopyCommandTemplate:   target.CopyTemplate,
+		UseSubstitutes:        d.Get("use_substitutes").(bool),
+		Substituters:          stringList(d.Get("substituters")),
+		TrustedPublicKeys:     stringList(d.Get("trusted_public_keys")),
+		CopyProtocol:          d.Get("copy_protocol").(string),
+		NoCheckSigs:           !d.Get("check_sigs").(bool),
+		SSHTimeout:            time.Duration(d.Get("ssh_timeout").(int)) * time.Second,
+	}
+}
+
+func resourceNixOSActivationCreateUpdate(d *schema.ResourceData, m interface{}) error {
+	id := d.Id()
+	if id == "" {
+		d.SetId(randomID())
+	}
+
+	cfg := getNixosActivationConfig(d)
+	rebuildConfig := cfg.GetRebuildConfig()
+
+	err := waitForSSH(context.Background(), d, cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts, cfg.SSHTimeout)
+	if err != nil {
+		return err
+	}
+
+	if d.IsNewResource() || d.HasChange("nixos_system") || d.HasChange("target_host") {
+		err = nix.CopyClosure(rebuildConfig, cfg.SystemPath)
+		if err != nil {
+			return err
+		}
+
+		err = nix.SwitchToSystem(rebuildConfig, cfg.SystemPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return resourceNixOSActivationRead(d, m)
+}
+
+func resourceNixOSActivationRead(d *schema.ResourceData, m interface{}) error {
+	cfg := getNixosActivationConfig(d)
+
+	currentSystem := "unknown"
+
+	err := waitForSSH(context.Background(), d, cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts, cfg.SSHTimeout)
+	if err == nil {
+		currentSystem, err = nix.CurrentSystem(cfg.GetRebuildConfig())
+		if err != nil {
+			return err
+		}
+	}
+
+	err = d.Set("nixos_system", currentSystem)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func resourceNixOSActivationDelete(d *schema.ResourceData, m interface{}) error {
+	return nil
+}
+
+func resourceNixOSActivationCustomizeDiff(d *schema.ResourceDiff, m interface{}) error {
+	// The desired system is known up front, so no build is needed to plan.
+	if !d.NewValueKnown("system_path") {
+		d.SetNewComputed("nixos_system")
+		return nil
+	}
+
+	systemPath := d.Get("system_path").(string)
+	if d.Get("nixos_system").(string) != systemPath {
+		d.SetNew("nixos_system", systemPath)
+	}
+
+	return nil
+}
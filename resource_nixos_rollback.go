@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+// An explicit rollback of a nixos server to a previous generation or system.
+func resourceNixOSRollback() *schema.Resource {
+	return &schema.Resource{
+		Create: withSSHFiles(resourceNixOSRollbackCreate),
+		Read:   withSSHFiles(resourceNixOSRollbackRead),
+		Delete: withSSHFiles(resourceNixOSRollbackDelete),
+
+		Schema: sshSchema(map[string]*schema.Schema{
+			"target_host": &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			"target_user": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "root",
+				ForceNew: true,
+			},
+			"target_port": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      22,
+				ValidateFunc: validation.IntBetween(1, 65535),
+				ForceNew:     true,
+			},
+			"ssh_opts": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "-o StrictHostKeyChecking=accept-new -o BatchMode=yes",
+				ForceNew: true,
+			},
+			"ssh_timeout": &schema.Schema{
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  180,
+				ForceNew: true,
+			},
+			"generation": &schema.Schema{
+				Type:          schema.TypeInt,
+				Optional:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"system_path"},
+			},
+			"system_path": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"generation"},
+			},
+			"nixos_system": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+		}, true),
+	}
+}
+
+func getRollbackConfig(d resourceLike) *nix.NixosRebuildConfig {
+	target := getSSHTarget(d, d.Get("ssh_opts").(string))
+	return &nix.NixosRebuildConfig{
+		TargetHost:            target.Host,
+		TargetUser:            target.User,
+		SSHOpts:               target.SSHOpts,
+		Transport:             target.Transport,
+		SSHPassword:           target.Password,
+		SSHRetries:            target.Retries,
+		Escalation:            target.Escalation,
+		EscalationFlags:       target.EscalationFlags,
+		RemoteTempDir:         target.TempDir,
+		CommandTimeout:        target.CommandTimeout,
+		RemoteCommandTemplate: target.CommandTemplate,
+		CopyCommandTemplate:   target.CopyTemplate,
+	}
+}
+
+func resourceNixOSRollbackCreate(d *schema.ResourceData, m interface{}) error {
+	cfg := getRollbackConfig(d)
+
+	err := waitForSSH(context.Background(), d, cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts, time.Duration(d.Get("ssh_timeout").(int))*time.Second)
+	if err != nil {
+		return err
+	}
+
+	if generation, ok := d.GetOk("generation"); ok {
+		err = nix.SwitchGeneration(cfg, generation.(int))
+	} else if systemPath, ok := d.GetOk("system_path"); ok {
+		err = nix.SwitchToSystem(cfg, systemPath.(string))
+	} else {
+		err = errors.New("one of generation or system_path must be set")
+	}
+	if err != nil {
+		return err
+	}
+
+	d.SetId(randomID())
+
+	return resourceNixOSRollbackRead(d, m)
+}
+
+func resourceNixOSRollbackRead(d *schema.ResourceData, m interface{}) error {
+	cfg := getRollbackConfig(d)
+
+	currentSystem := "unknown"
+
+	err := waitForSSH(context.Background(), d, cfg.TargetUser, cfg.TargetHost, cfg.SSHOpts, time.Duration(d.Get("ssh_timeout").(int))*time.Second)
+	if err == nil {
+		currentSystem, err = nix.CurrentSystem(cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = d.Set("nixos_system", currentSystem)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func resourceNixOSRollbackDelete(d *schema.ResourceData, m interface{}) error {
+	return nil
+}
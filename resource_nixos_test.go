@@ -0,0 +1,566 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/configs/hcl2shim"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func testNixosConfig(t *testing.T, raw map[string]interface{}) nixosResourceConfig {
+	d := schema.TestResourceDataRaw(t, resourceNixOS().Schema, raw)
+	cfg, err := getNixosConfig(d, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestUsePlannedBuild(t *testing.T) {
+	f := newFakeNix(t)
+	raw := map[string]interface{}{
+		"target_host":  "example.com",
+		"nixos_config": "{ ... }: {}",
+	}
+
+	plan := testNixosConfig(t, raw)
+	system, err := plan.DoBuild()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if system != f.system {
+		t.Fatalf("plan built %q, expected %q", system, f.system)
+	}
+
+	apply := testNixosConfig(t, raw)
+	err = apply.UsePlannedBuild()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apply.SystemPath != f.system {
+		t.Fatalf("apply uses %q, expected the plan time build %q", apply.SystemPath, f.system)
+	}
+	if builds := f.calls(t, "nixos-rebuild"); len(builds) != 1 {
+		t.Fatalf("expected one build, got %q", builds)
+	}
+}
+
+func TestUsePlannedBuildChanged(t *testing.T) {
+	f := newFakeNix(t)
+	raw := map[string]interface{}{
+		"target_host":  "example.com",
+		"nixos_config": "{ ... }: {}",
+	}
+
+	// A file the config imports changed since the plan, so the system it
+	// evaluates to was never built.
+	f.write(t, "nix-instantiate", "#!/bin/sh\necho '\"/nix/store/missing-nixos-system\"'\n")
+	apply := testNixosConfig(t, raw)
+	err := apply.UsePlannedBuild()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apply.SystemPath != "" {
+		t.Fatalf("apply uses %q, expected a new build", apply.SystemPath)
+	}
+}
+
+func TestUsePlannedBuildDefer(t *testing.T) {
+	f := newFakeNix(t)
+
+	// A deferred plan built nothing, so an earlier build of the same system
+	// is not reused.
+	apply := testNixosConfig(t, map[string]interface{}{
+		"target_host":  "example.com",
+		"nixos_config": "{ ... }: {}",
+		"plan_mode":    "defer",
+	})
+	err := apply.UsePlannedBuild()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apply.SystemPath != "" {
+		t.Fatalf("apply uses %q, expected a new build", apply.SystemPath)
+	}
+	if evals := f.calls(t, "nix-instantiate"); len(evals) != 0 {
+		t.Fatalf("expected no evaluation, got %q", evals)
+	}
+}
+
+// planSwitch plans changing a resource deployed from before to after with
+// the given plan_mode, and reports whether applying the plan switches.
+func planSwitch(t *testing.T, mode, deployed string, before, after map[string]interface{}) bool {
+	d, err := planDiff(t, mode, deployed, before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d != nil && switchNeeded(d)
+}
+
+// planDiff plans changing a resource deployed from before to after with the
+// given plan_mode, returning the resource as apply sees it, or nil if
+// nothing changes.
+func planDiff(t *testing.T, mode, deployed string, before, after map[string]interface{}) (*schema.ResourceData, error) {
+	r := resourceNixOS()
+	prior := schema.TestResourceDataRaw(t, r.Schema, before)
+	prior.SetId("example")
+	// Read always records these, and a plan against state without them
+	// would show them as unknown.
+	for k, v := range map[string]interface{}{
+		"nixos_system":     deployed,
+		"units_to_reload":  []string{},
+		"units_to_restart": []string{},
+		"units_to_stop":    []string{},
+	} {
+		err := prior.Set(k, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	state := prior.State()
+
+	diff, err := r.Diff(state, terraform.NewResourceConfigRaw(after), &providerConfig{PlanMode: mode})
+	if err != nil || diff == nil {
+		return nil, err
+	}
+	return schema.InternalMap(r.Schema).Data(state, diff)
+}
+
+func TestSwitchNeeded(t *testing.T) {
+	f := newFakeNix(t)
+	base := map[string]interface{}{
+		"target_host":  "example.com",
+		"nixos_config": "{ ... }: {}",
+	}
+	with := func(k string, v interface{}) map[string]interface{} {
+		m := map[string]interface{}{k: v}
+		for k, v := range base {
+			m[k] = v
+		}
+		return m
+	}
+
+	for _, tc := range []struct {
+		name     string
+		mode     string
+		deployed string
+		after    map[string]interface{}
+		switches bool
+		builds   int
+	}{
+		{"build unchanged", "build", f.system, base, false, 1},
+		{"build changed system", "build", "/nix/store/old-nixos-system", base, true, 1},
+		// The plan time build shows the change doesn't touch the system.
+		{"build no-op change", "build", f.system, with("max_jobs", 4), false, 1},
+		{"build switch_action", "build", f.system, with("switch_action", "boot"), true, 1},
+		{"defer unchanged", "defer", f.system, base, false, 0},
+		// Without a build any changed input may change the system.
+		{"defer input change", "defer", f.system, with("build_args", map[string]interface{}{"release": "true"}), true, 0},
+		{"defer switch_action", "defer", f.system, with("switch_action", "boot"), true, 0},
+		// How the system is built or the target reached doesn't change it.
+		{"defer build option", "defer", f.system, with("max_jobs", 4), false, 0},
+		{"defer target_port", "defer", f.system, with("target_port", 2222), false, 0},
+		{"defer ssh_args", "defer", f.system, with("ssh_args", []interface{}{"-o", "ConnectTimeout=5"}), false, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := len(f.calls(t, "nixos-rebuild"))
+			if got := planSwitch(t, tc.mode, tc.deployed, base, tc.after); got != tc.switches {
+				t.Fatalf("switch = %v, expected %v", got, tc.switches)
+			}
+			if builds := len(f.calls(t, "nixos-rebuild")) - calls; builds != tc.builds {
+				t.Fatalf("planning built %d times, expected %d", builds, tc.builds)
+			}
+		})
+	}
+}
+
+func TestGetHooks(t *testing.T) {
+	for _, name := range []string{"pre_switch_hooks", "post_switch_hooks"} {
+		if !resourceNixOS().Schema[name].Sensitive {
+			t.Errorf("%s is not sensitive", name)
+		}
+	}
+
+	d := schema.TestResourceDataRaw(t, resourceNixOS().Schema, map[string]interface{}{
+		"target_host":       "example.com",
+		"pre_switch_hooks":  []interface{}{"./snapshot-db.sh", "echo $TOKEN"},
+		"post_switch_hooks": []interface{}{},
+	})
+	hooks := getHooks(d, "pre_switch")
+	if len(hooks) != 2 || hooks[0].Command != "./snapshot-db.sh" || hooks[1].Command != "echo $TOKEN" {
+		t.Fatalf("expected the hooks in order, got %+v", hooks)
+	}
+	for i, hook := range hooks {
+		if hook.Name != fmt.Sprintf("pre_switch_hooks[%d]", i) || !hook.Sensitive || hook.Remote {
+			t.Errorf("unexpected hook %+v", hook)
+		}
+	}
+	if hooks := getHooks(d, "post_switch"); len(hooks) != 0 {
+		t.Errorf("expected no post switch hooks, got %+v", hooks)
+	}
+}
+
+func TestPlanSpecialisation(t *testing.T) {
+	f := newFakeNix(t)
+	base := map[string]interface{}{
+		"target_host":  "example.com",
+		"nixos_config": "{ ... }: {}",
+	}
+
+	for _, tc := range []struct {
+		name           string
+		buildOnTarget  bool
+		specialisation string
+		exists         bool
+	}{
+		{"built here", false, "gpu", true},
+		{"missing here", false, "cpu", false},
+		// The system is only on the target, its specialisations are
+		// evaluated.
+		{"built on target", true, "gpu", true},
+		{"missing on target", true, "cpu", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			after := map[string]interface{}{
+				"specialisation":  tc.specialisation,
+				"build_on_target": tc.buildOnTarget,
+			}
+			for k, v := range base {
+				after[k] = v
+			}
+			if tc.buildOnTarget {
+				f.write(t, "nix-instantiate", `#!/bin/sh
+case "$*" in
+*--expr*) echo '["gpu"]' ;;
+*) echo '"/nix/store/remote-nixos-system"' ;;
+esac
+`)
+			}
+			_, err := planDiff(t, "build", f.system, base, after)
+			if tc.exists && err != nil {
+				t.Fatal(err)
+			}
+			if !tc.exists && (err == nil || !strings.Contains(err.Error(), `specialisation "cpu" does not exist`)) {
+				t.Fatalf("expected the missing specialisation to fail the plan, got %v", err)
+			}
+		})
+	}
+}
+
+func TestMagicRollback(t *testing.T) {
+	const previousSystem = "/nix/store/00000000000000000000000000000000-nixos-system"
+	for _, tc := range []struct {
+		name      string
+		reachable bool
+		slowBuild bool
+	}{
+		{"confirmed", true, false},
+		// The new system cut off ssh, the target reverts itself.
+		{"unreachable", false, false},
+		// The confirm_timeout only starts once the system is copied.
+		{"slow build", true, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeNix(t)
+			if tc.slowBuild {
+				f.write(t, "nixos-rebuild", fmt.Sprintf("#!/bin/sh\nsleep 3\necho \"nixos-rebuild $*\" >> %s/calls\nln -s %s result\n", f.dir, f.system))
+			}
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			port := l.Addr().(*net.TCPAddr).Port
+			if tc.reachable {
+				defer l.Close()
+			} else {
+				l.Close()
+			}
+			f.fakeTarget(t, port, previousSystem)
+			f.fakeActivation(t)
+
+			cfg := testNixosConfig(t, map[string]interface{}{
+				"target_host":     "example.com",
+				"nixos_config":    "{ ... }: {}",
+				"magic_rollback":  true,
+				"confirm_timeout": 2,
+			})
+			err = cfg.DoSwitchWithMagicRollback()
+
+			revert := fmt.Sprintf("systemd-run --unit=terraform-nix-revert --on-active=2 /bin/sh -c nix-env -p /nix/var/nix/profiles/system --set %[1]s && %[1]s/bin/switch-to-configuration switch", previousSystem)
+			if calls := f.calls(t, "systemd-run"); len(calls) != 1 || calls[0] != revert {
+				t.Errorf("expected the revert to be scheduled with\n%s\ngot %q", revert, calls)
+			}
+			// The system is built and copied before the revert is
+			// scheduled, and only activated after.
+			if order := f.order(t, "nixos-rebuild", "nix-copy-closure", "systemd-run", "switch-to-configuration"); order != "nixos-rebuild nix-copy-closure systemd-run switch-to-configuration" {
+				t.Errorf("expected the build, copy, revert and activation in order, got %s", order)
+			}
+
+			cancelled := false
+			for _, call := range f.calls(t, "systemctl") {
+				cancelled = cancelled || call == "systemctl stop terraform-nix-revert.timer"
+			}
+			if tc.reachable {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !cancelled {
+					t.Error("the revert was not cancelled")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "it will be reverted to "+previousSystem) {
+				t.Errorf("expected the switch to fail unconfirmed, got %v", err)
+			}
+			if cancelled {
+				t.Error("the revert was cancelled without reaching the target")
+			}
+		})
+	}
+}
+
+func TestRequireConfirmation(t *testing.T) {
+	const previousSystem = "/nix/store/00000000000000000000000000000000-nixos-system"
+	for _, tc := range []struct {
+		name      string
+		slowBuild bool
+	}{
+		{"unconfirmed", false},
+		// The confirmation_timeout only starts once the system is copied.
+		{"slow build", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeNix(t)
+			if tc.slowBuild {
+				f.write(t, "nixos-rebuild", fmt.Sprintf("#!/bin/sh\nsleep 3\necho \"nixos-rebuild $*\" >> %s/calls\nln -s %s result\n", f.dir, f.system))
+			}
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			f.fakeTarget(t, l.Addr().(*net.TCPAddr).Port, previousSystem)
+			f.fakeActivation(t)
+
+			cfg := testNixosConfig(t, map[string]interface{}{
+				"target_host":          "example.com",
+				"nixos_config":         "{ ... }: {}",
+				"require_confirmation": true,
+				"confirmation_command": "false",
+				"confirmation_timeout": 2,
+			})
+			err = cfg.DoSwitchWithConfirmation()
+			if err == nil || !strings.Contains(err.Error(), "was not confirmed within 2s, it will be reverted to "+previousSystem) {
+				t.Errorf("expected the switch to fail unconfirmed, got %v", err)
+			}
+
+			// The system is built and copied before the revert is
+			// scheduled, and only activated after.
+			if order := f.order(t, "nixos-rebuild", "nix-copy-closure", "systemd-run", "switch-to-configuration"); order != "nixos-rebuild nix-copy-closure systemd-run switch-to-configuration" {
+				t.Errorf("expected the build, copy, revert and activation in order, got %s", order)
+			}
+			if calls := f.calls(t, "switch-to-configuration"); len(calls) != 1 || calls[0] != "switch-to-configuration test" {
+				t.Errorf("expected the system to be activated with test, got %q", calls)
+			}
+			for _, call := range f.calls(t, "systemctl") {
+				if call == "systemctl stop terraform-nix-revert.timer" {
+					t.Error("the revert was cancelled without a confirmation")
+				}
+			}
+		})
+	}
+}
+
+func TestConfigDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	deploy := filepath.Join(dir, "envs", "prod")
+	elsewhere := filepath.Join(dir, "elsewhere")
+	link := filepath.Join(dir, "prod")
+	for _, d := range []string{deploy, elsewhere} {
+		err = os.MkdirAll(d, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.Symlink(deploy, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	for _, tc := range []struct {
+		name      string
+		wd        string
+		raw       map[string]interface{}
+		reference string
+	}{
+		{"config_dir", deploy, map[string]interface{}{"config_dir": deploy, "nixos_config_path": "configuration.nix"}, deploy + "/configuration.nix"},
+		// As with terraform -chdir, the process runs in another directory.
+		{"config_dir elsewhere", elsewhere, map[string]interface{}{"config_dir": deploy, "nixos_config_path": "./configuration.nix"}, deploy + "/configuration.nix"},
+		{"absolute path", elsewhere, map[string]interface{}{"config_dir": deploy, "nixos_config_path": "/etc/nixos/configuration.nix"}, "/etc/nixos/configuration.nix"},
+		{"flake", elsewhere, map[string]interface{}{"config_dir": deploy, "flake": ".", "flake_attr": "host"}, deploy + "#host"},
+		{"path flake", elsewhere, map[string]interface{}{"config_dir": deploy, "flake": "path:../shared", "flake_attr": "host"}, "path:" + dir + "/envs/shared#host"},
+		// The symlink is kept, so plan and apply agree even if it is
+		// pointed elsewhere in between.
+		{"symlinked config_dir", elsewhere, map[string]interface{}{"config_dir": link, "nixos_config_path": "configuration.nix"}, link + "/configuration.nix"},
+		{"working directory", elsewhere, map[string]interface{}{"nixos_config_path": "configuration.nix"}, elsewhere + "/configuration.nix"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := os.Chdir(tc.wd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.raw["target_host"] = "example.com"
+			cfg := testNixosConfig(t, tc.raw)
+			if ref := cfg.configRef(); ref != tc.reference {
+				t.Errorf("got %q, expected %q", ref, tc.reference)
+			}
+		})
+	}
+}
+
+func TestPlanMissingConfig(t *testing.T) {
+	f := newFakeNix(t)
+	config := filepath.Join(f.dir, "configuration.nix")
+	f.write(t, "configuration.nix", "{ ... }: {}\n")
+	missing := filepath.Join(f.dir, "configuraton.nix")
+	before := map[string]interface{}{
+		"target_host":       "example.com",
+		"nixos_config_path": config,
+	}
+	with := func(path interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"target_host":       "example.com",
+			"nixos_config_path": path,
+		}
+	}
+
+	// A typo fails the plan.
+	_, err := planDiff(t, "build", f.system, before, with(missing))
+	if err == nil || err.Error() != "nixos_config: no such file or directory: "+missing {
+		t.Fatalf("expected the missing config to fail the plan, got %v", err)
+	}
+
+	// A path from another resource is only known at apply.
+	d, err := planDiff(t, "build", f.system, before, with(hcl2shim.UnknownVariableValue))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == nil || d.Get("nixos_system").(string) != "" {
+		t.Fatal("expected nixos_system to be unknown until apply")
+	}
+
+	// An existing config that doesn't build may import generated files, the
+	// switch reports the failure.
+	f.write(t, "nixos-rebuild", "#!/bin/sh\necho 'error: file generated.nix was not found' >&2\nexit 1\n")
+	f.write(t, "configuration.nix", "{ ... }: { imports = [ ./generated.nix ]; }\n")
+	d, err = planDiff(t, "build", "/nix/store/00000000000000000000000000000000-nixos-system", before, before)
+	if err != nil {
+		t.Fatalf("expected the failed build to be left to apply, got %v", err)
+	}
+	if d == nil || d.Get("nixos_system").(string) != "" {
+		t.Fatal("expected nixos_system to be unknown after the failed build")
+	}
+}
+
+func TestNixosConfigExpr(t *testing.T) {
+	f := newFakeNix(t)
+	const expr = "{ ... }: { networking.hostName = \"web\"; }\n"
+	raw := map[string]interface{}{
+		"target_host":       "example.com",
+		"nixos_config_expr": expr,
+	}
+
+	// Plan and apply build the same file, under the data directory.
+	plan := testNixosConfig(t, raw)
+	apply := testNixosConfig(t, raw)
+	if plan.NixosConfigPath != apply.NixosConfigPath {
+		t.Fatalf("the config moved from %s to %s", plan.NixosConfigPath, apply.NixosConfigPath)
+	}
+	if !strings.HasPrefix(plan.NixosConfigPath, filepath.Join(f.dir, "data")+"/") {
+		t.Fatalf("the config was put in %s", plan.NixosConfigPath)
+	}
+	_, err := plan.DoBuild()
+	if err != nil {
+		t.Fatal(err)
+	}
+	written, err := ioutil.ReadFile(plan.NixosConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(written) != expr {
+		t.Errorf("%s was written, expected %s", written, expr)
+	}
+
+	// A changed expression is a changed system.
+	changed := map[string]interface{}{
+		"target_host":       "example.com",
+		"nixos_config_expr": "{ ... }: {}",
+	}
+	d, err := planDiff(t, "build", f.system, raw, changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == nil || d.Get("nixos_system").(string) != "" {
+		t.Error("expected nixos_system to be unknown once nixos_config_expr changed")
+	}
+
+	for _, other := range []string{"nixos_config", "nixos_config_path", "flake"} {
+		_, errs := resourceNixOS().Validate(terraform.NewResourceConfigRaw(map[string]interface{}{
+			"target_host":       "example.com",
+			"nixos_config_expr": expr,
+			other:               "./configuration.nix",
+		}))
+		if len(errs) == 0 {
+			t.Errorf("nixos_config_expr was accepted together with %s", other)
+		}
+	}
+}
+
+func TestNegativeCountsRejected(t *testing.T) {
+	for _, tc := range []map[string]interface{}{
+		{"switch_retries": -1},
+		{"lock_timeout": -1},
+		{"confirm_timeout": -1},
+		{"confirmation_timeout": -1},
+		{"reboot_timeout": -1},
+		{"health_http_timeout": -1},
+		{"health_check": []interface{}{map[string]interface{}{"command": "true", "retries": -1}}},
+		{"health_check": []interface{}{map[string]interface{}{"command": "true", "interval": -1}}},
+	} {
+		tc["target_host"] = "example.com"
+		tc["nixos_config"] = "{ ... }: {}"
+		_, errs := resourceNixOS().Validate(terraform.NewResourceConfigRaw(tc))
+		if len(errs) == 0 {
+			t.Errorf("%v was accepted", tc)
+		}
+	}
+
+	_, errs := resourceNixOS().Validate(terraform.NewResourceConfigRaw(map[string]interface{}{
+		"target_host":    "example.com",
+		"nixos_config":   "{ ... }: {}",
+		"switch_retries": 0,
+		"lock_timeout":   0,
+	}))
+	if len(errs) != 0 {
+		t.Errorf("zero was refused: %v", errs)
+	}
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+// sshSchema adds the ssh connection attributes shared by resources that
+// connect to a target to s. Resources without an update set forceNew.
+func sshSchema(s map[string]*schema.Schema, forceNew bool) map[string]*schema.Schema {
+	shared := map[string]*schema.Schema{
+		"transport": &schema.Schema{
+			Type:         schema.TypeString,
+			Optional:     true,
+			Default:      "openssh",
+			ValidateFunc: validation.StringInSlice([]string{"openssh", "go-ssh"}, false),
+		},
+		"ssh_args": &schema.Schema{
+			Type:          schema.TypeList,
+			Optional:      true,
+			Elem:          &schema.Schema{Type: schema.TypeString},
+			ConflictsWith: []string{"ssh_opts"},
+		},
+		"ssh_password": &schema.Schema{
+			Type:      schema.TypeString,
+			Optional:  true,
+			Sensitive: true,
+		},
+		"ssh_private_key": &schema.Schema{
+			Type:          schema.TypeString,
+			Optional:      true,
+			Sensitive:     true,
+			ConflictsWith: []string{"ssh_private_key_file"},
+		},
+		"ssh_private_key_file": &schema.Schema{
+			Type:     schema.TypeString,
+			Optional: true,
+			// NIX_SSHOPTS is split on whitespace.
+			ValidateFunc: validation.StringMatch(noWhitespaceRegexp, "must not contain whitespace"),
+		},
+		"bastion_host": &schema.Schema{
+			Type:          schema.TypeString,
+			Optional:      true,
+			ConflictsWith: []string{"bastion_jumps"},
+		},
+		"bastion_user": &schema.Schema{
+			Type:     schema.TypeString,
+			Optional: true,
+		},
+		"bastion_port": &schema.Schema{
+			Type:         schema.TypeInt,
+			Optional:     true,
+			Default:      22,
+			ValidateFunc: validation.IntBetween(1, 65535),
+		},
+		"proxy_command": &schema.Schema{
+			Type:          schema.TypeString,
+			Optional:      true,
+			ConflictsWith: []string{"bastion_host", "bastion_jumps"},
+			ValidateFunc:  validation.StringMatch(singleLineRegexp, "must be a single line"),
+		},
+		"host_key": &schema.Schema{
+			Type:         schema.TypeString,
+			Optional:     true,
+			ValidateFunc: validateHostKey,
+		},
+		"known_hosts_mode": &schema.Schema{
+			Type:         schema.TypeString,
+			Optional:     true,
+			Default:      "system",
+			ValidateFunc: validation.StringInSlice([]string{"system", "isolated", "replace-on-mismatch"}, false),
+		},
+		"ssh_poll_interval": &schema.Schema{
+			Type:         schema.TypeInt,
+			Optional:     true,
+			Default:      2,
+			ValidateFunc: validation.IntAtLeast(1),
+		},
+		"ssh_poll_max_interval": &schema.Schema{
+			Type:         schema.TypeInt,
+			Optional:     true,
+			Default:      30,
+			ValidateFunc: validation.IntAtLeast(1),
+		},
+		"ssh_retries": &schema.Schema{
+			Type:         schema.TypeInt,
+			Optional:     true,
+			Default:      0,
+			ValidateFunc: validation.IntAtLeast(0),
+		},
+		"use_sudo": &schema.Schema{
+			Type:          schema.TypeBool,
+			Optional:      true,
+			Default:       false,
+			Deprecated:    "use escalation = \"sudo\" instead",
+			ConflictsWith: []string{"escalation"},
+		},
+		"escalation": &schema.Schema{
+			Type:         schema.TypeString,
+			Optional:     true,
+			ValidateFunc: validation.StringInSlice([]string{"none", "sudo", "doas"}, false),
+		},
+		"escalation_flags": &schema.Schema{
+			Type:         schema.TypeString,
+			Optional:     true,
+			ValidateFunc: validation.StringMatch(singleLineRegexp, "must be a single line"),
+		},
+		"remote_temp_dir": &schema.Schema{
+			Type:         schema.TypeString,
+			Optional:     true,
+			ValidateFunc: validateAbsolutePath,
+		},
+		"command_timeout": &schema.Schema{
+			Type:         schema.TypeInt,
+			Optional:     true,
+			Default:      600,
+			ValidateFunc: validation.IntAtLeast(0),
+		},
+		"remote_command_template": &schema.Schema{
+			Type:         schema.TypeString,
+			Optional:     true,
+			ValidateFunc: validateCommandTemplate,
+		},
+		"copy_command_template": &schema.Schema{
+			Type:         schema.TypeString,
+			Optional:     true,
+			ValidateFunc: validateCommandTemplate,
+		},
+		"ssh_multiplex": &schema.Schema{
+			Type:     schema.TypeBool,
+			Optional: true,
+			Default:  false,
+		},
+		"bastion_jumps": &schema.Schema{
+			Type:     schema.TypeList,
+			Optional: true,
+			Elem: &schema.Schema{
+				Type:         schema.TypeString,
+				ValidateFunc: validation.StringMatch(noWhitespaceRegexp, "must not contain whitespace"),
+			},
+		},
+	}
+	for name, attr := range shared {
+		attr.ForceNew = forceNew
+		s[name] = attr
+	}
+	return s
+}
+
+// sshTarget is where a resource connects to with ssh.
+type sshTarget struct {
+	User            string
+	Host            string
+	SSHOpts         string
+	Transport       string
+	Password        string
+	Retries         int
+	Escalation      string
+	EscalationFlags string
+	TempDir         string
+	CommandTimeout  time.Duration
+	CommandTemplate string
+	CopyTemplate    string
+}
+
+// getSSHTarget reads the target_host, target_user and target_port of a
+// resource. target_host can also be written as user@host:port, the parts it
+// gives override target_user and target_port. The port is passed to ssh in
+// the returned ssh options, which every command connecting to the target
+// uses, including nix-copy-closure and nixos-rebuild through NIX_SSHOPTS.
+func getSSHTarget(d resourceLike, sshOpts string) sshTarget {
+	target := sshTarget{
+		User:            d.Get("target_user").(string),
+		SSHOpts:         sshOpts,
+		Transport:       d.Get("transport").(string),
+		Password:        d.Get("ssh_password").(string),
+		Retries:         d.Get("ssh_retries").(int),
+		Escalation:      d.Get("escalation").(string),
+		EscalationFlags: d.Get("escalation_flags").(string),
+		TempDir:         d.Get("remote_temp_dir").(string),
+		CommandTimeout:  time.Duration(d.Get("command_timeout").(int)) * time.Second,
+		CommandTemplate: d.Get("remote_command_template").(string),
+		CopyTemplate:    d.Get("copy_command_template").(string),
+	}
+	if target.Escalation == "" && d.Get("use_sudo").(bool) {
+		target.Escalation = "sudo"
+	}
+	if args := stringList(d.Get("ssh_args")); len(args) != 0 {
+		target.SSHOpts = shellJoin(args)
+	}
+
+	host := d.Get("target_host").(string)
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		target.User = host[:i]
+		host = host[i+1:]
+	}
+	port := d.Get("target_port").(int)
+	host, hostPort := splitHostPort(host)
+	if hostPort != 0 {
+		port = hostPort
+	}
+	target.Host = host
+
+	if key := d.Get("ssh_private_key").(string); key != "" {
+		target.SSHOpts = strings.TrimSpace(fmt.Sprintf("%s -i %s -o IdentitiesOnly=yes", target.SSHOpts, sshFilePath(sshKeyContent(key))))
+	} else if keyFile := d.Get("ssh_private_key_file").(string); keyFile != "" {
+		target.SSHOpts = strings.TrimSpace(fmt.Sprintf("%s -i %s -o IdentitiesOnly=yes", target.SSHOpts, keyFile))
+	}
+
+	if config := sshConfig(d); config != "" {
+		target.SSHOpts = strings.TrimSpace(fmt.Sprintf("%s -F %s", target.SSHOpts, sshFilePath(config)))
+	}
+
+	// ssh uses the first value given for an option, so these must come
+	// before the ssh_opts, which usually set StrictHostKeyChecking.
+	if d.Get("known_hosts_mode").(string) == "isolated" {
+		target.SSHOpts = fmt.Sprintf("-o UserKnownHostsFile=%s %s", isolatedKnownHosts(target.Host), target.SSHOpts)
+	}
+	if hostKey := d.Get("host_key").(string); strings.HasPrefix(hostKey, "SHA256:") {
+		target.SSHOpts = "-o UserKnownHostsFile=/dev/null -o GlobalKnownHostsFile=/dev/null -o StrictHostKeyChecking=yes " + target.SSHOpts
+	} else if hostKey != "" {
+		target.SSHOpts = fmt.Sprintf("-o UserKnownHostsFile=%s -o GlobalKnownHostsFile=/dev/null -o StrictHostKeyChecking=yes -o HostKeyAlias=%s %s", sshFilePath(knownHosts(hostKey)), pinnedHostKeyAlias, target.SSHOpts)
+	}
+
+	if jumps := getBastionJumps(d); len(jumps) != 0 {
+		target.SSHOpts = strings.TrimSpace(fmt.Sprintf("%s -o ProxyJump=%s", target.SSHOpts, strings.Join(jumps, ",")))
+	}
+
+	if d.Get("ssh_multiplex").(bool) {
+		if dir := sshControlDir(); dir != "" {
+			target.SSHOpts = strings.TrimSpace(fmt.Sprintf("%s -o ControlMaster=auto -o ControlPath=%s/%%C -o ControlPersist=60s", target.SSHOpts, dir))
+		}
+	}
+
+	if port != 0 && port != 22 {
+		target.SSHOpts = strings.TrimSpace(fmt.Sprintf("%s -p %d", target.SSHOpts, port))
+	}
+	return target
+}
+
+var shellSafeRegexp = regexp.MustCompile(`^[a-zA-Z0-9_@%+=:,./-]+$`)
+
+// shellJoin joins args into a string sh splits back into args. Arguments
+// that need no quoting are left alone, so the result is also split correctly
+// on whitespace by tools that don't understand quotes.
+func shellJoin(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		if shellSafeRegexp.MatchString(arg) {
+			quoted = append(quoted, arg)
+		} else {
+			quoted = append(quoted, "'"+strings.Replace(arg, "'", `'"'"'`, -1)+"'")
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// getBastionJumps returns the hosts ssh jumps through to reach the target,
+// from bastion_host or the [user@]host[:port] entries of bastion_jumps.
+func getBastionJumps(d resourceLike) []string {
+	if host := d.Get("bastion_host").(string); host != "" {
+		return []string{jumpSpec(d.Get("bastion_user").(string), host, d.Get("bastion_port").(int))}
+	}
+
+	var jumps []string
+	for _, jump := range stringList(d.Get("bastion_jumps")) {
+		user := ""
+		if i := strings.LastIndex(jump, "@"); i >= 0 {
+			user = jump[:i]
+			jump = jump[i+1:]
+		}
+		host, port := splitHostPort(jump)
+		jumps = append(jumps, jumpSpec(user, host, port))
+	}
+	return jumps
+}
+
+// jumpSpec formats a host for ProxyJump, which needs IPv6 literals
+// bracketed. A zero port leaves the port to ssh.
+func jumpSpec(user, host string, port int) string {
+	spec := host
+	if strings.Contains(host, ":") {
+		spec = "[" + host + "]"
+	}
+	if port != 0 && port != 22 {
+		spec = fmt.Sprintf("%s:%d", spec, port)
+	}
+	if user != "" {
+		spec = user + "@" + spec
+	}
+	return spec
+}
+
+// splitHostPort splits the port off host:port or [host]:port, the brackets
+// needed to give a port with an IPv6 literal are removed. Hosts without a
+// port, including bare IPv6 literals, are returned as they are.
+func splitHostPort(host string) (string, int) {
+	if strings.HasPrefix(host, "[") {
+		end := strings.Index(host, "]")
+		if end < 0 {
+			return host, 0
+		}
+		port, _ := parsePort(strings.TrimPrefix(host[end+1:], ":"))
+		return host[1:end], port
+	}
+	if strings.Count(host, ":") != 1 {
+		return host, 0
+	}
+	i := strings.Index(host, ":")
+	port, ok := parsePort(host[i+1:])
+	if !ok {
+		return host, 0
+	}
+	return host[:i], port
+}
+
+// parsePort parses a tcp port number.
+func parsePort(s string) (int, bool) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, false
+	}
+	return port, true
+}
+
+// maxControlDirLen keeps control sockets under the unix socket path limit,
+// 104 bytes on some systems, leaving room for the 40 byte %C hash and the
+// random suffix ssh adds while creating a socket.
+const maxControlDirLen = 104 - 1 - 40 - 17 - 1
+
+var (
+	// sshControlDirMu guards sshControlDirPath, which closeSSHMasters clears
+	// while resources may still be running commands.
+	sshControlDirMu   sync.Mutex
+	sshControlDirOnce sync.Once
+	sshControlDirPath string
+)
+
+// sshControlDir returns the directory the ssh_multiplex control sockets of
+// this provider process are kept in, or "" if no short enough directory
+// could be made, which disables multiplexing. Masters exit and remove their
+// sockets once idle for ControlPersist, or when closeSSHMasters is called.
+func sshControlDir() string {
+	sshControlDirMu.Lock()
+	defer sshControlDirMu.Unlock()
+	sshControlDirOnce.Do(func() {
+		for _, base := range []string{os.TempDir(), "/tmp"} {
+			if len(base)+len("/terraform-nix-mux123456789") > maxControlDirLen {
+				continue
+			}
+			dir, err := ioutil.TempDir(base, "terraform-nix-mux")
+			if err != nil {
+				log.Printf("[WARN] unable to create a directory for ssh control sockets: %s", err)
+				continue
+			}
+			sshControlDirPath = dir
+			return
+		}
+		log.Printf("[WARN] no directory for ssh control sockets, ssh_multiplex is disabled")
+	})
+	return sshControlDirPath
+}
+
+// closeSSHMasters asks the ssh_multiplex masters of this provider process to
+// exit and removes their control directory, once the provider is stopped or
+// exits. Later connections are not multiplexed.
+func closeSSHMasters() {
+	sshControlDirMu.Lock()
+	// Without a directory yet, none is made.
+	sshControlDirOnce.Do(func() {})
+	dir := sshControlDirPath
+	sshControlDirPath = ""
+	sshControlDirMu.Unlock()
+	if dir == "" {
+		return
+	}
+
+	sockets, _ := filepath.Glob(filepath.Join(dir, "*"))
+	for _, socket := range sockets {
+		// The host is required but unused, the socket names the master.
+		output, err := exec.Command("ssh", "-o", "ControlPath="+socket, "-O", "exit", "terraform-nix-mux").CombinedOutput()
+		if err != nil {
+			log.Printf("[DEBUG] unable to stop the ssh master %s: %s: %s", socket, err, output)
+		}
+	}
+	err := os.RemoveAll(dir)
+	if err != nil {
+		log.Printf("[WARN] unable to remove the ssh control directory %s: %s", dir, err)
+	}
+}
+
+// sshFiles counts the users of each file written for ssh by acquireSSHFile.
+var sshFiles = struct {
+	sync.Mutex
+	users map[string]int
+}{users: make(map[string]int)}
+
+var (
+	sshFileDirOnce sync.Once
+	sshFileDir     string
+	sshFileDirErr  error
+)
+
+// sshFilePath returns the file content is written to while a resource
+// operation uses it, in a directory only we can read.
+func sshFilePath(content string) string {
+	sshFileDirOnce.Do(func() {
+		sshFileDir, sshFileDirErr = ioutil.TempDir("", "terraform-nix-ssh")
+	})
+	sum := sha256.Sum256([]byte(content))
+	return filepath.Join(sshFileDir, hex.EncodeToString(sum[:8]))
+}
+
+// acquireSSHFile writes content to its sshFilePath with mode 0600, the
+// returned release removes it once no operation uses it any more.
+func acquireSSHFile(content string) (func(), error) {
+	path := sshFilePath(content)
+	if sshFileDirErr != nil {
+		return nil, fmt.Errorf("unable to create a directory for ssh files: %s", sshFileDirErr)
+	}
+
+	sshFiles.Lock()
+	defer sshFiles.Unlock()
+	if sshFiles.users[path] == 0 {
+		err := ioutil.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			_ = os.Remove(path)
+			return nil, err
+		}
+	}
+	sshFiles.users[path]++
+
+	return func() {
+		sshFiles.Lock()
+		defer sshFiles.Unlock()
+		sshFiles.users[path]--
+		if sshFiles.users[path] == 0 {
+			delete(sshFiles.users, path)
+			_ = os.Remove(path)
+		}
+	}, nil
+}
+
+// sshKeyContent returns the ssh_private_key key as it is written to a file,
+// ssh rejects keys without a final newline.
+func sshKeyContent(key string) string {
+	if !strings.HasSuffix(key, "\n") {
+		key += "\n"
+	}
+	return key
+}
+
+// isolatedKnownHosts returns the known_hosts file used for host with
+// known_hosts_mode = "isolated", kept apart from ~/.ssh/known_hosts.
+func isolatedKnownHosts(host string) string {
+	path, err := filepath.Abs(filepath.Join(nixDataDir(), "known_hosts", host))
+	if err != nil {
+		return filepath.Join(nixDataDir(), "known_hosts", host)
+	}
+	return path
+}
+
+// waitForSSH is nix.WaitForSSH, with known_hosts_mode = "replace-on-mismatch"
+// a changed host key is forgotten and the connection retried once.
+func waitForSSH(ctx context.Context, d resourceLike, user, host, sshOpts string, timeout time.Duration) error {
+	client := nix.SSHClient{
+		Transport:       d.Get("transport").(string),
+		Password:        d.Get("ssh_password").(string),
+		CommandTemplate: d.Get("remote_command_template").(string),
+	}
+	poll := getSSHPoll(d)
+	err := nix.WaitForSSH(ctx, user, host, sshOpts, client, poll, timeout)
+	if !nix.IsHostKeyChangedError(err) || d.Get("known_hosts_mode").(string) != "replace-on-mismatch" {
+		return err
+	}
+
+	log.Printf("[WARN] the host key of %s changed, replacing it in known_hosts", host)
+	err = nix.ForgetHostKey(user, host, sshOpts, client)
+	if err != nil {
+		return err
+	}
+	return nix.WaitForSSH(ctx, user, host, sshOpts, client, poll, timeout)
+}
+
+// getSSHPoll reads how often a resource polls its target while waiting for
+// it to come up.
+func getSSHPoll(d resourceLike) nix.SSHPoll {
+	return nix.SSHPoll{
+		Interval:    time.Duration(d.Get("ssh_poll_interval").(int)) * time.Second,
+		MaxInterval: time.Duration(d.Get("ssh_poll_max_interval").(int)) * time.Second,
+	}
+}
+
+// pinnedHostKeyAlias is the name the host_key of a target is recorded
+// under, so it matches whatever host name and port ssh connects with.
+const pinnedHostKeyAlias = "terraform-nix-pinned-host"
+
+// knownHosts returns a known_hosts file holding the host_key public key
+// line, with or without the host names of a known_hosts line.
+func knownHosts(hostKey string) string {
+	fields := strings.Fields(hostKey)
+	if len(fields) > 2 && !sshKeyTypeRegexp.MatchString(fields[0]) {
+		fields = fields[1:]
+	}
+	return fmt.Sprintf("%s %s\n", pinnedHostKeyAlias, strings.Join(fields[:2], " "))
+}
+
+// sshConfig returns an ssh config for the options that can't be passed as
+// arguments, or "" if none are needed. It is passed with -F, as NIX_SSHOPTS
+// can't hold values with spaces, and for openssh includes the usual configs,
+// which -F replaces. The go-ssh transport never reads them.
+func sshConfig(d resourceLike) string {
+	var config []string
+	if command := d.Get("proxy_command").(string); command != "" {
+		config = append(config, "ProxyCommand "+command)
+	}
+	// A host_key fingerprint can't be written to a known_hosts file, the
+	// key the host presents is accepted if its fingerprint matches.
+	if hostKey := d.Get("host_key").(string); strings.HasPrefix(hostKey, "SHA256:") {
+		config = append(config, fmt.Sprintf(`KnownHostsCommand /bin/sh -c 'test "$1" = "$2" && echo "$3 $4 $5"' - %s %%f %%H %%t %%K`, strings.TrimRight(hostKey, "=")))
+	}
+	if len(config) == 0 {
+		return ""
+	}
+	if d.Get("transport").(string) != "go-ssh" {
+		config = append(config, "Include ~/.ssh/config", "Include /etc/ssh/ssh_config")
+	}
+	return strings.Join(config, "\n") + "\n"
+}
+
+// acquireSSHFiles writes the files getSSHTarget passes to ssh for a resource,
+// the returned release removes them.
+func acquireSSHFiles(d resourceLike) (func(), error) {
+	var releases []func()
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+
+	goSSH := d.Get("transport").(string) == "go-ssh"
+	if goSSH && strings.HasPrefix(d.Get("host_key").(string), "SHA256:") {
+		return nil, errors.New("the go-ssh transport needs the host_key public key, not its fingerprint")
+	}
+	if goSSH || d.Get("ssh_password").(string) != "" {
+		err := nix.PrepareSSHHelpers()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if key := d.Get("ssh_private_key").(string); key != "" {
+		r, err := acquireSSHFile(sshKeyContent(key))
+		if err != nil {
+			return nil, fmt.Errorf("unable to write ssh_private_key: %s", err)
+		}
+		releases = append(releases, r)
+	}
+
+	if command := d.Get("proxy_command").(string); command != "" {
+		log.Printf("[DEBUG] connecting to %s with ProxyCommand %s", d.Get("target_host"), command)
+	}
+	if config := sshConfig(d); config != "" {
+		r, err := acquireSSHFile(config)
+		if err != nil {
+			release()
+			return nil, fmt.Errorf("unable to write an ssh config: %s", err)
+		}
+		releases = append(releases, r)
+	}
+
+	if d.Get("known_hosts_mode").(string) == "isolated" {
+		err := os.MkdirAll(filepath.Join(nixDataDir(), "known_hosts"), 0700)
+		if err != nil {
+			release()
+			return nil, err
+		}
+	}
+
+	if hostKey := d.Get("host_key").(string); hostKey != "" && !strings.HasPrefix(hostKey, "SHA256:") {
+		r, err := acquireSSHFile(knownHosts(hostKey))
+		if err != nil {
+			release()
+			return nil, fmt.Errorf("unable to write a known_hosts file for host_key: %s", err)
+		}
+		releases = append(releases, r)
+	}
+
+	return release, nil
+}
+
+// withSSHFiles wraps a resource operation so the files needed by its ssh
+// options, like the ssh_private_key, exist while it runs.
+func withSSHFiles(f func(*schema.ResourceData, interface{}) error) func(*schema.ResourceData, interface{}) error {
+	return func(d *schema.ResourceData, m interface{}) error {
+		release, err := acquireSSHFiles(d)
+		if err != nil {
+			return err
+		}
+		defer release()
+		return f(d, m)
+	}
+}
+
+// withSSHFilesDiff is withSSHFiles for CustomizeDiff, which may connect to
+// the target to build on it.
+func withSSHFilesDiff(f schema.CustomizeDiffFunc) schema.CustomizeDiffFunc {
+	return func(d *schema.ResourceDiff, m interface{}) error {
+		release, err := acquireSSHFiles(d)
+		if err != nil {
+			return err
+		}
+		defer release()
+		return f(d, m)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func TestSSHConfig(t *testing.T) {
+	for _, tc := range []struct {
+		raw      map[string]interface{}
+		expected string
+	}{
+		{map[string]interface{}{}, ""},
+		{
+			map[string]interface{}{"proxy_command": "nc %h %p"},
+			"ProxyCommand nc %h %p\nInclude ~/.ssh/config\nInclude /etc/ssh/ssh_config\n",
+		},
+		// go-ssh reads no other config files, so none are included.
+		{
+			map[string]interface{}{"proxy_command": "nc %h %p", "transport": "go-ssh"},
+			"ProxyCommand nc %h %p\n",
+		},
+	} {
+		d := schema.TestResourceDataRaw(t, resourceNixOS().Schema, tc.raw)
+		if got := sshConfig(d); got != tc.expected {
+			t.Errorf("sshConfig(%v):\n got %q\nwant %q", tc.raw, got, tc.expected)
+		}
+	}
+}
+
+func TestGetSSHTargetPort(t *testing.T) {
+	for _, tc := range []struct {
+		raw     map[string]interface{}
+		user    string
+		host    string
+		sshOpts string
+	}{
+		{map[string]interface{}{"target_host": "example.com"}, "root", "example.com", ""},
+		{map[string]interface{}{"target_host": "example.com", "target_port": 2222}, "root", "example.com", "-p 2222"},
+		{map[string]interface{}{"target_host": "admin@example.com:2222"}, "admin", "example.com", "-p 2222"},
+		// The port in target_host wins.
+		{map[string]interface{}{"target_host": "example.com:2222", "target_port": 3333}, "root", "example.com", "-p 2222"},
+		{map[string]interface{}{"target_host": "example.com", "target_port": 22}, "root", "example.com", ""},
+		{map[string]interface{}{"target_host": "[2001:db8::10]:2222"}, "root", "2001:db8::10", "-p 2222"},
+		{map[string]interface{}{"target_host": "2001:db8::10"}, "root", "2001:db8::10", ""},
+	} {
+		d := schema.TestResourceDataRaw(t, resourceNixOS().Schema, tc.raw)
+		target := getSSHTarget(d, "")
+		if target.User != tc.user || target.Host != tc.host || target.SSHOpts != tc.sshOpts {
+			t.Errorf("%v: got %s@%s with %q, expected %s@%s with %q", tc.raw, target.User, target.Host, target.SSHOpts, tc.user, tc.host, tc.sshOpts)
+		}
+	}
+}
+
+func TestTargetPortReachesCopy(t *testing.T) {
+	const system = "/nix/store/00000000000000000000000000000000-nixos-system"
+	f := newFakeNix(t)
+	f.fakeTarget(t, 2222, system)
+	// The closure is only the system and missing on the target, which is
+	// the same machine, and it is copied with nix-copy-closure.
+	f.write(t, "nix-store", `#!/bin/sh
+case "$*" in
+"--query --requisites "*) echo "$3" ;;
+"--query --size "*) echo 0 ;;
+"--check-validity --print-invalid "*) shift 2; printf '%s\n' "$@" ;;
+esac
+`)
+	f.write(t, "target/nix-store", "#!/bin/sh\nexec "+f.dir+"/nix-store \"$@\"\n")
+	f.write(t, "nix-copy-closure", fmt.Sprintf("#!/bin/sh\necho \"nix-copy-closure $* NIX_SSHOPTS=$NIX_SSHOPTS\" >> %s/calls\n", f.dir))
+
+	cfg := testNixosConfig(t, map[string]interface{}{
+		"target_host":  "example.com",
+		"target_port":  2222,
+		"nixos_config": "{ ... }: {}",
+	})
+	err := nix.CopyClosure(cfg.GetRebuildConfig(), system)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := f.calls(t, "nix-copy-closure")
+	if len(calls) != 1 || !strings.Contains(calls[0], " --to root@example.com "+system+" NIX_SSHOPTS=") || !strings.HasSuffix(calls[0], " -p 2222") {
+		t.Errorf("expected a copy to root@example.com with -p 2222 in NIX_SSHOPTS, got %q", calls)
+	}
+}
+
+// shellWords returns the words sh splits s into.
+func shellWords(t *testing.T, s string) []string {
+	out, err := exec.Command("sh", "-c", `set -f; for a in `+s+`; do printf '%s\n' "$a"; done`).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+}
+
+func TestBastionJumps(t *testing.T) {
+	for _, tc := range []struct {
+		raw      map[string]interface{}
+		expected string
+	}{
+		{map[string]interface{}{"bastion_host": "bastion.example.com"}, "-o ProxyJump=bastion.example.com"},
+		{map[string]interface{}{"bastion_host": "bastion.example.com", "bastion_user": "jump", "bastion_port": 2222}, "-o ProxyJump=jump@bastion.example.com:2222"},
+		{map[string]interface{}{"bastion_host": "2001:db8::1", "bastion_port": 2222}, "-o ProxyJump=[2001:db8::1]:2222"},
+		{
+			map[string]interface{}{"bastion_jumps": []interface{}{"jump@outer.example.com:2222", "inner.example.com", "[2001:db8::1]:22"}},
+			"-o ProxyJump=jump@outer.example.com:2222,inner.example.com,[2001:db8::1]",
+		},
+	} {
+		tc.raw["target_host"] = "example.com"
+		d := schema.TestResourceDataRaw(t, resourceNixOS().Schema, tc.raw)
+		sshOpts := getSSHTarget(d, "").SSHOpts
+		if sshOpts != tc.expected {
+			t.Errorf("%v: got %q, expected %q", tc.raw, sshOpts, tc.expected)
+		}
+
+		// nix-copy-closure splits NIX_SSHOPTS on whitespace, the commands
+		// run with sh split it as words, both must see the same options.
+		if words := shellWords(t, sshOpts); !reflect.DeepEqual(words, strings.Fields(sshOpts)) {
+			t.Errorf("%v: sh splits %q into %q", tc.raw, sshOpts, words)
+		}
+	}
+}
+
+func TestShellJoin(t *testing.T) {
+	for _, args := range [][]string{
+		{"-p", "2222"},
+		{"-o", "ProxyCommand=ssh -W %h:%p jump"},
+		{"-o", `SetEnv=GREETING="it's here"`},
+		{"-o", "ControlPath=~/.ssh/%C", "-i", "/keys/id ed25519"},
+		{"-o", "LocalCommand=echo $HOME `id` \\ *"},
+	} {
+		joined := shellJoin(args)
+		if words := shellWords(t, joined); !reflect.DeepEqual(words, args) {
+			t.Errorf("shellJoin(%q) = %s, which sh splits into %q", args, joined, words)
+		}
+	}
+	// Safe arguments stay readable.
+	if joined := shellJoin([]string{"-o", "ProxyJump=jump@host:22,other", "-p", "%p"}); joined != "-o ProxyJump=jump@host:22,other -p %p" {
+		t.Errorf("safe arguments were quoted: %s", joined)
+	}
+}
+
+func TestSSHArgsReachSSH(t *testing.T) {
+	f := newFakeNix(t)
+	f.fakeTarget(t, 22, "/nix/store/00000000000000000000000000000000-nixos-system")
+	// Each argument ssh gets on its own line.
+	f.write(t, "target/ssh", fmt.Sprintf("#!/bin/sh\nprintf '%%s\\n' \"$@\" > %s/ssh-args\n", f.dir))
+
+	sshArgs := []string{"-o", "ProxyCommand=ssh -W %h:%p jump", "-o", `SetEnv=GREETING="it's here"`, "-i", "/keys/id ed25519"}
+	raw := map[string]interface{}{
+		"target_host":  "example.com",
+		"nixos_config": "{ ... }: {}",
+		"ssh_args":     []interface{}{},
+	}
+	for _, arg := range sshArgs {
+		raw["ssh_args"] = append(raw["ssh_args"].([]interface{}), arg)
+	}
+	cfg := testNixosConfig(t, raw)
+	_, err := nix.RunCheck(cfg.GetRebuildConfig(), "true", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := ioutil.ReadFile(filepath.Join(f.dir, "ssh-args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+	expected := append(append([]string{}, sshArgs...), "root@example.com", "--", "true")
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("ssh was run with\n%q\nexpected\n%q", args, expected)
+	}
+}
+
+func TestCloseSSHMasters(t *testing.T) {
+	f := newFakeNix(t)
+	f.fakeTarget(t, 22, "/nix/store/00000000000000000000000000000000-nixos-system")
+	f.write(t, "target/ssh", fmt.Sprintf("#!/bin/sh\necho \"ssh $*\" >> %s/calls\n", f.dir))
+	sshControlDirOnce, sshControlDirPath = sync.Once{}, ""
+	t.Cleanup(func() { sshControlDirOnce, sshControlDirPath = sync.Once{}, "" })
+
+	dir := sshControlDir()
+	if dir == "" {
+		t.Skip("no directory for ssh control sockets")
+	}
+	socket := filepath.Join(dir, "0123456789abcdef")
+	err := ioutil.WriteFile(socket, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closeSSHMasters()
+	calls := f.calls(t, "ssh")
+	expected := []string{"ssh -o ControlPath=" + socket + " -O exit terraform-nix-mux"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("the masters were closed with\n%q\nexpected\n%q", calls, expected)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("%s was left behind: %v", dir, err)
+	}
+	// Later connections are not multiplexed.
+	if dir := sshControlDir(); dir != "" {
+		t.Errorf("a new control directory %s was made", dir)
+	}
+}
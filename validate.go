@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/andrewchambers/terraform-provider-nix/nix"
+)
+
+var nixIdentifierRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_'-]*$`)
+
+var noWhitespaceRegexp = regexp.MustCompile(`^\S*$`)
+
+var sshKeyTypeRegexp = regexp.MustCompile(`^(ssh|ecdsa|sk)-[a-z0-9@.-]+$`)
+
+var singleLineRegexp = regexp.MustCompile(`^[^\n]*$`)
+
+// gcAgeRegexp matches the ages nix-collect-garbage --delete-older-than takes.
+var gcAgeRegexp = regexp.MustCompile(`^[0-9]+d$`)
+
+// validateNixIdentifierKeys checks all keys of a map are valid nix identifiers.
+func validateNixIdentifierKeys(v interface{}, k string) ([]string, []error) {
+	var errs []error
+	for name := range v.(map[string]interface{}) {
+		if !nixIdentifierRegexp.MatchString(name) {
+			errs = append(errs, fmt.Errorf("%s: %q is not a valid nix identifier", k, name))
+		}
+	}
+	return nil, errs
+}
+
+// validateTrustedPublicKey checks a binary cache key has the name:base64 form
+// nix expects, such as those printed by nix-store --generate-binary-cache-key.
+func validateTrustedPublicKey(v interface{}, k string) ([]string, []error) {
+	key := v.(string)
+	i := strings.Index(key, ":")
+	if i < 1 {
+		return nil, []error{fmt.Errorf("%s: %q is not of the form name:base64", k, key)}
+	}
+	_, err := base64.StdEncoding.DecodeString(key[i+1:])
+	if err != nil {
+		return nil, []error{fmt.Errorf("%s: the key of %q is not valid base64: %s", k, key[:i], err)}
+	}
+	return nil, nil
+}
+
+// validateHostKey checks a host key is a public key line, optionally with
+// the host names of a known_hosts line, or a SHA256 fingerprint.
+func validateHostKey(v interface{}, k string) ([]string, []error) {
+	hostKey := v.(string)
+	if strings.HasPrefix(hostKey, "SHA256:") {
+		_, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(strings.TrimPrefix(hostKey, "SHA256:"), "="))
+		if err != nil {
+			return nil, []error{fmt.Errorf("%s: %q is not a valid SHA256 fingerprint", k, hostKey)}
+		}
+		return nil, nil
+	}
+
+	fields := strings.Fields(hostKey)
+	if len(fields) > 2 && !sshKeyTypeRegexp.MatchString(fields[0]) {
+		fields = fields[1:]
+	}
+	if len(fields) < 2 || !sshKeyTypeRegexp.MatchString(fields[0]) {
+		return nil, []error{fmt.Errorf("%s: must be a public key like \"ssh-ed25519 AAAA...\" or a fingerprint like \"SHA256:...\"", k)}
+	}
+	_, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, []error{fmt.Errorf("%s: the %s key is not valid base64: %s", k, fields[0], err)}
+	}
+	return nil, nil
+}
+
+// validateAbsolutePath checks a path on a target is absolute.
+func validateAbsolutePath(v interface{}, k string) ([]string, []error) {
+	if p := v.(string); !path.IsAbs(p) {
+		return nil, []error{fmt.Errorf("%s: %q is not an absolute path", k, p)}
+	}
+	return nil, nil
+}
+
+// validateCommandTemplate checks a command template renders, it may only
+// use the placeholders of nix.CommandTemplateData.
+func validateCommandTemplate(v interface{}, k string) ([]string, []error) {
+	_, err := nix.RenderCommandTemplate(v.(string), "root", "example", "true")
+	if err != nil {
+		return nil, []error{fmt.Errorf("%s: %s", k, err)}
+	}
+	return nil, nil
+}
+
+// byteUnits are the units parseByteSize accepts, in powers of 1024 like
+// nix uses.
+var byteUnits = map[string]int64{
+	"":  1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+var byteSizeRegexp = regexp.MustCompile(`^([0-9]+)\s*([KMGT]?)(?:I?B)?$`)
+
+// parseByteSize parses a size like 512M or 5G into bytes.
+func parseByteSize(s string) (int64, error) {
+	match := byteSizeRegexp.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(s)))
+	if match == nil {
+		return 0, fmt.Errorf("%q is not a size like 512M or 5G", s)
+	}
+	n, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is too large", s)
+	}
+	unit := byteUnits[match[2]]
+	if n > (1<<63-1)/unit {
+		return 0, fmt.Errorf("%q is too large", s)
+	}
+	return n * unit, nil
+}
+
+// validateByteSize checks a size can be parsed by parseByteSize.
+func validateByteSize(v interface{}, k string) ([]string, []error) {
+	_, err := parseByteSize(v.(string))
+	if err != nil {
+		return nil, []error{fmt.Errorf("%s: %s", k, err)}
+	}
+	return nil, nil
+}